@@ -0,0 +1,348 @@
+package db
+
+import (
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// A data file with flagBlocks groups its k-v pairs into blocks of about blockSize bytes,
+// and each block is compressed by the codec of the data file:
+//
+//	<file header, block..., block index, footer>
+//	block:  <compressed_size(4), raw_size(4), compressed k-v pairs>
+//	footer: <block_index_offset(8), block_count(4), magic(4)="FIBI">
+//
+// The block index is the offsets of blocks, 8 bytes each. The value_position of an index
+// item is the block number and the offset of the value in the decompressed block, so a
+// value is found by decompressing one block, which is cached for the following finds.
+
+const (
+	blockSize       = 64 * KB
+	blockHeaderSize = 8
+	blockFooterSize = 16
+	blockIndexMagic = "FIBI"
+
+	// blockPosBits is the bits of the offset in a decompressed block, the rest of the
+	// segment offset bits are the block number
+	blockPosBits = 24
+	blockPosMask = 1<<blockPosBits - 1
+	maxBlockNum  = 1 << (segmentOffsetBits - blockPosBits)
+
+	defaultBlockCacheSize = 64 * MB
+)
+
+// errBlockSegment is returned when appending to a data file with blocks, which is immutable
+var errBlockSegment = errors.New("the last segment is block compressed, it can't be appended")
+
+func packBlockPos(block int64, offset int64) int64 {
+	return block<<blockPosBits | offset&blockPosMask
+}
+
+func unpackBlockPos(pos int64) (int64, int64) {
+	return pos >> blockPosBits, pos & blockPosMask
+}
+
+// blockWriter groups k-v pairs into compressed blocks, and writes the block index and the
+// footer when it's closed
+type blockWriter struct {
+	w     io.Writer
+	codec codec
+	// offset is where the next block is written in the data file
+	offset  int64
+	raw     []byte
+	offsets []int64
+	// maxBlocks is the number of blocks addressable by a value_position
+	maxBlocks int64
+}
+
+func newBlockWriter(w io.Writer, codecID byte, offset int64) (*blockWriter, error) {
+	c, e := codecByID(codecID)
+	if e != nil {
+		return nil, e
+	}
+	return &blockWriter{w: w, codec: c, offset: offset, raw: make([]byte, 0, blockSize), maxBlocks: maxBlockNum}, nil
+}
+
+// nextPos returns the value_position of the value of the next k-v pair
+func (bw *blockWriter) nextPos() int64 {
+	return packBlockPos(int64(len(bw.offsets)), int64(len(bw.raw)+24))
+}
+
+// full tells whether the blocks written use up the block numbers, so no more k-v pairs
+// can be added
+func (bw *blockWriter) full() bool {
+	return int64(len(bw.offsets)) >= bw.maxBlocks
+}
+
+// add adds a k-v pair to the current block, and returns the value_position of its value
+func (bw *blockWriter) add(record []byte) (int64, error) {
+	if bw.full() {
+		return 0, fmt.Errorf("the segment has %d blocks, at most %d", len(bw.offsets), bw.maxBlocks)
+	}
+	if int64(len(bw.raw)+len(record)) > blockPosMask {
+		return 0, fmt.Errorf("k-v pair of %d bytes is too large for a block", len(record))
+	}
+
+	pos := bw.nextPos()
+	bw.raw = append(bw.raw, record...)
+	if int64(len(bw.raw)) >= blockSize {
+		return pos, bw.flush()
+	}
+	return pos, nil
+}
+
+// size returns the bytes written and buffered
+func (bw *blockWriter) size() int64 {
+	return bw.offset + int64(len(bw.raw))
+}
+
+// flush compresses the current block and writes it
+func (bw *blockWriter) flush() error {
+	if len(bw.raw) == 0 {
+		return nil
+	}
+	compressed, e := bw.codec.compress(bw.raw)
+	if e != nil {
+		return e
+	}
+
+	header := make([]byte, blockHeaderSize)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(compressed)))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(bw.raw)))
+	if _, e := bw.w.Write(header); e != nil {
+		return e
+	}
+	if _, e := bw.w.Write(compressed); e != nil {
+		return e
+	}
+
+	bw.offsets = append(bw.offsets, bw.offset)
+	bw.offset += int64(blockHeaderSize + len(compressed))
+	bw.raw = bw.raw[:0]
+	return nil
+}
+
+// close writes the last block, the block index and the footer
+func (bw *blockWriter) close() error {
+	if e := bw.flush(); e != nil {
+		return e
+	}
+
+	index := make([]byte, 8*len(bw.offsets)+blockFooterSize)
+	for i, off := range bw.offsets {
+		binary.BigEndian.PutUint64(index[i*8:], uint64(off))
+	}
+	footer := index[8*len(bw.offsets):]
+	binary.BigEndian.PutUint64(footer[0:8], uint64(bw.offset))
+	binary.BigEndian.PutUint32(footer[8:12], uint32(len(bw.offsets)))
+	copy(footer[12:16], blockIndexMagic)
+	if _, e := bw.w.Write(index); e != nil {
+		return e
+	}
+	bw.offset += int64(len(index))
+	return nil
+}
+
+// readBlockIndex reads the block offsets of a data file with blocks of size bytes, the
+// last offset is where the block index starts
+func readBlockIndex(r io.ReaderAt, format dataFormat, size int64) ([]int64, error) {
+	footer := make([]byte, blockFooterSize)
+	if size < format.headerSize+blockFooterSize {
+		return nil, errors.New("missing block index")
+	}
+	if _, e := r.ReadAt(footer, size-blockFooterSize); e != nil {
+		return nil, e
+	}
+	if string(footer[12:16]) != blockIndexMagic {
+		return nil, errors.New("missing block index")
+	}
+
+	indexOff := int64(binary.BigEndian.Uint64(footer[0:8]))
+	count := int64(binary.BigEndian.Uint32(footer[8:12]))
+	if indexOff < format.headerSize || indexOff+8*count+blockFooterSize != size {
+		return nil, errors.New("corrupt block index")
+	}
+
+	index := make([]byte, 8*count)
+	if _, e := r.ReadAt(index, indexOff); e != nil {
+		return nil, e
+	}
+	offsets := make([]int64, count+1)
+	for i := int64(0); i < count; i++ {
+		offsets[i] = int64(binary.BigEndian.Uint64(index[i*8:]))
+	}
+	offsets[count] = indexOff
+	return offsets, nil
+}
+
+// readBlock reads and decompresses the block in [from, to) of a data file
+func readBlock(r io.ReaderAt, format dataFormat, from int64, to int64) ([]byte, error) {
+	if to-from < blockHeaderSize {
+		return nil, errCorruptBlock
+	}
+	buf := make([]byte, to-from)
+	if _, e := r.ReadAt(buf, from); e != nil {
+		return nil, e
+	}
+
+	compressedSize := int64(binary.BigEndian.Uint32(buf[0:4]))
+	rawSize := int(binary.BigEndian.Uint32(buf[4:8]))
+	if blockHeaderSize+compressedSize != to-from || rawSize > blockPosMask {
+		return nil, errCorruptBlock
+	}
+	c, e := codecByID(format.codec)
+	if e != nil {
+		return nil, e
+	}
+	return c.decompress(buf[blockHeaderSize:], rawSize)
+}
+
+// scanBlocks indexes every k-v pair in the blocks of a segment. A block which can't be
+// decompressed or parsed is a corrupt k-v pair.
+func (fidx *FastIndex) scanBlocks(segment int, dfile *os.File, size int64, reporter *progressReporter,
+	parsed int64, records int64) (int64, int64, error) {
+	offsets, e := readBlockIndex(dfile, fidx.format, size)
+	if e != nil {
+		return 0, 0, fmt.Errorf("Build index : segment %d: %s", segment, e)
+	}
+	if len(offsets)-1 > maxBlockNum {
+		return 0, 0, fmt.Errorf("Build index : segment %d: %d blocks, at most %d", segment, len(offsets)-1, maxBlockNum)
+	}
+
+	valuePosByte := make([]byte, 8)
+	for block := 0; block+1 < len(offsets); block++ {
+		from, to := offsets[block], offsets[block+1]
+		raw, e := readBlock(dfile, fidx.format, from, to)
+		if e != nil {
+			if e := fidx.corruptAt(dfile, segment, from, to, e.Error()); e != nil {
+				return 0, 0, fmt.Errorf("Build index : %s", e)
+			}
+			continue
+		}
+
+		rawSize := int64(len(raw))
+		for off := int64(0); off < rawSize; {
+			reason := fidx.checkHeader(raw[off:], off, rawSize)
+			var recordSize int64
+			if reason == "" {
+				recordSize = fidx.format.recordSize(int64(binary.BigEndian.Uint64(raw[off+16 : off+24])))
+				if fidx.verifyChecksums && !fidx.format.verify(raw[off:off+recordSize]) {
+					reason = "checksum mismatch"
+				}
+			}
+			// the rest of the block can't be parsed, or the k-v pair has a wrong checksum
+			if reason != "" {
+				record := CorruptRecord{Segment: segment, Offset: from, Length: to - from,
+					Reason: fmt.Sprintf("%s in block %d at %d", reason, block, off)}
+				if e := fidx.corrupt(record, nil); e != nil {
+					return 0, 0, fmt.Errorf("Build index : %s", e)
+				}
+				if recordSize == 0 {
+					break
+				}
+				off += recordSize
+				continue
+			}
+
+			binary.BigEndian.PutUint64(valuePosByte, uint64(packValuePos(segment, packBlockPos(int64(block), off+24))))
+			if e := fidx.write(int64(binary.BigEndian.Uint64(raw[off+8:off+16])), raw[off+8:off+16], raw[off+16:off+24], valuePosByte); e != nil {
+				return 0, 0, e
+			}
+			off += recordSize
+			records++
+		}
+		reporter.scanned(parsed+to, records)
+	}
+
+	return parsed + size, records, nil
+}
+
+// readBlockValue reads the value of vsize bytes at offset of a segment with blocks, offset
+// is the block number and the offset in the decompressed block
+func (s *snapshot) readBlockValue(segment int, vsize int64, offset int64) ([]byte, error) {
+	block, off := unpackBlockPos(offset)
+	offsets := s.blockIndexes[segment]
+	if block+1 >= int64(len(offsets)) {
+		return nil, fmt.Errorf("invalid block %d of segment %d", block, segment)
+	}
+
+	raw, e := s.blockCache.get(blockKey{segment, block}, func() ([]byte, error) {
+		return readBlock(s.dataFiles[segment], s.formats[segment], offsets[block], offsets[block+1])
+	})
+	if e != nil {
+		return nil, e
+	}
+
+	format := s.formats[segment]
+	recordSize := format.recordSize(vsize)
+	if off < 24 || off-24+recordSize > int64(len(raw)) {
+		return nil, fmt.Errorf("invalid value position %d in block %d of segment %d", off, block, segment)
+	}
+	if s.db.verifyChecksums && !format.verify(raw[off-24:off-24+recordSize]) {
+		return nil, ErrChecksumMismatch
+	}
+
+	// the cached block is shared
+	value := make([]byte, vsize)
+	copy(value, raw[off:off+vsize])
+	return value, nil
+}
+
+// blockCache caches the decompressed blocks in LRU order within size bytes
+type blockCache struct {
+	sync.Mutex
+	size   int64
+	used   int64
+	lru    *list.List
+	blocks map[blockKey]*list.Element
+}
+
+type blockKey struct {
+	segment int
+	block   int64
+}
+
+type cachedBlock struct {
+	key blockKey
+	raw []byte
+}
+
+func newBlockCache(size int64) *blockCache {
+	return &blockCache{size: size, lru: list.New(), blocks: make(map[blockKey]*list.Element)}
+}
+
+// get returns the decompressed block, it's loaded by load if it's not cached. The block
+// must not be modified.
+func (c *blockCache) get(key blockKey, load func() ([]byte, error)) ([]byte, error) {
+	c.Lock()
+	if elem, ok := c.blocks[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.Unlock()
+		return elem.Value.(*cachedBlock).raw, nil
+	}
+	c.Unlock()
+
+	raw, e := load()
+	if e != nil {
+		return nil, e
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.blocks[key]; ok || int64(len(raw)) > c.size {
+		return raw, nil
+	}
+	c.blocks[key] = c.lru.PushFront(&cachedBlock{key: key, raw: raw})
+	c.used += int64(len(raw))
+	for c.used > c.size {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachedBlock)
+		delete(c.blocks, oldest.key)
+		c.used -= int64(len(oldest.raw))
+	}
+	return raw, nil
+}
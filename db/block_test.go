@@ -0,0 +1,283 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// writeBlocks writes k-v pairs into a data file with blocks of codec
+func writeBlocks(t *testing.T, path string, codec byte, keys []int64, values []string) {
+	format, _ := newDataFormat(DataFileV2)
+	w := &segmentWriter{path: path, format: format.withBlocks(codec)}
+	for i, key := range keys {
+		if _, _, e := w.writeRecord(w.format.encodeRecord(key, int64(len(values[i])), []byte(values[i]))); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := w.close(); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func Test_block_writer(t *testing.T) {
+	format, _ := newDataFormat(DataFileV2)
+	format = format.withBlocks(codecLZ4)
+	buf := bytes.NewBuffer(format.encodeHeader())
+	bw, e := newBlockWriter(buf, format.codec, format.headerSize)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// 3 blocks of 64KB
+	value := bytes.Repeat([]byte("v"), int(KB))
+	positions := make([]int64, 0)
+	for i := int64(0); i < 150; i++ {
+		pos, e := bw.add(format.encodeRecord(i, int64(len(value)), value))
+		if e != nil {
+			t.Fatal(e)
+		}
+		positions = append(positions, pos)
+	}
+	if e := bw.close(); e != nil {
+		t.Fatal(e)
+	}
+	if bw.offset != int64(buf.Len()) {
+		t.Errorf("offset:%d, expected %d", bw.offset, buf.Len())
+	}
+
+	data := bytes.NewReader(buf.Bytes())
+	offsets, e := readBlockIndex(data, format, int64(buf.Len()))
+	if e != nil || len(offsets) != 4 || offsets[0] != format.headerSize {
+		t.Fatalf("offsets:%v, e:%v, expected 3 blocks", offsets, e)
+	}
+	for i, pos := range positions {
+		block, off := unpackBlockPos(pos)
+		raw, e := readBlock(data, format, offsets[block], offsets[block+1])
+		if e != nil {
+			t.Fatal(e)
+		}
+		record := raw[off-24 : off-24+format.recordSize(int64(len(value)))]
+		if !format.verify(record) || !bytes.Equal(record, format.encodeRecord(int64(i), int64(len(value)), value)) {
+			t.Errorf("k-v pair %d at block %d offset %d differs", i, block, off)
+		}
+	}
+
+	if _, e := readBlockIndex(data, format, int64(buf.Len())-1); e == nil {
+		t.Error("expected an error for a missing block index")
+	}
+	if _, e := readBlock(data, format, offsets[0], offsets[1]-1); e == nil {
+		t.Error("expected an error for a truncated block")
+	}
+}
+
+func Test_block_writer_max_blocks(t *testing.T) {
+	// the last valid block packed into a value_position of the last segment
+	pos := packValuePos(maxSegmentNum-1, packBlockPos(maxBlockNum-1, blockPosMask))
+	segment, offset := unpackValuePos(pos)
+	if block, off := unpackBlockPos(offset); segment != maxSegmentNum-1 || block != maxBlockNum-1 || off != blockPosMask {
+		t.Errorf("segment:%d, block:%d, offset:%d, expected the last ones", segment, block, off)
+	}
+
+	// a block writer refuses k-v pairs when the block numbers are used up
+	format, _ := newDataFormat(DataFileV2)
+	format = format.withBlocks(codecLZ4)
+	bw, e := newBlockWriter(bytes.NewBuffer(nil), format.codec, format.headerSize)
+	if e != nil {
+		t.Fatal(e)
+	}
+	bw.maxBlocks = 2
+	value := bytes.Repeat([]byte("v"), int(blockSize))
+	for i := int64(0); i < 2; i++ {
+		if _, e := bw.add(format.encodeRecord(i, int64(len(value)), value)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if _, e := bw.add(format.encodeRecord(2, 1, []byte("v"))); e == nil {
+		t.Error("expected an error adding to a full block writer")
+	}
+
+	// and a segment writer rotates the segment
+	dir, clean := tempDir(t)
+	defer clean()
+	w := &segmentWriter{path: dir + "/data.d", format: format}
+	for i := int64(0); i < 3; i++ {
+		if _, _, e := w.writeRecord(format.encodeRecord(i, int64(len(value)), value)); e != nil {
+			t.Fatal(e)
+		}
+		w.blocks.maxBlocks = 2
+	}
+	if e := w.close(); e != nil {
+		t.Fatal(e)
+	}
+	if len(w.segments) != 2 {
+		t.Errorf("segments:%v, expected 2", w.segments)
+	}
+}
+
+func Test_data_file_gen_blocks(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	gen := &DataFileGen{
+		maxKey:         1 << 20,
+		maxValueLength: 256,
+		writeBufSize:   int(4 * KB),
+		maxSize:        512 * KB,
+		maxSegmentSize: 16 * KB,
+		codec:          codecFlate,
+		path:           dir + "/data/data.d",
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+
+	var size int64 = 0
+	segments, _ := listSegments(dir + "/data")
+	for _, segment := range segments {
+		info, _ := os.Stat(dir + "/data/" + segment)
+		size += info.Size()
+	}
+	// the values are repeated keys, and a segment is rotated by its compressed size
+	if len(segments) < 2 || size > gen.maxSize/2 {
+		t.Errorf("segments:%v of %d bytes, expected rotated and compressed", segments, size)
+	}
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	if len(db.CorruptRecords()) != 0 {
+		t.Errorf("corrupt records:%v", db.CorruptRecords())
+	}
+	db.InitFind()
+
+	found := 0
+	for i, segment := range segments {
+		f, _ := os.Open(dir + "/data/" + segment)
+		info, _ := f.Stat()
+		e := forEachRecord(f, db.formats[i], i, info.Size(), 0, func(record []byte, valuePos int64, read int64) error {
+			key := int64(binary.BigEndian.Uint64(record[8:16]))
+			value, e := db.Get(key)
+			if e != nil || strings.Trim(string(value), strconv.FormatInt(key, 10)) != "" {
+				t.Errorf("key:%d, v:%s, e:%v", key, value, e)
+			}
+			found++
+			return nil
+		}, nil)
+		f.Close()
+		if e != nil {
+			t.Fatal(e)
+		}
+	}
+	if found == 0 {
+		t.Error("no k-v pairs in the blocks")
+	}
+}
+
+func Test_db_blocks(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	if e := db.Put(2, []byte("new bb")); e != nil {
+		t.Fatal(e)
+	}
+
+	expected := map[int64]string{1: "a", 2: "new bb", 3: "ccc"}
+	check := func(stage string) {
+		for k, v := range expected {
+			if found, e := db.Get(k); e != nil || string(found) != v {
+				t.Errorf("%s key:%d, v:%s, e:%v, expected %s", stage, k, found, e, v)
+			}
+		}
+	}
+
+	// compaction converts the data file into blocks, which are immutable
+	if e := db.SetBlockCompression("lz4"); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	check("compressed")
+	if !db.formats[0].blocked() || db.formats[0].codec != codecLZ4 {
+		t.Errorf("format:%+v, expected lz4 blocks", db.formats[0])
+	}
+	if e := db.Put(4, []byte("dddd")); e != errBlockSegment {
+		t.Errorf("e:%v, expected errBlockSegment", e)
+	}
+
+	db.Close()
+	db = OpenDB(dir)
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	db.InitFind()
+	check("rebuilt")
+
+	// and back into a writable data file
+	db.SetDataFileVersion(DataFileV1)
+	db.SetBlockCompression("none")
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	check("decompressed")
+	if e := db.Put(4, []byte("dddd")); e != nil {
+		t.Fatal(e)
+	}
+	expected[4] = "dddd"
+	check("put")
+
+	// a stream with blocks can't be ingested
+	data, _ := ioutil.ReadFile(dir + "/data/data.d")
+	writeBlocks(t, dir+"/blocks/data.d", codecFlate, []int64{1}, []string{"a"})
+	blocks, _ := ioutil.ReadFile(dir + "/blocks/data.d")
+	fidx := newTestIndex(t, dir+"/stream_index", 4)
+	if e := fidx.BuildFromReader(bytes.NewReader(blocks), dir+"/stream/data.d", int(KB)); e == nil {
+		t.Error("expected an error for a stream with blocks")
+	}
+	if format, _ := parseDataFormat(data); format != formatV1 {
+		t.Errorf("format:%+v, expected v1", format)
+	}
+}
+
+func Test_block_cache(t *testing.T) {
+	cache := newBlockCache(10)
+	loads := 0
+	load := func(size int) func() ([]byte, error) {
+		return func() ([]byte, error) {
+			loads++
+			return make([]byte, size), nil
+		}
+	}
+
+	cache.get(blockKey{0, 0}, load(4))
+	cache.get(blockKey{0, 1}, load(4))
+	cache.get(blockKey{0, 0}, load(4))
+	if loads != 2 || cache.used != 8 {
+		t.Errorf("loads:%d, used:%d, expected 2 and 8", loads, cache.used)
+	}
+
+	// block 1 is the least recently used
+	cache.get(blockKey{1, 0}, load(4))
+	if _, ok := cache.blocks[blockKey{0, 1}]; ok || cache.used != 8 {
+		t.Errorf("used:%d, expected block 1 evicted", cache.used)
+	}
+	cache.get(blockKey{0, 0}, load(4))
+	if loads != 3 {
+		t.Errorf("loads:%d, expected block 0 cached", loads)
+	}
+
+	// a block larger than the cache isn't cached
+	if raw, _ := cache.get(blockKey{2, 0}, load(11)); len(raw) != 11 || cache.used != 8 {
+		t.Errorf("used:%d, expected the large block not cached", cache.used)
+	}
+}
@@ -0,0 +1,170 @@
+package db
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Build buffers the index items of every indexShard before writing them into index
+// files. With thousands of shards the buffers would take memory in proportion to the
+// shard count, so all shards share a bufferPool. The pool hands out fixed-size blocks
+// within a memory budget, and when the budget is used up, the shards holding most
+// blocks are flushed to give their blocks back before Build can go on. The blocks are
+// dropped after the last flush, and the budget goes to sorting the index files, see
+// IndexShard.sort.
+
+// poolBlockSize is about 4KB and holds whole index items
+const poolBlockSize = 170 * fixIndexItemSize
+
+// minMemoryBudget keeps the read buffer and some blocks of the pool
+const minMemoryBudget = 4 * MB
+
+// defaultMergeBufSize is the buffer of a sorted run to merge without a budget, and
+// minMergeBufSize the least one within a budget
+const (
+	defaultMergeBufSize = 64 * KB
+	minMergeBufSize     = 4 * KB
+)
+
+type bufferPool struct {
+	blockSize int
+	// budget is the max bytes of all blocks, 0 means unlimited
+	budget int64
+	used   int64
+	free   [][]byte
+
+	// shards which could be flushed to reclaim blocks
+	shards []*IndexShard
+}
+
+func newBufferPool(budget int64) *bufferPool {
+	return &bufferPool{
+		blockSize: poolBlockSize,
+		budget:    budget,
+	}
+}
+
+// get returns an empty block, it flushes the largest shards when the budget is used up
+func (p *bufferPool) get() ([]byte, error) {
+	if len(p.free) == 0 {
+		if p.budget > 0 && p.used+int64(p.blockSize) > p.budget {
+			if e := p.reclaim(); e != nil {
+				return nil, e
+			}
+		}
+	}
+
+	if n := len(p.free); n > 0 {
+		block := p.free[n-1]
+		p.free = p.free[:n-1]
+		return block, nil
+	}
+	p.used += int64(p.blockSize)
+	return make([]byte, 0, p.blockSize), nil
+}
+
+// put gives a block back to the pool
+func (p *bufferPool) put(block []byte) {
+	p.free = append(p.free, block[:0])
+}
+
+// release drops the free blocks once every shard is flushed, so the budget is left to sort
+func (p *bufferPool) release() {
+	p.used -= int64(len(p.free) * p.blockSize)
+	p.free = nil
+}
+
+// runSize returns the bytes of index items sorted in memory at once within the budget,
+// 0 means unlimited
+func (p *bufferPool) runSize() int64 {
+	if p.budget <= 0 {
+		return 0
+	}
+	return p.budget - p.budget%fixIndexItemSize
+}
+
+// mergeFanIn returns how many of n sorted runs are merged at once, so the buffers of them
+// and the merged file are at least minMergeBufSize within the budget. The runs beyond it
+// are merged in more passes.
+func (p *bufferPool) mergeFanIn(n int) int {
+	if p.budget <= 0 {
+		return n
+	}
+	fanIn := int(p.budget/minMergeBufSize) - 1
+	if fanIn < 2 {
+		fanIn = 2
+	}
+	if n < fanIn {
+		return n
+	}
+	return fanIn
+}
+
+// mergeBufSize returns the buffer of every one of n sorted runs and the merged file to
+// merge within the budget, n is at most mergeFanIn
+func (p *bufferPool) mergeBufSize(n int) int {
+	if p.budget <= 0 {
+		return int(defaultMergeBufSize)
+	}
+	if size := p.budget / int64(n); size < defaultMergeBufSize {
+		return int(size)
+	}
+	return int(defaultMergeBufSize)
+}
+
+// reserve takes n bytes of the budget from the blocks for a buffer outside the pool, the
+// free blocks are dropped and the shards flushed until the blocks are within the rest
+func (p *bufferPool) reserve(n int64) error {
+	if p.budget <= 0 {
+		return nil
+	}
+	if p.budget-n < int64(p.blockSize) {
+		return fmt.Errorf("buffer of %d bytes exceeds the memory budget", n)
+	}
+	p.budget -= n
+	for p.used > p.budget {
+		if len(p.free) == 0 {
+			if e := p.reclaim(); e != nil {
+				return e
+			}
+			if len(p.free) == 0 {
+				break
+			}
+		}
+		p.free = p.free[:len(p.free)-1]
+		p.used -= int64(p.blockSize)
+	}
+	return nil
+}
+
+// unreserve gives the n bytes reserved back to the budget
+func (p *bufferPool) unreserve(n int64) {
+	if p.budget > 0 {
+		p.budget += n
+	}
+}
+
+// reclaim flushes the shards holding most blocks, until a quarter of the budget is free,
+// so the following writes won't flush every time
+func (p *bufferPool) reclaim() error {
+	holders := make([]*IndexShard, 0)
+	for _, shard := range p.shards {
+		if len(shard.blocks) > 0 {
+			holders = append(holders, shard)
+		}
+	}
+	sort.Slice(holders, func(i, j int) bool {
+		return len(holders[i].blocks) > len(holders[j].blocks)
+	})
+
+	target := p.budget / 4
+	for _, shard := range holders {
+		if int64(len(p.free)*p.blockSize) >= target {
+			break
+		}
+		if e := shard.flush(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
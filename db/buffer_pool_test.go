@@ -0,0 +1,261 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_buffer_pool_reclaim(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	budget := int64(8 * poolBlockSize)
+	fidx := newTestIndex(t, dir, 4)
+	fidx.pool.budget = budget
+	for _, shard := range fidx.shards {
+		shard.writeBufSize = int(MB)
+	}
+
+	// shard 0 holds most blocks, and is flushed first
+	_buf := make([]byte, 8)
+	for i := 0; i < 5*170; i++ {
+		fidx.shards[0].Write(_buf, _buf, _buf)
+	}
+	for shard := 1; shard < 4; shard++ {
+		for i := 0; i < 170; i++ {
+			fidx.shards[shard].Write(_buf, _buf, _buf)
+		}
+	}
+	if fidx.pool.used != budget {
+		t.Fatalf("pool used %d, expected %d", fidx.pool.used, budget)
+	}
+
+	fidx.shards[1].Write(_buf, _buf, _buf)
+	if fidx.pool.used > budget {
+		t.Errorf("pool used %d, over budget %d", fidx.pool.used, budget)
+	}
+	if fidx.shards[0].buffered != 0 || fidx.shards[0].totalSize != 5*poolBlockSize {
+		t.Errorf("shard 0 buffered %d, wrote %d, expected to be flushed", fidx.shards[0].buffered, fidx.shards[0].totalSize)
+	}
+	if fidx.shards[2].buffered != poolBlockSize {
+		t.Errorf("shard 2 buffered %d, expected not to be flushed", fidx.shards[2].buffered)
+	}
+}
+
+func Test_fast_index_build_memory_budget(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	dataPath := dir + "/data/data.d"
+	gen := &DataFileGen{
+		maxKey:         1 << 20,
+		maxValueLength: 16,
+		writeBufSize:   int(64 * KB),
+		maxSize:        8 * MB,
+		path:           dataPath,
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+
+	shardNum := 512
+	buildTestIndex(t, dir+"/index", shardNum, dataPath, int(64*MB))
+
+	fidx := newTestIndex(t, dir+"/budget_index", shardNum)
+	fidx.SetMemoryBudget(minMemoryBudget)
+	if e := fidx.Build(dataPath, int(64*MB)); e != nil {
+		t.Fatal(e)
+	}
+	if fidx.pool.used > fidx.pool.budget || fidx.pool.budget > minMemoryBudget-MB {
+		t.Errorf("pool used %d of budget %d", fidx.pool.used, fidx.pool.budget)
+	}
+
+	for i := 0; i < shardNum; i++ {
+		name := "/index_" + strconv.Itoa(i) + ".idx"
+		expected, _ := ioutil.ReadFile(dir + "/index" + name)
+		idx, _ := ioutil.ReadFile(dir + "/budget_index" + name)
+		if len(expected) == 0 || !bytes.Equal(idx, expected) {
+			t.Fatalf("index shard %d differs from the unlimited build", i)
+		}
+	}
+}
+
+func Test_index_shard_sort_in_place(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	idx, e := NewIndexShard(dir, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	items := [][3]int64{{5, 1, 300}, {3, 1, 200}, {5, 2, 100}, {1, 1, 400}}
+	_buf := make([]byte, 24)
+	for _, item := range items {
+		for i, v := range item {
+			binary.BigEndian.PutUint64(_buf[i*8:], uint64(v))
+		}
+		if e := idx.Write(_buf[:8], _buf[8:16], _buf[16:]); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := idx.writeCompletely(); e != nil {
+		t.Fatal(e)
+	}
+	if e := idx.sort(); e != nil {
+		t.Fatal(e)
+	}
+
+	sorted, _ := ioutil.ReadFile(idx.fileName)
+	expected := [][3]int64{{1, 1, 400}, {3, 1, 200}, {5, 2, 100}, {5, 1, 300}}
+	for i, item := range expected {
+		got := convertByteToItem(sorted[i*24 : (i+1)*24])
+		if got.key != item[0] || got.vsz != item[1] || got.vpos != item[2] {
+			t.Errorf("item %d: %v, expected %v", i, *got, item)
+		}
+	}
+}
+
+func Test_buffer_pool_reclaim_error(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	fidx := newTestIndex(t, dir, 2)
+	fidx.pool.budget = int64(2 * poolBlockSize)
+	for _, shard := range fidx.shards {
+		shard.writeBufSize = int(MB)
+	}
+	_buf := make([]byte, 8)
+	for i := 0; i < 2*170; i++ {
+		fidx.shards[0].Write(_buf, _buf, _buf)
+	}
+
+	// the flush to reclaim fails, and the blocks are still held by shard 0
+	fidx.shards[0].file.Close()
+	if e := fidx.shards[1].Write(_buf, _buf, _buf); e == nil {
+		t.Fatal("expected the failed flush to be returned")
+	}
+	if len(fidx.pool.free) != 0 || len(fidx.shards[0].blocks) != 2 || fidx.shards[0].buffered != 2*poolBlockSize {
+		t.Errorf("%d free blocks, shard 0 holds %d blocks, expected the blocks held", len(fidx.pool.free), len(fidx.shards[0].blocks))
+	}
+}
+
+func Test_index_shard_sort_runs(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	idx, e := NewIndexShard(dir, 0)
+	if e != nil {
+		t.Fatal(e)
+	}
+	// runs of 4 items, the last one is short
+	idx.pool.budget = 4*fixIndexItemSize + 10
+	keys := rand.Perm(30)
+	_buf := make([]byte, 24)
+	for i, key := range keys {
+		binary.BigEndian.PutUint64(_buf[0:8], uint64(key/2))
+		binary.BigEndian.PutUint64(_buf[8:16], 1)
+		binary.BigEndian.PutUint64(_buf[16:24], uint64(i))
+		if e := idx.Write(_buf[:8], _buf[8:16], _buf[16:]); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := idx.writeCompletely(); e != nil {
+		t.Fatal(e)
+	}
+	if e := idx.sort(); e != nil {
+		t.Fatal(e)
+	}
+	idx.file.Close()
+
+	sorted, _ := ioutil.ReadFile(idx.fileName)
+	if len(sorted) != len(keys)*fixIndexItemSize {
+		t.Fatalf("sorted %d bytes, expected %d", len(sorted), len(keys)*fixIndexItemSize)
+	}
+	for i := 1; i < len(keys); i++ {
+		if lessItem(sorted[i*24:], sorted[(i-1)*24:]) {
+			t.Fatalf("item %d is less than the one before", i)
+		}
+	}
+	if _, e := os.Stat(idx.fileName + ".merge"); !os.IsNotExist(e) {
+		t.Errorf("e:%v, expected the merged file renamed", e)
+	}
+}
+
+func Test_buffer_pool_merge_within_budget(t *testing.T) {
+	p := newBufferPool(10 * minMergeBufSize)
+
+	// 100 runs are merged by 9 at a time, so the buffers of them and the merged file fit
+	fanIn := p.mergeFanIn(100)
+	if fanIn != 9 || int64((fanIn+1)*p.mergeBufSize(fanIn+1)) > p.budget {
+		t.Errorf("fan-in %d, buffer %d, expected within budget %d", fanIn, p.mergeBufSize(fanIn+1), p.budget)
+	}
+	if fanIn := p.mergeFanIn(3); fanIn != 3 {
+		t.Errorf("fan-in %d, expected 3 runs merged at once", fanIn)
+	}
+	if fanIn := newBufferPool(0).mergeFanIn(100); fanIn != 100 {
+		t.Errorf("fan-in %d, expected every run merged at once without a budget", fanIn)
+	}
+}
+
+func Test_buffer_pool_reserve(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	budget := int64(8 * poolBlockSize)
+	fidx := newTestIndex(t, dir, 2)
+	fidx.pool.budget = budget
+	for _, shard := range fidx.shards {
+		shard.writeBufSize = int(MB)
+	}
+	_buf := make([]byte, 8)
+	for i := 0; i < 8*170; i++ {
+		fidx.shards[i%2].Write(_buf, _buf, _buf)
+	}
+
+	// the blocks give way to the buffer reserved
+	if e := fidx.pool.reserve(3 * poolBlockSize); e != nil {
+		t.Fatal(e)
+	}
+	if fidx.pool.budget != budget-3*poolBlockSize || fidx.pool.used > fidx.pool.budget {
+		t.Errorf("pool used %d of budget %d, expected within %d", fidx.pool.used, fidx.pool.budget, budget-3*poolBlockSize)
+	}
+	fidx.pool.unreserve(3 * poolBlockSize)
+	if fidx.pool.budget != budget {
+		t.Errorf("budget %d, expected %d given back", fidx.pool.budget, budget)
+	}
+	if e := fidx.pool.reserve(budget); e == nil {
+		t.Error("expected an error for a buffer over the budget")
+	}
+}
+
+func Test_fast_index_build_large_record_budget(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	// the read buffer grows for a large value within the budget, and the blocks give way
+	dataPath := dir + "/data/data.d"
+	writeRecords(t, dataPath, []int64{1, 2}, []string{"a", strings.Repeat("b", int(3*MB/2))})
+	fidx := newTestIndex(t, dir+"/index", 4)
+	fidx.SetMemoryBudget(minMemoryBudget)
+	if e := fidx.Build(dataPath, int(MB)); e != nil {
+		t.Fatal(e)
+	}
+	if fidx.pool.budget != minMemoryBudget-MB {
+		t.Errorf("budget %d, expected the grown buffer given back", fidx.pool.budget)
+	}
+
+	// but a value larger than the budget stops the build
+	writeRecords(t, dataPath, []int64{1}, []string{strings.Repeat("c", int(minMemoryBudget))})
+	fidx = newTestIndex(t, dir+"/index", 4)
+	fidx.SetMemoryBudget(minMemoryBudget)
+	fidx.maxValueSize = 64 * MB
+	if e := fidx.Build(dataPath, int(MB)); e == nil || !strings.Contains(e.Error(), "memory budget") {
+		t.Errorf("e:%v, expected the value over the memory budget", e)
+	}
+}
@@ -0,0 +1,109 @@
+package db
+
+import "time"
+
+// Build reports how far it got through a ProgressFunc, so a multi-hour build
+// doesn't look like a hang. A build goes through three phases: scan parses the
+// data file into the shard buffers, flush writes the remaining buffers into the
+// index files, and sort sorts every index file.
+
+type BuildPhase string
+
+const (
+	PhaseScan  BuildPhase = "scan"
+	PhaseFlush BuildPhase = "flush"
+	PhaseSort  BuildPhase = "sort"
+)
+
+type BuildProgress struct {
+	Phase BuildPhase
+
+	// BytesParsed is how many bytes of the data file have been indexed
+	BytesParsed int64
+	// TotalBytes is 0 if the size is unknown, such as building from a stream
+	TotalBytes int64
+	// Records is the number of k-v pairs that have been indexed
+	Records int64
+
+	// ShardsDone is the number of shards finished in flush or sort phase
+	ShardsDone int
+	ShardNum   int
+
+	// Throughput is the scan speed in bytes per second
+	Throughput float64
+
+	Elapsed      time.Duration
+	PhaseElapsed time.Duration
+}
+
+type ProgressFunc func(p BuildProgress)
+
+// ETA estimates the remaining time of the current phase, or -1 if it's unknown yet
+func (p BuildProgress) ETA() time.Duration {
+	if p.Phase == PhaseScan {
+		if p.Throughput <= 0 || p.TotalBytes <= 0 {
+			return -1
+		}
+		remain := float64(p.TotalBytes - p.BytesParsed)
+		return time.Duration(remain / p.Throughput * float64(time.Second))
+	}
+
+	if p.ShardsDone <= 0 {
+		return -1
+	}
+	perShard := p.PhaseElapsed / time.Duration(p.ShardsDone)
+	return perShard * time.Duration(p.ShardNum-p.ShardsDone)
+}
+
+type progressReporter struct {
+	fn         ProgressFunc
+	start      time.Time
+	phaseStart time.Time
+	p          BuildProgress
+}
+
+func newProgressReporter(fn ProgressFunc, totalBytes int64, shardNum int) *progressReporter {
+	now := time.Now()
+	return &progressReporter{
+		fn:         fn,
+		start:      now,
+		phaseStart: now,
+		p: BuildProgress{
+			Phase:      PhaseScan,
+			TotalBytes: totalBytes,
+			ShardNum:   shardNum,
+		},
+	}
+}
+
+func (r *progressReporter) phase(phase BuildPhase) {
+	r.p.Phase = phase
+	r.p.ShardsDone = 0
+	r.phaseStart = time.Now()
+	r.report()
+}
+
+func (r *progressReporter) scanned(bytesParsed int64, records int64) {
+	r.p.BytesParsed = bytesParsed
+	r.p.Records = records
+	r.report()
+}
+
+func (r *progressReporter) shardDone(shardsDone int) {
+	r.p.ShardsDone = shardsDone
+	r.report()
+}
+
+func (r *progressReporter) report() {
+	if r.fn == nil {
+		return
+	}
+
+	now := time.Now()
+	r.p.Elapsed = now.Sub(r.start)
+	r.p.PhaseElapsed = now.Sub(r.phaseStart)
+	if r.p.Phase == PhaseScan && r.p.PhaseElapsed > 0 {
+		r.p.Throughput = float64(r.p.BytesParsed) / r.p.PhaseElapsed.Seconds()
+	}
+	r.fn(r.p)
+}
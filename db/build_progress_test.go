@@ -0,0 +1,70 @@
+package db
+
+import (
+	"os"
+	"testing"
+)
+
+func Test_build_progress(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	dataPath := dir + "/data/data.d"
+	gen := &DataFileGen{
+		maxKey:         1 << 20,
+		maxValueLength: 64,
+		writeBufSize:   int(4 * KB),
+		maxSize:        256 * KB,
+		path:           dataPath,
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+	dfInfo, e := os.Stat(dataPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	var reports []BuildProgress
+	fidx := newTestIndex(t, dir+"/index", 8)
+	fidx.OnProgress(func(p BuildProgress) {
+		reports = append(reports, p)
+	})
+	if e := fidx.Build(dataPath, int(16*KB)); e != nil {
+		t.Fatal(e)
+	}
+
+	if len(reports) == 0 {
+		t.Fatal("no progress reported")
+	}
+
+	phases := []BuildPhase{}
+	for _, p := range reports {
+		if len(phases) == 0 || phases[len(phases)-1] != p.Phase {
+			phases = append(phases, p.Phase)
+		}
+	}
+	expected := []BuildPhase{PhaseScan, PhaseFlush, PhaseSort}
+	if len(phases) != len(expected) {
+		t.Fatalf("phases: %v, expected %v", phases, expected)
+	}
+	for i := range expected {
+		if phases[i] != expected[i] {
+			t.Fatalf("phases: %v, expected %v", phases, expected)
+		}
+	}
+
+	last := reports[len(reports)-1]
+	if last.BytesParsed != dfInfo.Size() || last.TotalBytes != dfInfo.Size() {
+		t.Errorf("parsed %d of %d bytes, expected %d", last.BytesParsed, last.TotalBytes, dfInfo.Size())
+	}
+	if last.Records <= 0 {
+		t.Errorf("no records indexed")
+	}
+	if last.ShardsDone != 8 || last.ShardNum != 8 {
+		t.Errorf("sorted %d of %d shards, expected 8", last.ShardsDone, last.ShardNum)
+	}
+	if last.ETA() != 0 {
+		t.Errorf("ETA of a finished build is %v", last.ETA())
+	}
+}
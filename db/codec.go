@@ -0,0 +1,266 @@
+package db
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// A codec compresses blocks of k-v pairs. Its ID is saved in the data file, so a data
+// file is decompressed with the codec it was compressed with. flate is from the standard
+// library, and lz4 is a built-in codec of the LZ4 block format, which compresses less
+// but decompresses several times faster. stored keeps a block as it is, for the blocks
+// of SortData without a codec set, which are there for their block index.
+
+const (
+	codecNone  byte = 0
+	codecFlate byte = 1
+	codecLZ4   byte = 2
+	// codecStored isn't a name of -compress, codecNone means no blocks
+	codecStored byte = 3
+)
+
+type codec interface {
+	compress(src []byte) ([]byte, error)
+	// decompress decompresses src into rawSize bytes
+	decompress(src []byte, rawSize int) ([]byte, error)
+}
+
+var codecs = map[byte]codec{
+	codecFlate:  flateCodec{},
+	codecLZ4:    lz4Codec{},
+	codecStored: storedCodec{},
+}
+
+var codecNames = map[string]byte{
+	"none":  codecNone,
+	"flate": codecFlate,
+	"lz4":   codecLZ4,
+}
+
+// codecByName returns the ID of a codec: none, flate or lz4
+func codecByName(name string) (byte, error) {
+	id, ok := codecNames[name]
+	if !ok {
+		return codecNone, fmt.Errorf("unknown codec %s", name)
+	}
+	return id, nil
+}
+
+func codecByID(id byte) (codec, error) {
+	c, ok := codecs[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %d", id)
+	}
+	return c, nil
+}
+
+var errCorruptBlock = errors.New("corrupt compressed block")
+
+type storedCodec struct{}
+
+func (storedCodec) compress(src []byte) ([]byte, error) {
+	return append([]byte{}, src...), nil
+}
+
+func (storedCodec) decompress(src []byte, rawSize int) ([]byte, error) {
+	if len(src) != rawSize {
+		return nil, errCorruptBlock
+	}
+	return append([]byte{}, src...), nil
+}
+
+type flateCodec struct{}
+
+// the writers and hash tables are reused, they are large for compressing a single value
+var (
+	flateWriters = sync.Pool{New: func() interface{} {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	}}
+	lz4Tables = sync.Pool{New: func() interface{} {
+		return make([]int32, 1<<lz4HashLog)
+	}}
+)
+
+func (flateCodec) compress(src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(src)/2))
+	w := flateWriters.Get().(*flate.Writer)
+	defer flateWriters.Put(w)
+	w.Reset(buf)
+	if _, e := w.Write(src); e != nil {
+		return nil, e
+	}
+	if e := w.Close(); e != nil {
+		return nil, e
+	}
+	return buf.Bytes(), nil
+}
+
+func (flateCodec) decompress(src []byte, rawSize int) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(src))
+	defer r.Close()
+	raw := make([]byte, rawSize)
+	if _, e := io.ReadFull(r, raw); e != nil {
+		return nil, errCorruptBlock
+	}
+	return raw, nil
+}
+
+// lz4Codec encodes a block as sequences of <token, literal_length+, literals, offset(2),
+// match_length+>, the high 4 bits of token are the literal length and the low 4 bits
+// are the match length minus 4, 15 means more bytes of length follow.
+type lz4Codec struct{}
+
+const (
+	lz4MinMatch    = 4
+	lz4HashLog     = 16
+	lz4MaxOffset   = 1<<16 - 1
+	lz4LastLiteral = 5
+	// no match starts in the last 12 bytes
+	lz4MatchLimit = 12
+)
+
+func (lz4Codec) compress(src []byte) ([]byte, error) {
+	dst := make([]byte, 0, len(src)/2+16)
+	// table saves the last position+1 of a 4-byte sequence by its hash
+	// a short src, such as a value, is hashed into a smaller table
+	hashLog := uint32(lz4HashLog)
+	for hashLog > 8 && 1<<(hashLog-2) > len(src) {
+		hashLog--
+	}
+	pooled := lz4Tables.Get().([]int32)
+	defer lz4Tables.Put(pooled)
+	table := pooled[:1<<hashLog]
+	for i := range table {
+		table[i] = 0
+	}
+
+	anchor := 0
+	i := 0
+	for i+lz4MatchLimit <= len(src) {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - hashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+
+		matchLen := lz4MinMatch
+		for i+matchLen < len(src)-lz4LastLiteral && src[ref+matchLen] == src[i+matchLen] {
+			matchLen++
+		}
+		dst = lz4Sequence(dst, src[anchor:i], i-ref, matchLen)
+		i += matchLen
+		anchor = i
+	}
+	return lz4Sequence(dst, src[anchor:], 0, 0), nil
+}
+
+// lz4Sequence appends a sequence of literals and a match, the last sequence has no match
+func lz4Sequence(dst []byte, literals []byte, offset int, matchLen int) []byte {
+	token := byte(0)
+	if len(literals) >= 15 {
+		token = 15 << 4
+	} else {
+		token = byte(len(literals)) << 4
+	}
+	if offset > 0 {
+		if matchLen-lz4MinMatch >= 15 {
+			token |= 15
+		} else {
+			token |= byte(matchLen - lz4MinMatch)
+		}
+	}
+
+	dst = append(dst, token)
+	if len(literals) >= 15 {
+		dst = lz4Length(dst, len(literals)-15)
+	}
+	dst = append(dst, literals...)
+	if offset == 0 {
+		return dst
+	}
+
+	dst = append(dst, byte(offset), byte(offset>>8))
+	if matchLen-lz4MinMatch >= 15 {
+		dst = lz4Length(dst, matchLen-lz4MinMatch-15)
+	}
+	return dst
+}
+
+func lz4Length(dst []byte, n int) []byte {
+	for ; n >= 255; n -= 255 {
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+func (lz4Codec) decompress(src []byte, rawSize int) ([]byte, error) {
+	dst := make([]byte, 0, rawSize)
+	i := 0
+	for i < len(src) {
+		token := src[i]
+		i++
+
+		literalLen, n := lz4ReadLength(src[i:], int(token>>4))
+		if n < 0 || i+n+literalLen > len(src) || len(dst)+literalLen > rawSize {
+			return nil, errCorruptBlock
+		}
+		i += n
+		dst = append(dst, src[i:i+literalLen]...)
+		i += literalLen
+
+		// the last sequence has no match
+		if i == len(src) {
+			break
+		}
+
+		if i+2 > len(src) {
+			return nil, errCorruptBlock
+		}
+		offset := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		matchLen, n := lz4ReadLength(src[i:], int(token&15))
+		if n < 0 {
+			return nil, errCorruptBlock
+		}
+		i += n
+		matchLen += lz4MinMatch
+
+		pos := len(dst) - offset
+		if offset == 0 || pos < 0 || len(dst)+matchLen > rawSize {
+			return nil, errCorruptBlock
+		}
+		// the match could overlap the bytes it produces
+		for j := 0; j < matchLen; j++ {
+			dst = append(dst, dst[pos+j])
+		}
+	}
+
+	if len(dst) != rawSize {
+		return nil, errCorruptBlock
+	}
+	return dst, nil
+}
+
+// lz4ReadLength reads the extra bytes of a length starting with n from the token, and
+// returns the length and the bytes read, or -1 if src ends
+func lz4ReadLength(src []byte, n int) (int, int) {
+	if n != 15 {
+		return n, 0
+	}
+	for i, b := range src {
+		n += int(b)
+		if b != 255 {
+			return n, i + 1
+		}
+	}
+	return 0, -1
+}
@@ -0,0 +1,53 @@
+package db
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func Test_codecs(t *testing.T) {
+	random := make([]byte, 100*KB)
+	rand.New(rand.NewSource(1)).Read(random)
+	compressible := bytes.Repeat([]byte("fastindex k-v pair "), 5000)
+	inputs := map[string][]byte{
+		"empty":        {},
+		"short":        []byte("abc"),
+		"random":       random,
+		"compressible": compressible,
+		"zeros":        make([]byte, 70*KB),
+	}
+
+	for _, name := range []string{"flate", "lz4"} {
+		id, e := codecByName(name)
+		if e != nil {
+			t.Fatal(e)
+		}
+		c, _ := codecByID(id)
+		for input, src := range inputs {
+			compressed, e := c.compress(src)
+			if e != nil {
+				t.Fatalf("%s %s: %v", name, input, e)
+			}
+			raw, e := c.decompress(compressed, len(src))
+			if e != nil || !bytes.Equal(raw, src) {
+				t.Errorf("%s %s: e:%v, decompressed %d bytes, expected %d", name, input, e, len(raw), len(src))
+			}
+		}
+
+		compressed, _ := c.compress(compressible)
+		if len(compressed) > len(compressible)/4 {
+			t.Errorf("%s compressed %d bytes into %d", name, len(compressible), len(compressed))
+		}
+		if _, e := c.decompress(compressed[:len(compressed)/2], len(compressible)); e == nil {
+			t.Errorf("%s: expected an error for a truncated block", name)
+		}
+		if _, e := c.decompress(compressed, len(compressible)+1); e == nil {
+			t.Errorf("%s: expected an error for a wrong raw size", name)
+		}
+	}
+
+	if _, e := codecByName("zstd"); e == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+}
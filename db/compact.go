@@ -0,0 +1,322 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Compaction rewrites the live k-v pairs into a new data file and indexes them in the
+// same pass. A k-v pair is live if it's the one found for its key, so the overwritten
+// values, the deleted ones, the tombstones and the corrupt bytes are all dropped. The
+// new data dir and index dir are built next to the old ones, and replace them by renames
+// once they are complete, so a failed compaction leaves the old dataset as it was.
+
+type CompactStats struct {
+	// Records is the number of live k-v pairs rewritten
+	Records int64
+	// Dropped is the number of overwritten or deleted k-v pairs and tombstones
+	Dropped int64
+	// Expired is the number of expired k-v pairs dropped
+	Expired int64
+	// Corrupt is the number of corrupt k-v pairs or blocks dropped, and CorruptBytes is
+	// their bytes. They fail Compact under CorruptAbort.
+	Corrupt      int64
+	CorruptBytes int64
+
+	SizeBefore int64
+	SizeAfter  int64
+}
+
+// Reclaimed returns the bytes of data file reclaimed by compaction
+func (s CompactStats) Reclaimed() int64 {
+	return s.SizeBefore - s.SizeAfter
+}
+
+// SetCompactionRate limits the bytes read by Compact per second, so it doesn't starve
+// the reads. rate <= 0 means unlimited.
+func (db *DB) SetCompactionRate(rate int64) {
+	db.compactionRate = rate
+}
+
+// Compact rewrites the live k-v pairs of db into a new data file and index, and reopens
+// db on them. The writers wait until it's completed.
+func (db *DB) Compact() (CompactStats, error) {
+	stats := CompactStats{}
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if e := db.checkOpen(); e != nil {
+		return stats, e
+	}
+	release, e := db.lockBuilder("compact")
+	if e != nil {
+		return stats, e
+	}
+	defer release()
+	if len(db.dataFiles) == 0 {
+		return stats, errors.New("no data file to compact")
+	}
+	// the generations won't change while compacting
+	db.mergeWG.Wait()
+
+	sizes, e := db.openedSizes()
+	if e != nil {
+		return stats, e
+	}
+	for _, size := range sizes {
+		stats.SizeBefore += size
+	}
+	format, e := db.rewriteFormat()
+	if e != nil {
+		return stats, e
+	}
+	rw, e := db.newRewrite(format)
+	if e != nil {
+		return stats, e
+	}
+	w, fidx := rw.w, rw.fidx
+	reporter := newProgressReporter(db.buildProgress, stats.SizeBefore, db.indexShardNum)
+	throttle := newThrottle(db.compactionRate)
+
+	var parsed int64 = 0
+	for i, df := range db.dataFiles {
+		if e := db.compactSegment(i, df, sizes[i], w, fidx, &stats, func(n int64) {
+			throttle.wait(parsed + n)
+			reporter.scanned(parsed+n, stats.Records)
+		}); e != nil {
+			rw.abort()
+			return stats, e
+		}
+		parsed += sizes[i]
+	}
+	stats.SizeAfter, e = rw.replace(reporter)
+	return stats, e
+}
+
+// openedSizes returns the sizes of the segments opened, the last one is up to writeOff
+func (db *DB) openedSizes() ([]int64, error) {
+	sizes := make([]int64, len(db.dataFiles))
+	for i, df := range db.dataFiles {
+		info, e := df.Stat()
+		if e != nil {
+			return nil, e
+		}
+		sizes[i] = info.Size()
+		if i == len(db.dataFiles)-1 {
+			sizes[i] = db.writeOff
+		}
+	}
+	return sizes, nil
+}
+
+// rewriteFormat returns the format of a data file rewritten by Compact or SortData, the
+// format set to db, or the format of the last segment
+func (db *DB) rewriteFormat() (dataFormat, error) {
+	if db.dataFileVersion != 0 || db.blockCodec != codecNone || db.valueEncoder.codec != codecNone || db.encrypt || db.ttl > 0 {
+		return db.dataFormat()
+	}
+	return db.formats[len(db.formats)-1], nil
+}
+
+// rewrite is a new data file and index built next to the old ones, which replace them
+// once they are complete
+type rewrite struct {
+	db          *DB
+	w           *segmentWriter
+	fidx        *FastIndex
+	tmpDataDir  string
+	tmpIndexDir string
+}
+
+func (db *DB) newRewrite(format dataFormat) (*rewrite, error) {
+	rw := &rewrite{
+		db:          db,
+		tmpDataDir:  filepath.Clean(db.dataFileDir) + ".compact",
+		tmpIndexDir: filepath.Clean(db.indexFileDir) + ".compact",
+	}
+	os.RemoveAll(rw.tmpDataDir)
+	os.RemoveAll(rw.tmpIndexDir)
+	rw.w = &segmentWriter{
+		path:           filepath.Join(rw.tmpDataDir, filepath.Base(db.dataFilePath)),
+		format:         format,
+		maxSegmentSize: db.maxSegmentSize,
+		keys:           db.keys,
+	}
+	fidx, e := db.newFastIndex(rw.tmpIndexDir)
+	if e != nil {
+		return nil, e
+	}
+	rw.fidx = fidx
+	return rw, nil
+}
+
+// abort removes the new data file and index
+func (rw *rewrite) abort() {
+	rw.w.close()
+	rw.fidx.closeShards()
+	os.RemoveAll(rw.tmpDataDir)
+	os.RemoveAll(rw.tmpIndexDir)
+}
+
+// replace publishes the new data file and index, and reopens db on them. It returns the
+// size of the new data file.
+func (rw *rewrite) replace(reporter *progressReporter) (int64, error) {
+	if e := rw.publish(reporter); e != nil {
+		return 0, e
+	}
+	if e := rw.db.reload(); e != nil {
+		return 0, e
+	}
+	return rw.w.total, nil
+}
+
+// publish completes the new data file and index, and replaces the old dataset with them
+func (rw *rewrite) publish(reporter *progressReporter) error {
+	db, w := rw.db, rw.w
+	if e := w.close(); e != nil {
+		os.RemoveAll(rw.tmpDataDir)
+		os.RemoveAll(rw.tmpIndexDir)
+		return e
+	}
+	if e := rw.fidx.finish(reporter); e != nil {
+		os.RemoveAll(rw.tmpDataDir)
+		os.RemoveAll(rw.tmpIndexDir)
+		return e
+	}
+
+	m := db.manifest(w.segments, w.sizes)
+	paths := make([]string, len(w.segments))
+	for i, segment := range w.segments {
+		paths[i] = filepath.Join(rw.tmpDataDir, segment)
+	}
+	m.KeyIDs = segmentKeyIDs(paths)
+	if e := m.write(rw.tmpIndexDir); e != nil {
+		return e
+	}
+
+	// replace the old dataset, the readers keep it opened until they're done
+	dirs := [][2]string{{rw.tmpDataDir, filepath.Clean(db.dataFileDir)}, {rw.tmpIndexDir, filepath.Clean(db.indexFileDir)}}
+	return replaceDirs(dirs)
+}
+
+// publishData completes the new data file without an index, and replaces the old data
+// files with it. The old index is removed before, as it doesn't index the new data file.
+func (rw *rewrite) publishData() error {
+	db := rw.db
+	rw.fidx.closeShards()
+	os.RemoveAll(rw.tmpIndexDir)
+	if e := rw.w.close(); e != nil {
+		os.RemoveAll(rw.tmpDataDir)
+		return e
+	}
+	if e := removeIndex(db.indexFileDir); e != nil {
+		return e
+	}
+	return replaceDirs([][2]string{{rw.tmpDataDir, filepath.Clean(db.dataFileDir)}})
+}
+
+// compactSegment copies the live k-v pairs of the segment in [0, size) by w, and indexes
+// them into fidx. The k-v pairs are converted into the format of w, a checksum is kept
+// if both formats have it. progress is called with the bytes read so far.
+func (db *DB) compactSegment(segment int, df *os.File, size int64, w *segmentWriter, fidx *FastIndex,
+	stats *CompactStats, progress func(int64)) error {
+	format := db.formats[segment]
+	valuePosByte := make([]byte, 8)
+	valueSizeByte := make([]byte, 8)
+	var lastReport int64 = 0
+	cipher := db.ciphers[segment]
+	if format.encrypted() && cipher == nil {
+		return errNoKeyProvider
+	}
+	now := time.Now()
+	report := func(read int64) error {
+		if read-lastReport >= MB || read == size {
+			progress(read)
+			lastReport = read
+		}
+		return nil
+	}
+
+	return forEachRecord(df, format, segment, size, db.maxValueSize, func(record []byte, valuePos int64, read int64) error {
+		key := int64(binary.BigEndian.Uint64(record[8:16]))
+		vsize, vpos := db.find(key)
+		if vsize < 0 || vpos != valuePos {
+			stats.Dropped++
+		} else {
+			// the value is opened, and sealed again by w if its format is encrypted
+			if cipher != nil {
+				_, offset := unpackValuePos(valuePos)
+				var e error
+				if record, e = cipher.openRecord(record, format, offset); e != nil {
+					return fmt.Errorf("segment %d: key %d: %s", segment, key, e)
+				}
+			}
+			if format.expiring() {
+				expiresAt, _, e := splitExpiry(record[24 : 24+binary.BigEndian.Uint64(record[16:24])])
+				if e != nil {
+					return fmt.Errorf("segment %d: key %d: %s", segment, key, e)
+				}
+				if expired(expiresAt, now) {
+					stats.Expired++
+					return report(read)
+				}
+			}
+			converted, e := convertRecord(record, format, w.format, db.valueEncoder, db.valueSizeLimit())
+			if e != nil {
+				return fmt.Errorf("segment %d: key %d: %s", segment, key, e)
+			}
+			newSegment, pos, e := w.writeRecord(converted)
+			if e != nil {
+				return e
+			}
+			valueSize := int64(binary.BigEndian.Uint64(converted[16:24]))
+			binary.BigEndian.PutUint64(valueSizeByte, uint64(w.valueSize(valueSize)))
+			binary.BigEndian.PutUint64(valuePosByte, uint64(packValuePos(newSegment, pos)))
+			if e := fidx.write(key, converted[8:16], valueSizeByte, valuePosByte); e != nil {
+				return e
+			}
+			stats.Records++
+		}
+
+		return report(read)
+	}, func(record CorruptRecord) error {
+		if db.corruptPolicy == CorruptAbort {
+			return fmt.Errorf("corrupt k-v pair, %s", record)
+		}
+		stats.Corrupt++
+		stats.CorruptBytes += record.Length
+		return nil
+	})
+}
+
+// find returns the valueSize and valuePos of key from the memtable or the index
+func (s *snapshot) find(key int64) (int64, int64) {
+	if vsize, vpos, ok := s.memtable.get(key); ok {
+		return vsize, vpos
+	}
+	return s.fidx.Find(key)
+}
+
+// throttle sleeps to keep the bytes processed within rate per second
+type throttle struct {
+	rate  int64
+	start time.Time
+}
+
+func newThrottle(rate int64) *throttle {
+	return &throttle{rate: rate, start: time.Now()}
+}
+
+// wait sleeps until n bytes are allowed since the throttle started
+func (t *throttle) wait(n int64) {
+	if t.rate <= 0 {
+		return
+	}
+	expected := time.Duration(float64(n) / float64(t.rate) * float64(time.Second))
+	if d := expected - time.Since(t.start); d > 0 {
+		time.Sleep(d)
+	}
+}
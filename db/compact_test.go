@@ -0,0 +1,153 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_db_compact(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	// 2 segments with a corrupt k-v pair in the end of the first one
+	data := encodeRecords([]int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	data = append(data, []byte{0, 0, 0, 0, 0, 0, 0, 9, 1, 2}...)
+	createDirIfNotExist(dir + "/data")
+	if e := ioutil.WriteFile(dir+"/data/data.d", data, 0644); e != nil {
+		t.Fatal(e)
+	}
+	writeRecords(t, dir+"/data/data_0001.d", []int64{4, 1}, []string{"dddd", "new a"})
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.SetCorruptPolicy(CorruptSkip, 0)
+	db.CreateIndex()
+	db.InitFind()
+	db.SetMemtableSize(2 * fixIndexItemSize)
+
+	// overwritten and deleted in the memtable and the generations
+	if e := db.Put(2, []byte("new bb")); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Delete(3); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Put(5, []byte("eeeee")); e != nil {
+		t.Fatal(e)
+	}
+
+	db.SetMaxSegmentSize(64)
+	stats, e := db.Compact()
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	expected := map[int64]string{1: "new a", 2: "new bb", 4: "dddd", 5: "eeeee"}
+	if stats.Records != 4 || stats.Dropped != 4 || stats.Corrupt != 1 || stats.CorruptBytes != 10 {
+		t.Errorf("stats:%+v, expected 4 records, 4 dropped and 10 corrupt bytes", stats)
+	}
+	var size int64 = 0
+	for _, v := range expected {
+		size += int64(24 + len(v))
+	}
+	if stats.SizeAfter != size || stats.Reclaimed() <= 0 {
+		t.Errorf("stats:%+v, expected size after %d", stats, size)
+	}
+
+	check := func(stage string) {
+		for k, v := range expected {
+			if found, e := db.Get(k); e != nil || string(found) != v {
+				t.Errorf("%s key:%d, v:%s, e:%v, expected %s", stage, k, found, e, v)
+			}
+		}
+		if _, e := db.Get(3); e != ErrNotFound {
+			t.Errorf("%s deleted key:3, e:%v, expected ErrNotFound", stage, e)
+		}
+	}
+	check("compacted")
+	if len(db.dataFiles) != 2 || len(db.fidx.generations()) != 0 || db.memtable.len() != 0 {
+		t.Errorf("%d segments, %d generations, %d k-v pairs in memtable, expected 2, 0, 0",
+			len(db.dataFiles), len(db.fidx.generations()), db.memtable.len())
+	}
+
+	// the compacted dataset is writable and could be opened again
+	if e := db.Put(6, []byte("f")); e != nil {
+		t.Fatal(e)
+	}
+	expected[6] = "f"
+	db.Close()
+	db = OpenDB(dir)
+	db.InitFind()
+	check("reopened")
+}
+
+func Test_db_compact_corrupt(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	// a block which can't be decompressed, after the first one
+	values := make([]string, 100)
+	keys := make([]int64, 100)
+	for i := range values {
+		keys[i] = int64(i)
+		values[i] = strings.Repeat(strconv.Itoa(i), 1000)
+	}
+	writeBlocks(t, dir+"/data/data.d", codecFlate, keys, values)
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	if e := db.CreateIndex(); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.InitFind(); e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	info, _ := db.dataFiles[0].Stat()
+	offsets, e := readBlockIndex(db.dataFiles[0], db.formats[0], info.Size())
+	if e != nil || len(offsets) < 3 {
+		t.Fatalf("offsets:%v, e:%v, expected 2 blocks at least", offsets, e)
+	}
+	f, _ := os.OpenFile(dir+"/data/data.d", os.O_WRONLY, 0644)
+	f.WriteAt([]byte{0, 0, 0, 0}, offsets[1])
+	f.Close()
+
+	// it fails under CorruptAbort, and the dataset is kept
+	if _, e := db.Compact(); e == nil {
+		t.Fatal("expected Compact to fail on the corrupt block")
+	}
+	if v, e := db.Get(0); e != nil || string(v) != values[0] {
+		t.Errorf("v:%s, e:%v, expected the dataset kept", v, e)
+	}
+
+	// or drops the block and counts it
+	db.SetCorruptPolicy(CorruptSkip, 0)
+	stats, e := db.Compact()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if stats.Corrupt != 1 || stats.CorruptBytes != offsets[2]-offsets[1] || stats.Records == 0 {
+		t.Errorf("stats:%+v, expected a corrupt block of %d bytes", stats, offsets[2]-offsets[1])
+	}
+	if v, e := db.Get(0); e != nil || string(v) != values[0] {
+		t.Errorf("v:%s, e:%v, expected %s", v, e, values[0])
+	}
+}
+
+func Test_throttle(t *testing.T) {
+	throttle := newThrottle(MB)
+	start := time.Now()
+	throttle.wait(100 * KB)
+	if d := time.Since(start); d < 80*time.Millisecond {
+		t.Errorf("waited %s, expected about 100ms", d)
+	}
+
+	start = time.Now()
+	newThrottle(0).wait(GB)
+	if d := time.Since(start); d > 10*time.Millisecond {
+		t.Errorf("waited %s, expected no wait", d)
+	}
+}
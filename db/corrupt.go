@@ -0,0 +1,237 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Build validates the framing of every k-v pair before indexing it. The key must be
+// 8 bytes as the index saves int64 keys, and the value_size must be in the configured
+// limit and inside the data file. A corrupt k-v pair is handled by the CorruptPolicy:
+// CorruptAbort stops the build, CorruptSkip resyncs to the next plausible k-v pair and
+// CorruptQuarantine also copies the skipped bytes into a quarantine file. Every corrupt
+// k-v pair is recorded for the report at the end of the build.
+
+type CorruptPolicy int
+
+const (
+	CorruptAbort CorruptPolicy = iota
+	CorruptSkip
+	CorruptQuarantine
+)
+
+// defaultMaxValueSize is the limit of value_size, a value is at most 2MB length
+const defaultMaxValueSize = 2 * MB
+
+const quarantineFileName = "quarantine.bad"
+
+var corruptPolicyNames = map[string]CorruptPolicy{
+	"abort":      CorruptAbort,
+	"skip":       CorruptSkip,
+	"quarantine": CorruptQuarantine,
+}
+
+// ParseCorruptPolicy parses abort, skip or quarantine into a CorruptPolicy
+func ParseCorruptPolicy(name string) (CorruptPolicy, bool) {
+	policy, ok := corruptPolicyNames[name]
+	return policy, ok
+}
+
+// CorruptRecord is a range of bytes which can't be parsed as k-v pairs
+type CorruptRecord struct {
+	Segment int
+	Offset  int64
+	Length  int64
+	Reason  string
+}
+
+func (r CorruptRecord) String() string {
+	return fmt.Sprintf("segment:%d, offset:%d, length:%d, reason:%s", r.Segment, r.Offset, r.Length, r.Reason)
+}
+
+// SetCorruptPolicy sets how Build handles corrupt k-v pairs, and the limit of value_size.
+// maxValueSize <= 0 means the default limit.
+func (fidx *FastIndex) SetCorruptPolicy(policy CorruptPolicy, maxValueSize int64) {
+	fidx.corruptPolicy = policy
+	fidx.maxValueSize = maxValueSize
+}
+
+// CorruptRecords returns the corrupt k-v pairs found by the last build
+func (fidx *FastIndex) CorruptRecords() []CorruptRecord {
+	return fidx.corrupted
+}
+
+func (fidx *FastIndex) valueSizeLimit() int64 {
+	if fidx.maxValueSize <= 0 {
+		return defaultMaxValueSize
+	}
+	return fidx.maxValueSize
+}
+
+// checkHeader validates the header of a k-v pair in the data file being built with the limit of fidx
+func (fidx *FastIndex) checkHeader(header []byte, pos int64, size int64) string {
+	return checkRecordHeader(fidx.format, header, pos, size, fidx.valueSizeLimit())
+}
+
+// checkRecordHeader validates the <key_size, key, value_size> of a k-v pair at offset pos,
+// and returns the reason if it's corrupt. size is the data file's size, or -1 if unknown.
+func checkRecordHeader(format dataFormat, header []byte, pos int64, size int64, maxValueSize int64) string {
+	if len(header) < 24 {
+		return "truncated record"
+	}
+
+	keySize := binary.BigEndian.Uint64(header[:8])
+	if keySize != 8 {
+		return fmt.Sprintf("invalid key size %d", keySize)
+	}
+	// keys are never negative, so it's a flipped bit
+	if key := int64(binary.BigEndian.Uint64(header[8:16])); key < 0 {
+		return fmt.Sprintf("invalid key %d", key)
+	}
+
+	valueSize := binary.BigEndian.Uint64(header[16:24])
+	if valueSize > uint64(maxValueSize) && int64(valueSize) != tombstoneValueSize {
+		return fmt.Sprintf("invalid value size %d", valueSize)
+	}
+
+	if size >= 0 && pos+format.recordSize(int64(valueSize)) > size {
+		return "truncated record"
+	}
+	return ""
+}
+
+// resync searches the next plausible k-v pair after a corrupt one at offset from, and
+// returns its offset, or size if there's no more. A k-v pair is plausible if its
+// header is valid and it's followed by another valid header or the end of file.
+func (fidx *FastIndex) resync(dfile *os.File, from int64, size int64) int64 {
+	header := make([]byte, 24)
+	next := make([]byte, 24)
+	for pos := from + 1; pos+24 <= size; pos++ {
+		if n, _ := dfile.ReadAt(header, pos); n < 24 || fidx.checkHeader(header, pos, size) != "" {
+			continue
+		}
+
+		end := pos + fidx.format.recordSize(int64(binary.BigEndian.Uint64(header[16:24])))
+		if end == size {
+			return pos
+		}
+		if n, _ := dfile.ReadAt(next, end); n == 24 && fidx.checkHeader(next, end, size) == "" {
+			return pos
+		}
+	}
+	return size
+}
+
+// resyncStream consumes bytes of a stream after a corrupt k-v pair until the next
+// plausible one, the consumed bytes are written into w and counted
+func (fidx *FastIndex) resyncStream(reader *bufio.Reader, w io.Writer) (int64, error) {
+	var skipped int64 = 0
+	for {
+		b, e := reader.ReadByte()
+		if e == io.EOF {
+			return skipped, nil
+		} else if e != nil {
+			return skipped, e
+		}
+		if _, e := w.Write([]byte{b}); e != nil {
+			return skipped, e
+		}
+		skipped++
+
+		header, _ := reader.Peek(24)
+		if fidx.checkHeader(header, 0, -1) != "" {
+			continue
+		}
+
+		// check the following header if the whole k-v pair could be peeked
+		recordSize := int(fidx.format.recordSize(int64(binary.BigEndian.Uint64(header[16:24]))))
+		if recordSize+24 > reader.Size() {
+			return skipped, nil
+		}
+		peeked, _ := reader.Peek(recordSize + 24)
+		if len(peeked) == recordSize {
+			return skipped, nil
+		}
+		if len(peeked) == recordSize+24 && fidx.checkHeader(peeked[recordSize:], 0, -1) == "" {
+			return skipped, nil
+		}
+	}
+}
+
+// skipStream handles a corrupt k-v pair at offset of a stream. The bytes until the next
+// plausible k-v pair are copied into w, and into the quarantine file by the CorruptPolicy.
+func (fidx *FastIndex) skipStream(reader *bufio.Reader, w io.Writer, offset int64, reason string) (int64, error) {
+	record := CorruptRecord{Offset: offset, Reason: reason}
+	if fidx.corruptPolicy == CorruptAbort {
+		return 0, fidx.corrupt(record, nil)
+	}
+
+	if fidx.corruptPolicy == CorruptQuarantine {
+		quarantine, e := fidx.quarantineFile()
+		if e != nil {
+			return 0, e
+		}
+		w = io.MultiWriter(w, quarantine)
+	}
+
+	skipped, e := fidx.resyncStream(reader, w)
+	if e != nil {
+		return skipped, e
+	}
+	record.Length = skipped
+	return skipped, fidx.corrupt(record, nil)
+}
+
+// corrupt records corrupt bytes and copies them from data into the quarantine file
+// by the CorruptPolicy, it returns an error if the build should stop
+func (fidx *FastIndex) corrupt(record CorruptRecord, data io.Reader) error {
+	fidx.corrupted = append(fidx.corrupted, record)
+
+	if fidx.corruptPolicy == CorruptAbort {
+		return fmt.Errorf("corrupt record at %s", record)
+	}
+
+	if fidx.corruptPolicy == CorruptQuarantine && data != nil {
+		quarantine, e := fidx.quarantineFile()
+		if e != nil {
+			return e
+		}
+		if _, e := io.Copy(quarantine, data); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// corruptAt handles corrupt bytes of a data file in [from, to)
+func (fidx *FastIndex) corruptAt(dfile *os.File, segment int, from int64, to int64, reason string) error {
+	record := CorruptRecord{Segment: segment, Offset: from, Length: to - from, Reason: reason}
+	return fidx.corrupt(record, io.NewSectionReader(dfile, from, to-from))
+}
+
+// quarantineFile creates the quarantine file in the index dir when it's first used
+func (fidx *FastIndex) quarantineFile() (*os.File, error) {
+	if fidx.quarantine == nil {
+		if e := createDirIfNotExist(fidx.dir); e != nil {
+			return nil, e
+		}
+		f, e := os.Create(filepath.Join(fidx.dir, quarantineFileName))
+		if e != nil {
+			return nil, e
+		}
+		fidx.quarantine = f
+	}
+	return fidx.quarantine, nil
+}
+
+// closeQuarantine closes the quarantine file if any corrupt bytes were copied
+func (fidx *FastIndex) closeQuarantine() {
+	if fidx.quarantine != nil {
+		fidx.quarantine.Close()
+		fidx.quarantine = nil
+	}
+}
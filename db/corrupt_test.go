@@ -0,0 +1,186 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// corruptData returns k-v pairs with garbage between the 2nd and the 3rd one, and the
+// garbage's offset
+func corruptData() ([]byte, []byte, int64) {
+	head := encodeRecords([]int64{1, 2}, []string{"a", "bb"})
+	tail := encodeRecords([]int64{3, 4}, []string{"ccc", "dddd"})
+	garbage := []byte{0, 0, 0, 0, 0, 0, 0, 9, 1, 2, 3}
+
+	data := append(append(append([]byte{}, head...), garbage...), tail...)
+	return data, garbage, int64(len(head))
+}
+
+// findValue reads the value of key through an opened FastIndex
+func findValue(t *testing.T, fidx *FastIndex, data []byte, key int64) string {
+	vsize, vpos := fidx.Find(key)
+	if vsize < 0 {
+		return ""
+	}
+	_, offset := unpackValuePos(vpos)
+	return string(data[offset : offset+vsize])
+}
+
+func Test_build_corrupt_skip(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	data, garbage, garbageOff := corruptData()
+	dataPath := filepath.Join(dir, "data.d")
+	ioutil.WriteFile(dataPath, data, 0644)
+
+	fidx := newTestIndex(t, dir+"/index", 2)
+	fidx.SetCorruptPolicy(CorruptSkip, 0)
+	if e := fidx.Build(dataPath, 32); e != nil {
+		t.Fatal(e)
+	}
+
+	records := fidx.CorruptRecords()
+	if len(records) != 1 || records[0].Offset != garbageOff || records[0].Length != int64(len(garbage)) {
+		t.Fatalf("corrupt records: %v, expected offset %d, length %d", records, garbageOff, len(garbage))
+	}
+
+	fidx = openTestIndex(t, dir+"/index", 2)
+	expected := map[int64]string{1: "a", 2: "bb", 3: "ccc", 4: "dddd"}
+	for k, v := range expected {
+		if found := findValue(t, fidx, data, k); found != v {
+			t.Errorf("key:%d, v:%s, expected %s", k, found, v)
+		}
+	}
+}
+
+func Test_build_corrupt_quarantine(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	data, garbage, _ := corruptData()
+	// a truncated k-v pair at the end
+	data = append(data, encodeRecords([]int64{5}, []string{"eeeee"})[:26]...)
+	dataPath := filepath.Join(dir, "data.d")
+	ioutil.WriteFile(dataPath, data, 0644)
+
+	fidx := newTestIndex(t, dir+"/index", 2)
+	fidx.SetCorruptPolicy(CorruptQuarantine, 0)
+	if e := fidx.Build(dataPath, int(KB)); e != nil {
+		t.Fatal(e)
+	}
+
+	records := fidx.CorruptRecords()
+	if len(records) != 2 || records[1].Reason != "truncated record" || records[1].Length != 26 {
+		t.Fatalf("corrupt records: %v", records)
+	}
+
+	quarantined, e := ioutil.ReadFile(filepath.Join(dir, "index", quarantineFileName))
+	if e != nil {
+		t.Fatal(e)
+	}
+	expected := append(append([]byte{}, garbage...), data[len(data)-26:]...)
+	if !bytes.Equal(quarantined, expected) {
+		t.Errorf("quarantined %v, expected %v", quarantined, expected)
+	}
+}
+
+func Test_build_corrupt_abort(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	data, _, _ := corruptData()
+	dataPath := filepath.Join(dir, "data.d")
+	ioutil.WriteFile(dataPath, data, 0644)
+
+	if e := newTestIndex(t, dir+"/index", 2).Build(dataPath, int(KB)); e == nil {
+		t.Error("expected Build to abort")
+	}
+}
+
+func Test_build_corrupt_negative_key(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	// the top bit of the 2nd key is flipped
+	data := encodeRecords([]int64{1, -1<<63 | 2, 3}, []string{"a", "bb", "ccc"})
+	dataPath := filepath.Join(dir, "data.d")
+	ioutil.WriteFile(dataPath, data, 0644)
+
+	if e := newTestIndex(t, dir+"/index", 4).Build(dataPath, int(KB)); e == nil {
+		t.Error("expected Build to abort")
+	}
+
+	fidx := newTestIndex(t, dir+"/index", 4)
+	fidx.SetCorruptPolicy(CorruptSkip, 0)
+	if e := fidx.Build(dataPath, int(KB)); e != nil {
+		t.Fatal(e)
+	}
+	if records := fidx.CorruptRecords(); len(records) != 1 || records[0].Offset != 25 || records[0].Length != 26 {
+		t.Fatalf("corrupt records: %v, expected the 2nd k-v pair", records)
+	}
+	if found := findValue(t, openTestIndex(t, dir+"/index", 4), data, 3); found != "ccc" {
+		t.Errorf("key:3, v:%s, expected ccc", found)
+	}
+}
+
+func Test_build_value_size_limit(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	data := encodeRecords([]int64{1, 2, 3}, []string{"a", string(make([]byte, 100)), "ccc"})
+	dataPath := filepath.Join(dir, "data.d")
+	ioutil.WriteFile(dataPath, data, 0644)
+
+	// a k-v pair larger than the read buffer is still indexed
+	fidx := newTestIndex(t, dir+"/index", 2)
+	if e := fidx.Build(dataPath, 32); e != nil {
+		t.Fatal(e)
+	}
+	if len(fidx.CorruptRecords()) != 0 {
+		t.Fatalf("corrupt records: %v", fidx.CorruptRecords())
+	}
+	if found := findValue(t, openTestIndex(t, dir+"/index", 2), data, 3); found != "ccc" {
+		t.Errorf("key:3, v:%s, expected ccc", found)
+	}
+
+	// but not if it's over the limit
+	fidx = newTestIndex(t, dir+"/index", 2)
+	fidx.SetCorruptPolicy(CorruptSkip, 64)
+	if e := fidx.Build(dataPath, 32); e != nil {
+		t.Fatal(e)
+	}
+	if records := fidx.CorruptRecords(); len(records) != 1 || records[0].Length != 124 {
+		t.Fatalf("corrupt records: %v", records)
+	}
+}
+
+func Test_build_from_reader_corrupt_skip(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	data, garbage, garbageOff := corruptData()
+	dataPath := filepath.Join(dir, "data.d")
+	fidx := newTestIndex(t, dir+"/index", 2)
+	fidx.SetCorruptPolicy(CorruptSkip, 0)
+	if e := fidx.BuildFromReader(bytes.NewReader(data), dataPath, int(KB)); e != nil {
+		t.Fatal(e)
+	}
+
+	records := fidx.CorruptRecords()
+	if len(records) != 1 || records[0].Offset != garbageOff || records[0].Length != int64(len(garbage)) {
+		t.Fatalf("corrupt records: %v, expected offset %d, length %d", records, garbageOff, len(garbage))
+	}
+
+	// the corrupt bytes are copied as well, so offsets are the same as the stream's
+	copied, _ := ioutil.ReadFile(dataPath)
+	if !bytes.Equal(copied, data) {
+		t.Fatalf("copied data file differs")
+	}
+	fidx = openTestIndex(t, dir+"/index", 2)
+	if found := findValue(t, fidx, data, 4); found != "dddd" {
+		t.Errorf("key:4, v:%s, expected dddd", found)
+	}
+}
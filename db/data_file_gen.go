@@ -3,15 +3,21 @@ package db
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"math/rand"
 	"os"
-	"strconv"
+	"path/filepath"
+	"sync"
+	"time"
 )
 
 // To generate raw data file which is formatted as
 // <key_size, key, value_size, value>, which key_zie and value_size
 // have 8-byte length. The key will be as most 1KB length and the value is
-// at most 2MB length.
+// at most 2MB length. A data file of version 2 has a file header and the
+// checksum of each k-v pair, see dataFormat, and its values could be compressed one by one.
 //
 
 const (
@@ -25,29 +31,82 @@ type DataFileGen struct {
 	maxKey         int64
 	maxValueLength int64
 	// maxSize is max size of the whole data file. No more than 1TB
-	maxSize      int64
+	maxSize int64
+	// maxSegmentSize rotates the data file into segments when it's reached, 0 means no rotation
+	maxSegmentSize int64
+	// version is the format of data file, 0 means DataFileV1, and codec compresses the
+	// k-v pairs in blocks, codecNone means no blocks
+	version int
+	codec   byte
+	// valueEncoder compresses every value alone, with a flags byte of its codec
+	valueEncoder valueEncoder
+	// keyID is the key of keys sealing the values, "" means no encryption
+	keyID string
+	keys  KeyProvider
+	// ttl makes every k-v pair expire randomly within ttl from now, 0 means no expiry
+	ttl time.Duration
+	// dist is how the keys and values are drawn by sampler
+	dist         Distribution
+	sampler      *sampler
+	format       dataFormat
 	writeBufSize int
 
-	// data file's path
+	// data file's path, the following segments are named by segmentPath
 	path string
 	file *os.File
+	// keyManifestPath is where the key manifest is written, "" means none
+	keyManifestPath string
+	keyManifest     *keyManifestWriter
+	// workers generate the segments in parallel, see generateParallel
+	workers int
 }
 
-func (self *DataFileGen) generate() error {
+func (self *DataFileGen) generate() (e error) {
 	if len(self.path) == 0 {
-		panic("data file path can't be empty")
+		return errors.New("data file path can't be empty")
+	}
+	format, e := newDataFormat(self.version)
+	if e != nil {
+		return e
+	}
+	if self.sampler, e = newSampler(self.dist, self.maxKey, self.maxValueLength); e != nil {
+		return e
+	}
+	format = format.withBlocks(self.codec).withValueCodec(self.valueEncoder.codec != codecNone).withExpiry(self.ttl > 0).withEncryption(self.keyID)
+	self.format = format
+	if self.keyManifestPath != "" {
+		if self.keyManifest, e = newKeyManifestWriter(self.keyManifestPath, self.maxKey, self.ttl > 0); e != nil {
+			return e
+		}
+		defer func() {
+			if ce := self.keyManifest.close(); e == nil {
+				e = ce
+			}
+		}()
+	}
+	if self.workers > 1 {
+		return self.generateParallel()
+	}
+	if format.blocked() || format.encrypted() {
+		return self.generateSegments()
 	}
 
 	// create data file
-	createDirIfNotExist(self.path)
+	if e := createDirIfNotExist(filepath.Dir(self.path)); e != nil {
+		return e
+	}
 	dataFilePath := self.path
 	f, e := os.Create(dataFilePath)
 	if e != nil {
 		return e
 	}
+	defer func() { f.Close() }()
 
 	var totalSize int64 = 0
+	var segmentSize int64 = 0
+	segment := 0
 	buf := bytes.NewBuffer([]byte{})
+	buf.Write(format.encodeHeader())
 
 	// write data into file
 	for totalSize < self.maxSize {
@@ -65,19 +124,134 @@ func (self *DataFileGen) generate() error {
 				return e
 			}
 			totalSize += int64(len)
+			segmentSize += int64(len)
+		}
+
+		// rotate to the next segment
+		if self.maxSegmentSize > 0 && segmentSize >= self.maxSegmentSize && totalSize < self.maxSize {
+			if e := f.Close(); e != nil {
+				return e
+			}
+			segment++
+			segmentSize = 0
+			if f, e = os.Create(segmentPath(self.path, segment)); e != nil {
+				return e
+			}
+			buf.Write(format.encodeHeader())
 		}
 	}
 
 	return nil
 }
 
-func (self *DataFileGen) fillBuf(buf *bytes.Buffer) int64 {
-	key := rand.Int63n(self.maxKey)
-	keyStr := strconv.FormatInt(key, 10)
-	valueSize := rand.Int63n(self.maxValueLength)
+// generateSegments generates a data file with compressed blocks or sealed values, maxSize
+// is the size before compression and encryption
+func (self *DataFileGen) generateSegments() error {
+	w := &segmentWriter{path: self.path, format: self.format, maxSegmentSize: self.maxSegmentSize, keys: self.keys}
+	buf := bytes.NewBuffer([]byte{})
+	var totalSize int64 = 0
+	for totalSize < self.maxSize {
+		buf.Reset()
+		totalSize += self.fillBuf(buf)
+		if _, _, e := w.writeRecord(buf.Bytes()); e != nil {
+			w.close()
+			return e
+		}
+	}
+	return w.close()
+}
+
+// generateParallel splits the data file into parts which are generated by workers, each
+// part is a segment of maxSize/workers bytes, or of maxSegmentSize bytes if it's set. A
+// part draws its k-v pairs from its own sampler, so the data file is deterministic under
+// a seed and the parts, whatever order the workers generate them in. The key manifests of
+// the parts are written apart, and appended to the key manifest in the order of the parts.
+func (self *DataFileGen) generateParallel() error {
+	parts := self.workers
+	partSize := (self.maxSize + int64(parts) - 1) / int64(parts)
+	if self.maxSegmentSize > 0 {
+		parts = int((self.maxSize + self.maxSegmentSize - 1) / self.maxSegmentSize)
+		partSize = self.maxSegmentSize
+	}
+	if parts > maxSegmentNum {
+		return fmt.Errorf("%d segments exceed the limit %d", parts, maxSegmentNum)
+	}
+
+	errs := make([]error, parts)
+	partCh := make(chan int, parts)
+	for i := 0; i < parts; i++ {
+		partCh <- i
+	}
+	close(partCh)
+	wg := sync.WaitGroup{}
+	for w := 0; w < self.workers && w < parts; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range partCh {
+				size := partSize
+				if remain := self.maxSize - int64(i)*partSize; remain < size {
+					size = remain
+				}
+				errs[i] = self.generatePart(i, parts, size)
+			}
+		}()
+	}
+	wg.Wait()
+	for _, e := range errs {
+		if e != nil {
+			return e
+		}
+	}
+
+	if self.keyManifest == nil {
+		return nil
+	}
+	for i := 0; i < parts; i++ {
+		if e := self.keyManifest.append(keyManifestPartPath(self.keyManifestPath, i)); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// generatePart generates the i-th part of parts into its segment of size bytes
+func (self *DataFileGen) generatePart(i int, parts int, size int64) error {
+	part := *self
+	part.path = segmentPath(self.path, i)
+	part.maxSize = size
+	part.maxSegmentSize = 0
+	part.sampler = self.sampler.part(i, parts)
+	if self.keyManifest != nil {
+		var e error
+		if part.keyManifest, e = newKeyManifestWriter(keyManifestPartPath(self.keyManifestPath, i), self.maxKey, self.ttl > 0); e != nil {
+			return e
+		}
+	}
 
-	vRepeat := int(valueSize / int64(len(keyStr)))
-	valueSize = int64(vRepeat * len(keyStr))
+	e := part.generateSegments()
+	if part.keyManifest != nil {
+		if ce := part.keyManifest.close(); e == nil {
+			e = ce
+		}
+	}
+	return e
+}
+
+func (self *DataFileGen) fillBuf(buf *bytes.Buffer) int64 {
+	start := buf.Len()
+	key := self.sampler.key()
+	value := self.sampler.value(key, self.sampler.valueSize())
+	if self.keyManifest != nil {
+		self.keyManifest.add(key, value)
+	}
+	if self.format.valueCoded() {
+		value, _ = self.valueEncoder.encode(value)
+	}
+	if self.format.expiring() {
+		value = withExpiry(time.Now().Add(time.Duration(self.sampler.rng.Int63n(int64(self.ttl)))+time.Second).Unix(), value)
+	}
+	valueSize := int64(len(value))
 
 	_buf := make([]byte, 8)
 
@@ -94,12 +268,16 @@ func (self *DataFileGen) fillBuf(buf *bytes.Buffer) int64 {
 	buf.Write(_buf)
 
 	// value
-	for i := 0; i < vRepeat; i++ {
-		buf.WriteString(keyStr)
+	buf.Write(value)
+
+	// checksum of the k-v pair
+	if self.format.checksummed() {
+		binary.BigEndian.PutUint32(_buf, crc32.Checksum(buf.Bytes()[start:], crc32c))
+		buf.Write(_buf[:checksumSize])
 	}
 
 	// k-v pair's length
-	return 8 + 8 + 8 + valueSize
+	return self.format.recordSize(valueSize)
 }
 
 func randomGen(maxLength int64) ([]byte, []byte) {
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 )
 
@@ -36,3 +38,103 @@ func Test_buffer(t *testing.T) {
 
 	fmt.Println(buf)
 }
+
+func Test_data_file_gen_parallel(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	// generate returns the segments and the key manifest generated into a dir
+	generate := func(name string, workers int, maxSegmentSize int64, dist Distribution) ([][]byte, []byte) {
+		db := OpenDB(filepath.Join(dir, name))
+		db.indexShardNum = 4
+		db.maxKey = 10000
+		db.maxValueLength = 128
+		db.SetMaxSegmentSize(maxSegmentSize)
+		db.SetGenWorkers(workers)
+		db.SetDistribution(dist)
+		db.SetKeyManifest(true)
+		db.CreateData(256 * KB)
+
+		segments, _ := listSegments(db.dataFileDir)
+		data := make([][]byte, len(segments))
+		for i, segment := range segments {
+			data[i], _ = ioutil.ReadFile(filepath.Join(db.dataFileDir, segment))
+		}
+		keys, _ := ioutil.ReadFile(db.keyManifestPath)
+
+		// every k-v pair is found as the key manifest says
+		db.CreateIndex()
+		db.InitFind()
+		testKeys, expiring, e := db.TestKeys(1000, 0.9, 1)
+		if e != nil {
+			t.Fatal(e)
+		}
+		if stats := db.FindTest(testKeys, expiring); stats.Wrong != 0 || stats.Hits == 0 {
+			t.Errorf("%s stats:%+v, expected right", name, stats)
+		}
+		return data, keys
+	}
+	same := func(a [][]byte, b [][]byte) bool {
+		if len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !bytes.Equal(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	dist := Distribution{Content: ContentRandom, Seed: 5}
+	a, aKeys := generate("a", 4, 0, dist)
+	b, bKeys := generate("b", 4, 0, dist)
+	if len(a) != 4 || !same(a, b) || !bytes.Equal(aKeys, bKeys) {
+		t.Errorf("%d segments, expected 4 segments the same of the same seed and workers", len(a))
+	}
+	if c, _ := generate("c", 4, 0, Distribution{Content: ContentRandom, Seed: 6}); same(a, c) {
+		t.Error("expected another data file of another seed")
+	}
+
+	// with a max segment size, it's the same whatever the workers
+	d, dKeys := generate("d", 2, 32*KB, dist)
+	e, eKeys := generate("e", 3, 32*KB, dist)
+	if len(d) != 8 || !same(d, e) || !bytes.Equal(dKeys, eKeys) {
+		t.Errorf("%d segments, expected 8 segments the same of the same seed and segment size", len(d))
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "d", "*.part*")); len(matches) != 0 {
+		t.Errorf("key manifests of parts %v, expected removed", matches)
+	}
+
+	// the permutation draws every key once across the parts
+	_, keys := generate("f", 4, 0, Distribution{Keys: KeyPermutation, ValueSize: SizeFixed, Seed: 5})
+	seen := make(map[string]bool)
+	for off := keyManifestHeaderSize; off < len(keys); off += keyManifestEntrySize {
+		key := string(keys[off : off+8])
+		if seen[key] {
+			t.Fatalf("key %v drawn twice", keys[off:off+8])
+		}
+		seen[key] = true
+	}
+
+	// and blocks and encryption are generated in parallel too
+	dir2, clean2 := tempDir(t)
+	defer clean2()
+	db := OpenDB(dir2)
+	db.indexShardNum = 4
+	db.SetGenWorkers(3)
+	db.SetBlockCompression("lz4")
+	db.SetKeyProvider(testKeys("k1", "k1"), true)
+	db.SetKeyManifest(true)
+	db.maxValueLength = 128
+	db.CreateData(128 * KB)
+	db.CreateIndex()
+	db.InitFind()
+	testKeys, expiring, err := db.TestKeys(500, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := db.FindTest(testKeys, expiring); stats.Wrong != 0 || len(db.dataFiles) != 3 || !db.formats[2].encrypted() {
+		t.Errorf("stats:%+v, %d segments, expected right of 3 encrypted segments", stats, len(db.dataFiles))
+	}
+}
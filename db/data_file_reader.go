@@ -1,28 +1,32 @@
 package db
 
-import "os"
+import (
+	"errors"
+	"os"
+)
 
 type Reader struct {
 	readBufSize int64
 	fileName    string
 }
 
-func (r *Reader) read() []byte {
+func (r *Reader) read() ([]byte, error) {
 	if len(r.fileName) == 0 {
-		panic("fileName is empty")
+		return nil, errors.New("fileName is empty")
 	}
 
 	f, e := os.Open(r.fileName)
 	if e != nil {
-		panic("open dataFile error")
+		return nil, e
 	}
+	defer f.Close()
 
 	if r.readBufSize <= 0 {
 		r.readBufSize = 1024 * 1024
 	}
 	buf := make([]byte, r.readBufSize)
 	if _, e := f.Read(buf); e != nil {
-		panic(e)
+		return nil, e
 	}
-	return buf
+	return buf, nil
 }
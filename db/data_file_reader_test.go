@@ -11,7 +11,10 @@ func Test_read(t *testing.T) {
 		readBufSize: 1024 * 1024,
 		fileName:    "/Users/Cuber_Q/goproj/fastindex/data/data.d",
 	}
-	buf := reader.read()
+	buf, e := reader.read()
+	if e != nil {
+		t.Fatal(e)
+	}
 	var offset int64 = 0
 
 	for i := 0; i < 10; i++ {
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// A data file of format v1 is a bare sequence of k-v pairs. A data file of format v2
+// starts with a file header <magic(4)="FIDX", version(2), flags(2), header_size(4),
+// codec(1), reserved(3)>, and with flagChecksum every k-v pair is followed by the CRC32C
+// of its <key_size, key, value_size, value>. With flagBlocks the k-v pairs are grouped
+// into blocks compressed by the codec, see block.go, and with flagValueCodec every value
+// could be compressed alone, see value_codec.go. With flagEncrypted every value is sealed
+// by AES-GCM, and the header goes on with <salt(16), key_id_size(2), key_id>, see
+// encryption.go. With flagExpiry every value starts with its expiry, see expiry.go. A v1
+// data file starts with key_size 8, so it never starts with the magic. The value_position
+// of an index item is the offset of the value in a data file without blocks, so an index
+// doesn't depend on the format.
+
+const (
+	dataFileMagic      = "FIDX"
+	dataFileHeaderSize = 16
+
+	DataFileV1 = 1
+	DataFileV2 = 2
+
+	// flagChecksum means every k-v pair is followed by its CRC32C
+	flagChecksum uint16 = 1 << 0
+	// flagBlocks means the k-v pairs are in compressed blocks
+	flagBlocks uint16 = 1 << 1
+	// flagValueCodec means every value starts with a flags byte of its codec
+	flagValueCodec uint16 = 1 << 2
+	// flagEncrypted means every value is sealed by the key of key_id in the header
+	flagEncrypted uint16 = 1 << 3
+	// flagExpiry means every value starts with its expiry
+	flagExpiry uint16 = 1 << 4
+	// knownFlags are the flags above, a data file with any other one can't be read
+	knownFlags = flagChecksum | flagBlocks | flagValueCodec | flagEncrypted | flagExpiry
+
+	// maxHeaderSize limits the header read from a data file
+	maxHeaderSize = 4 * KB
+
+	checksumSize = 4
+)
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+func crc32Checksum(b []byte) uint32 {
+	return crc32.Checksum(b, crc32c)
+}
+
+type dataFormat struct {
+	version    uint16
+	flags      uint16
+	headerSize int64
+	// codec compresses the blocks
+	codec byte
+	// keyID is the key sealing the values, and salt derives the key of the data file from it
+	keyID string
+	salt  [saltSize]byte
+}
+
+var formatV1 = dataFormat{version: DataFileV1}
+
+// newDataFormat returns the format of new data files of version
+func newDataFormat(version int) (dataFormat, error) {
+	switch version {
+	case 0, DataFileV1:
+		return formatV1, nil
+	case DataFileV2:
+		return dataFormat{version: DataFileV2, flags: flagChecksum, headerSize: dataFileHeaderSize}, nil
+	}
+	return formatV1, fmt.Errorf("unsupported data file version %d", version)
+}
+
+// withBlocks returns the format of v2 with the k-v pairs in blocks compressed by codec,
+// codecNone means no blocks
+func (f dataFormat) withBlocks(codec byte) dataFormat {
+	if codec == codecNone {
+		f.flags &^= flagBlocks
+		f.codec = codecNone
+		return f
+	}
+	if f.version < DataFileV2 {
+		f, _ = newDataFormat(DataFileV2)
+	}
+	f.flags |= flagBlocks
+	f.codec = codec
+	return f
+}
+
+// withValueCodec returns the format of v2 with a flags byte in every value if coded
+func (f dataFormat) withValueCodec(coded bool) dataFormat {
+	if !coded {
+		f.flags &^= flagValueCodec
+		return f
+	}
+	if f.version < DataFileV2 {
+		f, _ = newDataFormat(DataFileV2)
+	}
+	f.flags |= flagValueCodec
+	return f
+}
+
+// parseDataFormat parses the format from the first bytes of a data file, the bytes
+// without the magic are a v1 data file
+func parseDataFormat(b []byte) (dataFormat, error) {
+	if len(b) < len(dataFileMagic) || string(b[:len(dataFileMagic)]) != dataFileMagic {
+		return formatV1, nil
+	}
+	if len(b) < dataFileHeaderSize {
+		return formatV1, fmt.Errorf("truncated data file header")
+	}
+
+	f := dataFormat{
+		version:    binary.BigEndian.Uint16(b[4:6]),
+		flags:      binary.BigEndian.Uint16(b[6:8]),
+		headerSize: int64(binary.BigEndian.Uint32(b[8:12])),
+		codec:      b[12],
+	}
+	if f.version != DataFileV2 || f.headerSize < dataFileHeaderSize {
+		return formatV1, fmt.Errorf("unsupported data file version %d, header size %d", f.version, f.headerSize)
+	}
+	if unknown := f.flags &^ knownFlags; unknown != 0 {
+		return formatV1, fmt.Errorf("unsupported data file flags %#x", unknown)
+	}
+	if f.blocked() {
+		if _, e := codecByID(f.codec); e != nil {
+			return formatV1, e
+		}
+	}
+	if f.encrypted() {
+		if int64(len(b)) < f.headerSize || f.headerSize < encryptionHeaderSize {
+			return formatV1, fmt.Errorf("truncated data file header")
+		}
+		copy(f.salt[:], b[dataFileHeaderSize:dataFileHeaderSize+saltSize])
+		keyIDSize := int64(binary.BigEndian.Uint16(b[encryptionHeaderSize-2 : encryptionHeaderSize]))
+		if encryptionHeaderSize+keyIDSize > f.headerSize {
+			return formatV1, fmt.Errorf("invalid key id size %d", keyIDSize)
+		}
+		f.keyID = string(b[encryptionHeaderSize : encryptionHeaderSize+keyIDSize])
+	}
+	return f, nil
+}
+
+// headerSizeOf returns the header size of a data file from its first bytes, 0 for v1
+func headerSizeOf(b []byte) int64 {
+	if len(b) < dataFileHeaderSize || string(b[:len(dataFileMagic)]) != dataFileMagic {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint32(b[8:12]))
+}
+
+// readDataFormat reads the format of a data file
+func readDataFormat(r io.ReaderAt) (dataFormat, error) {
+	b := make([]byte, dataFileHeaderSize)
+	n, e := r.ReadAt(b, 0)
+	if e != nil && e != io.EOF {
+		return formatV1, e
+	}
+	if size := headerSizeOf(b[:n]); size > dataFileHeaderSize && size <= maxHeaderSize {
+		b = make([]byte, size)
+		if n, e = r.ReadAt(b, 0); e != nil && e != io.EOF {
+			return formatV1, e
+		}
+	}
+	return parseDataFormat(b[:n])
+}
+
+// encodeHeader returns the file header, which is empty for v1
+func (f dataFormat) encodeHeader() []byte {
+	if f.headerSize == 0 {
+		return nil
+	}
+	header := make([]byte, f.headerSize)
+	copy(header, dataFileMagic)
+	binary.BigEndian.PutUint16(header[4:6], f.version)
+	binary.BigEndian.PutUint16(header[6:8], f.flags)
+	binary.BigEndian.PutUint32(header[8:12], uint32(f.headerSize))
+	header[12] = f.codec
+	if f.encrypted() {
+		copy(header[dataFileHeaderSize:], f.salt[:])
+		binary.BigEndian.PutUint16(header[encryptionHeaderSize-2:encryptionHeaderSize], uint16(len(f.keyID)))
+		copy(header[encryptionHeaderSize:], f.keyID)
+	}
+	return header
+}
+
+func (f dataFormat) checksummed() bool {
+	return f.flags&flagChecksum != 0
+}
+
+func (f dataFormat) blocked() bool {
+	return f.flags&flagBlocks != 0
+}
+
+func (f dataFormat) valueCoded() bool {
+	return f.flags&flagValueCodec != 0
+}
+
+func (f dataFormat) encrypted() bool {
+	return f.flags&flagEncrypted != 0
+}
+
+// trailerSize returns the bytes following the value of a k-v pair
+func (f dataFormat) trailerSize() int64 {
+	if f.checksummed() {
+		return checksumSize
+	}
+	return 0
+}
+
+// recordSize returns the bytes of a k-v pair with valueSize
+func (f dataFormat) recordSize(valueSize int64) int64 {
+	return 24 + valueLength(valueSize) + f.trailerSize()
+}
+
+// encodeRecord encodes a k-v pair, or a tombstone with valueSize of tombstoneValueSize
+func (f dataFormat) encodeRecord(key int64, valueSize int64, value []byte) []byte {
+	record := make([]byte, f.recordSize(valueSize))
+	binary.BigEndian.PutUint64(record[0:8], 8)
+	binary.BigEndian.PutUint64(record[8:16], uint64(key))
+	binary.BigEndian.PutUint64(record[16:24], uint64(valueSize))
+	copy(record[24:], value)
+	if f.checksummed() {
+		body := record[:len(record)-checksumSize]
+		binary.BigEndian.PutUint32(record[len(body):], crc32Checksum(body))
+	}
+	return record
+}
+
+// verify checks the checksum of a whole k-v pair, a k-v pair without checksum is valid
+func (f dataFormat) verify(record []byte) bool {
+	if !f.checksummed() {
+		return true
+	}
+	body := record[:len(record)-checksumSize]
+	return crc32Checksum(body) == binary.BigEndian.Uint32(record[len(body):])
+}
@@ -0,0 +1,237 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// encodeRecordsV2 encodes k-v pairs in a data file of format v2
+func encodeRecordsV2(keys []int64, values []string) []byte {
+	format, _ := newDataFormat(DataFileV2)
+	data := format.encodeHeader()
+	for i, key := range keys {
+		data = append(data, format.encodeRecord(key, int64(len(values[i])), []byte(values[i]))...)
+	}
+	return data
+}
+
+func Test_data_format(t *testing.T) {
+	v2, e := newDataFormat(DataFileV2)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if _, e := newDataFormat(3); e == nil {
+		t.Error("expected an error for version 3")
+	}
+
+	parsed, e := parseDataFormat(v2.encodeHeader())
+	if e != nil || parsed != v2 {
+		t.Errorf("parsed:%+v, e:%v, expected %+v", parsed, e, v2)
+	}
+	// a v1 data file starts with key_size
+	if parsed, e := parseDataFormat(encodeRecord(1, []byte("a"))); e != nil || parsed != formatV1 {
+		t.Errorf("parsed:%+v, e:%v, expected v1", parsed, e)
+	}
+	if parsed, e := parseDataFormat(nil); e != nil || parsed != formatV1 {
+		t.Errorf("parsed empty:%+v, e:%v, expected v1", parsed, e)
+	}
+	header := v2.encodeHeader()
+	header[5] = 9
+	if _, e := parseDataFormat(header); e == nil {
+		t.Error("expected an error for an unsupported version")
+	}
+	// a flag unknown to this version could change how the k-v pairs are read
+	header = v2.encodeHeader()
+	header[6] |= 0x80
+	if _, e := parseDataFormat(header); e == nil || !strings.Contains(e.Error(), "0x8000") {
+		t.Errorf("e:%v, expected an error for an unknown flag", e)
+	}
+
+	record := v2.encodeRecord(7, 3, []byte("abc"))
+	if len(record) != 24+3+checksumSize || !v2.verify(record) {
+		t.Errorf("record:%v, expected a valid checksum", record)
+	}
+	tombstone := v2.encodeRecord(7, tombstoneValueSize, nil)
+	if len(tombstone) != 24+checksumSize || !v2.verify(tombstone) {
+		t.Errorf("tombstone:%v, expected a valid checksum", tombstone)
+	}
+	record[25] ^= 1
+	if v2.verify(record) {
+		t.Error("expected a checksum mismatch")
+	}
+}
+
+func Test_data_file_gen_v2(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	gen := &DataFileGen{
+		maxKey:         1 << 20,
+		maxValueLength: 64,
+		writeBufSize:   int(4 * KB),
+		maxSize:        32 * KB,
+		maxSegmentSize: 8 * KB,
+		version:        DataFileV2,
+		path:           dir + "/data/data.d",
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+
+	segments, _ := listSegments(dir + "/data")
+	if len(segments) < 2 {
+		t.Fatalf("segments:%v, expected rotated", segments)
+	}
+	for _, segment := range segments {
+		data, _ := ioutil.ReadFile(dir + "/data/" + segment)
+		format, e := parseDataFormat(data)
+		if e != nil || format.version != DataFileV2 {
+			t.Fatalf("segment %s format:%+v, e:%v, expected v2", segment, format, e)
+		}
+
+		// every k-v pair matches its checksum
+		fidx := newTestIndex(t, dir+"/index_"+segment, 4)
+		fidx.SetVerifyChecksums(true)
+		if e := fidx.Build(dir+"/data/"+segment, int(KB)); e != nil {
+			t.Fatal(e)
+		}
+		if len(fidx.CorruptRecords()) != 0 {
+			t.Errorf("segment %s corrupt records:%v", segment, fidx.CorruptRecords())
+		}
+	}
+}
+
+func Test_build_v2_verify(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	data := encodeRecordsV2([]int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	// flip a bit of the value of key 2
+	corrupted := append([]byte{}, data...)
+	corrupted[dataFileHeaderSize+(24+1+checksumSize)+24] ^= 1
+	createDirIfNotExist(dir + "/data")
+	if e := ioutil.WriteFile(dir+"/data/data.d", corrupted, 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	// without verification, the framing is valid
+	fidx := newTestIndex(t, dir+"/index", 4)
+	if e := fidx.Build(dir+"/data/data.d", int(KB)); e != nil {
+		t.Fatal(e)
+	}
+	opened := openTestIndex(t, dir+"/index", 4)
+	for k, v := range map[int64]string{1: "a", 2: "cb", 3: "ccc"} {
+		if found := findValue(t, opened, corrupted, k); found != v {
+			t.Errorf("key:%d, v:%s, expected %s", k, found, v)
+		}
+	}
+	opened.Close()
+
+	// with verification, the k-v pair is skipped from a file and from a stream
+	fidx = newTestIndex(t, dir+"/index", 4)
+	fidx.SetCorruptPolicy(CorruptSkip, 0)
+	fidx.SetVerifyChecksums(true)
+	if e := fidx.Build(dir+"/data/data.d", int(KB)); e != nil {
+		t.Fatal(e)
+	}
+	streamFidx := newTestIndex(t, dir+"/stream_index", 4)
+	streamFidx.SetCorruptPolicy(CorruptSkip, 0)
+	streamFidx.SetVerifyChecksums(true)
+	if e := streamFidx.BuildFromReader(bytes.NewReader(corrupted), dir+"/stream/data.d", int(KB)); e != nil {
+		t.Fatal(e)
+	}
+	copied, _ := ioutil.ReadFile(dir + "/stream/data.d")
+	if !bytes.Equal(copied, corrupted) {
+		t.Error("copied data file differs from the stream")
+	}
+
+	for _, f := range []*FastIndex{fidx, streamFidx} {
+		records := f.CorruptRecords()
+		if len(records) != 1 || records[0].Reason != "checksum mismatch" || records[0].Length != 24+2+checksumSize {
+			t.Errorf("corrupt records:%v, expected a checksum mismatch", records)
+		}
+		opened := openTestIndex(t, f.dir, 4)
+		for k, v := range map[int64]string{1: "a", 2: "", 3: "ccc"} {
+			if found := findValue(t, opened, corrupted, k); found != v {
+				t.Errorf("key:%d, v:%s, expected %s", k, found, v)
+			}
+		}
+		opened.Close()
+	}
+}
+
+func Test_db_v2(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	// a dataset of a v1 segment and a v2 segment
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2}, []string{"a", "bb"})
+	if e := ioutil.WriteFile(dir+"/data/data_0001.d", encodeRecordsV2([]int64{3, 4}, []string{"ccc", "dddd"}), 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	db.InitFind()
+	if e := db.Put(2, []byte("new bb")); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Delete(4); e != nil {
+		t.Fatal(e)
+	}
+
+	expected := map[int64]string{1: "a", 2: "new bb", 3: "ccc"}
+	check := func(stage string) {
+		for k, v := range expected {
+			if found, e := db.Get(k); e != nil || string(found) != v {
+				t.Errorf("%s key:%d, v:%s, e:%v, expected %s", stage, k, found, e, v)
+			}
+		}
+		if _, e := db.Get(4); e != ErrNotFound {
+			t.Errorf("%s deleted key:4, e:%v, expected ErrNotFound", stage, e)
+		}
+	}
+	check("put")
+
+	// the k-v pairs appended to the v2 segment have checksums
+	db.Close()
+	db = OpenDB(dir)
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	db.InitFind()
+	if len(db.CorruptRecords()) != 0 {
+		t.Errorf("corrupt records:%v, expected none", db.CorruptRecords())
+	}
+	check("rebuilt")
+
+	// compaction converts the k-v pairs into v2
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	check("compacted")
+	data, _ := ioutil.ReadFile(dir + "/data/data.d")
+	if format, _ := parseDataFormat(data); format.version != DataFileV2 {
+		t.Errorf("compacted format:%+v, expected v2", format)
+	}
+	db.Close()
+	db = OpenDB(dir)
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	if len(db.CorruptRecords()) != 0 {
+		t.Errorf("compacted corrupt records:%v, expected none", db.CorruptRecords())
+	}
+
+	// Get finds a corrupt value
+	data[dataFileHeaderSize+24] ^= 1
+	if e := ioutil.WriteFile(dir+"/data/data.d", data, 0644); e != nil {
+		t.Fatal(e)
+	}
+	db.InitFind()
+	if _, e := db.Get(1); e != ErrChecksumMismatch {
+		t.Errorf("e:%v, expected ErrChecksumMismatch", e)
+	}
+}
@@ -1,9 +1,13 @@
 package db
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 )
 
@@ -16,6 +20,7 @@ type DB struct {
 	dataFilePath string
 
 	indexShardNum int
+	sharder       Sharder
 
 	maxDataSize    int64
 	maxKey         int64
@@ -24,20 +29,101 @@ type DB struct {
 	// buffer size
 	writeBufSize int
 	readBufSize  int
+	// memBudget limits the buffers when building index, 0 means unlimited
+	memBudget int64
 
-	dataFile *os.File
-	fidx     *FastIndex
+	// maxSegmentSize rotates the data file into segments when creating data, 0 means no rotation
+	maxSegmentSize int64
+
+	// snapshot is the data files and the index opened by InitFind or Reload, the writers
+	// holding writeMu use it through the promoted fields, the readers acquire it
+	*snapshot
+
+	// dataFileVersion is the format of data files created by CreateData, verifyChecksums
+	// makes CreateIndex, Ingest and Get verify the checksums of k-v pairs
+	dataFileVersion int
+	verifyChecksums bool
+	// blockCodec compresses the blocks of data files created by CreateData and Compact,
+	// decompressed blocks are cached within blockCacheSize
+	blockCodec     byte
+	blockCacheSize int64
+	// valueEncoder compresses the values of Put, CreateData and Compact one by one
+	valueEncoder valueEncoder
+	// keys decrypt the values by ciphers of segments, and encrypt new data files if encrypt
+	keys    KeyProvider
+	encrypt bool
+	// ttl makes new data files have expiry, see SetTTL
+	ttl time.Duration
+	// distribution is how CreateData draws the keys and the values
+	distribution Distribution
+	// keyManifest makes CreateData write the key manifest at keyManifestPath
+	keyManifest     bool
+	keyManifestPath string
+	// genWorkers generate the data file of CreateData in parallel
+	genWorkers int
+
+	// Put appends to the last segment at writeOff, writeMu serializes the writers and the
+	// builders, which wait for the background merge as well
+	writeMu  sync.Mutex
+	writer   *os.File
+	writeOff int64
+
+	// memtableSize is the size of index items to flush the memtable into a generation.
+	// manifestMu guards the manifest of the snapshot along with nextGen and merging, and
+	// mergeWG waits for the background merge.
+	memtableSize int64
+	manifestMu   sync.Mutex
+	nextGen      int
+	merging      bool
+	mergeWG      sync.WaitGroup
+
+	// openMu guards swapping the snapshot against acquiring it, and closed tells whether
+	// Close closed it. stopWatch stops the goroutine of Watch.
+	openMu    sync.RWMutex
+	closed    bool
+	stopWatch chan struct{}
+
+	// lock is the LOCK file held by db, guarded by lockMu
+	lockMu sync.Mutex
+	lock   *dirLock
+
+	// compactionRate limits the bytes read by Compact per second, 0 means unlimited
+	compactionRate int64
+
+	// buildProgress is passed to FastIndex.Build by CreateIndex
+	buildProgress ProgressFunc
+
+	// how to handle corrupt k-v pairs when building index, and what's found
+	corruptPolicy  CorruptPolicy
+	maxValueSize   int64
+	corruptRecords []CorruptRecord
 }
 
+// ErrNotFound is returned by Get if the key doesn't exist
+var ErrNotFound = errors.New("key not found")
+
+// ErrClosed is returned if a DB or a FastIndex is used after Close
+var ErrClosed = errors.New("db is closed")
+
+// errNotOpened is returned if db is used before InitFind
+var errNotOpened = errors.New("db is not opened, call InitFind first")
+
+// ErrChecksumMismatch is returned by Get if the k-v pair doesn't match its checksum
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
 func OpenDB(baseDir string) *DB {
 	db := &DB{baseDir: baseDir}
 	db.dataFileDir = baseDir + "/data/"
 	db.dataFilePath = db.dataFileDir + "data.d"
+	db.keyManifestPath = baseDir + "/data.keys"
 	db.indexFileDir = baseDir + "/index/"
 	db.maxDataSize = 16 * GB
 	db.indexShardNum = 1000
+	db.sharder = ModSharder{}
 	db.maxKey = 1 << 30
 	db.maxValueLength = KB
+	db.memtableSize = defaultMemtableSize
+	db.blockCacheSize = defaultBlockCacheSize
 
 	// using for dataGen
 	db.writeBufSize = int(MB)
@@ -47,52 +133,639 @@ func OpenDB(baseDir string) *DB {
 	return db
 }
 
+// Open opens the data files and the index in baseDir to find with the default options. Use
+// OpenDB and InitFind to set options before opening.
+func Open(baseDir string) (*DB, error) {
+	db := OpenDB(baseDir)
+	if e := db.InitFind(); e != nil {
+		return nil, e
+	}
+	return db, nil
+}
+
+// SetMaxSegmentSize makes CreateData rotate the data file into segments of at most size bytes
+func (db *DB) SetMaxSegmentSize(size int64) {
+	db.maxSegmentSize = size
+}
+
+// SetGenWorkers makes CreateData generate the data file by workers in parallel, into a
+// segment per worker, or into segments of the max segment size if it's set. The data file
+// of a seed is the same for the same workers, or for the same max segment size if it's set.
+// workers <= 1 means one by one.
+func (db *DB) SetGenWorkers(workers int) {
+	db.genWorkers = workers
+}
+
+// SetDataFileVersion sets the format of data files created by CreateData, DataFileV1 or DataFileV2
+func (db *DB) SetDataFileVersion(version int) error {
+	if _, e := newDataFormat(version); e != nil {
+		return e
+	}
+	db.dataFileVersion = version
+	return nil
+}
+
+// SetBlockCompression makes CreateData and Compact group k-v pairs into blocks compressed
+// by codec: flate, lz4, or none for no blocks. A data file with blocks is of format v2.
+func (db *DB) SetBlockCompression(codec string) error {
+	id, e := codecByName(codec)
+	if e != nil {
+		return e
+	}
+	db.blockCodec = id
+	return nil
+}
+
+// SetBlockCacheSize sets the bytes of decompressed blocks cached for Get
+func (db *DB) SetBlockCacheSize(size int64) {
+	db.blockCacheSize = size
+}
+
+// dataFormat returns the format of data files created by db
+func (db *DB) dataFormat() (dataFormat, error) {
+	format, e := newDataFormat(db.dataFileVersion)
+	if e != nil {
+		return format, e
+	}
+	format = format.withBlocks(db.blockCodec).withValueCodec(db.valueEncoder.codec != codecNone).withExpiry(db.ttl > 0)
+	if !db.encrypt {
+		return format, nil
+	}
+	keyID, e := db.keys.CurrentKey()
+	if e != nil {
+		return format, e
+	}
+	return format.withEncryption(keyID), nil
+}
+
+// SetVerifyChecksums makes CreateIndex, Ingest and Get verify the checksums of k-v pairs
+// in data files which have checksums
+func (db *DB) SetVerifyChecksums(verify bool) {
+	db.verifyChecksums = verify
+}
+
 // create dataFile and indexFiles
-func (db *DB) CreateData(size int64) {
+func (db *DB) CreateData(size int64) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	release, e := db.lockBuilder("createData")
+	if e != nil {
+		return e
+	}
+	defer release()
+	// the background merge won't publish a manifest over the new dataset
+	db.mergeWG.Wait()
+
+	// remove segments of the last dataFile, CreateIndex indexes every segment in the dir
+	if segments, e := listSegments(db.dataFileDir); e == nil {
+		for _, segment := range segments {
+			os.Remove(filepath.Join(db.dataFileDir, segment))
+		}
+	}
+
 	// create dataFile
 	db.maxDataSize = size
+	keyID := ""
+	if db.encrypt {
+		var e error
+		if keyID, e = db.keys.CurrentKey(); e != nil {
+			return e
+		}
+	}
 	dataGen := &DataFileGen{
 		maxKey:         db.maxKey,
 		maxValueLength: db.maxValueLength,
 		maxSize:        db.maxDataSize,
+		maxSegmentSize: db.maxSegmentSize,
+		version:        db.dataFileVersion,
+		codec:          db.blockCodec,
+		valueEncoder:   db.valueEncoder,
+		keys:           db.keys,
+		keyID:          keyID,
+		ttl:            db.ttl,
+		dist:           db.distribution,
+		workers:        db.genWorkers,
 		writeBufSize:   db.writeBufSize,
 		path:           db.dataFilePath,
 	}
+	// the key manifest of the last dataFile is stale
+	os.Remove(db.keyManifestPath)
+	if db.keyManifest {
+		dataGen.keyManifestPath = db.keyManifestPath
+	}
 
 	if e := dataGen.generate(); e != nil {
-		fmt.Errorf("dataGen.generate error: %s", e)
+		return fmt.Errorf("dataGen.generate error: %s", e)
+	}
+	return nil
+}
+
+// OnBuildProgress registers a callback to follow the progress of CreateIndex
+func (db *DB) OnBuildProgress(fn ProgressFunc) {
+	db.buildProgress = fn
+}
+
+// SetSharding sets the shard count and the sharder of the index created by CreateIndex and Ingest
+func (db *DB) SetSharding(shardNum int, sharder Sharder) {
+	db.indexShardNum = shardNum
+	db.sharder = sharder
+}
+
+// SetMemoryBudget limits the memory of buffers used by CreateIndex, Ingest and Reshard,
+// budget <= 0 means unlimited
+func (db *DB) SetMemoryBudget(budget int64) {
+	db.memBudget = budget
+}
+
+// SetCorruptPolicy sets how CreateIndex, Ingest and Compact handle corrupt k-v pairs, and the
+// limit of value_size. Compact drops them unless the policy is CorruptAbort, without copying
+// them into a quarantine file. maxValueSize <= 0 means the default limit.
+func (db *DB) SetCorruptPolicy(policy CorruptPolicy, maxValueSize int64) {
+	db.corruptPolicy = policy
+	db.maxValueSize = maxValueSize
+}
+
+// CorruptRecords returns the corrupt k-v pairs found by the last CreateIndex or Ingest
+func (db *DB) CorruptRecords() []CorruptRecord {
+	return db.corruptRecords
+}
+
+// CreateIndex creates indexFiles for every segment in the data dir
+func (db *DB) CreateIndex() error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	release, e := db.lockBuilder("createIndex")
+	if e != nil {
+		return e
 	}
+	defer release()
+	// the background merge won't publish a manifest over the new dataset
+	db.mergeWG.Wait()
 
+	segments, e := listSegments(db.dataFileDir)
+	if e != nil {
+		return e
+	}
+	paths := make([]string, len(segments))
+	for i, segment := range segments {
+		paths[i] = filepath.Join(db.dataFileDir, segment)
+	}
+
+	// create indexFiles aside to publish them at once, the generations are stale as the new
+	// index covers every k-v pair
+	tmpDir := buildDir(db.indexFileDir)
+	fidx, e := db.newFastIndex(tmpDir)
+	if e != nil {
+		return e
+	}
+	e = fidx.BuildSegments(paths, db.readBufSize)
+	db.corruptRecords = fidx.CorruptRecords()
+	if e != nil {
+		os.RemoveAll(tmpDir)
+		return e
+	}
+
+	m := db.manifest(segments, segmentSizes(paths))
+	m.KeyIDs = segmentKeyIDs(paths)
+	if e := m.write(tmpDir); e != nil {
+		return e
+	}
+	return replaceIndex(tmpDir, db.indexFileDir)
 }
 
-func (db *DB) CreateIndex() {
-	// create indexFiles
-	fidx := NewFastIndex(db.indexFileDir, db.indexShardNum)
-	fidx.Build(db.dataFilePath, db.readBufSize)
+// Ingest copies the k-v pairs read from r into a new data file and creates indexFiles
+// in the same pass. Both are written aside, and replace the old data files and index at
+// once when the stream is done, so a failed ingest keeps the dataset as it was.
+func (db *DB) Ingest(r io.Reader) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	release, e := db.lockBuilder("ingest")
+	if e != nil {
+		return e
+	}
+	defer release()
+	// the background merge won't publish a manifest over the new dataset
+	db.mergeWG.Wait()
+
+	tmpDataDir := buildDir(db.dataFileDir)
+	tmpDir := buildDir(db.indexFileDir)
+	fidx, e := db.newFastIndex(tmpDir)
+	if e != nil {
+		return e
+	}
+	dataPath := filepath.Join(tmpDataDir, filepath.Base(db.dataFilePath))
+	e = fidx.BuildFromReader(r, dataPath, db.readBufSize)
+	db.corruptRecords = fidx.CorruptRecords()
+	if e != nil {
+		os.RemoveAll(tmpDataDir)
+		os.RemoveAll(tmpDir)
+		return e
+	}
+
+	segments := []string{filepath.Base(dataPath)}
+	m := db.manifest(segments, segmentSizes([]string{dataPath}))
+	m.KeyIDs = segmentKeyIDs([]string{dataPath})
+	if e := m.write(tmpDir); e != nil {
+		return e
+	}
+	return replaceDirs([][2]string{{tmpDataDir, filepath.Clean(db.dataFileDir)}, {tmpDir, filepath.Clean(db.indexFileDir)}})
 }
 
-func (db *DB) InitFind() {
-	df, e := os.Open(db.dataFilePath)
+// Reshard redistributes the items of the existing index into shardNum shards by the
+// sharder, without rescanning the data file. The new index replaces the old one when
+// it's completed.
+func (db *DB) Reshard(shardNum int, sharder Sharder) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	release, e := db.lockBuilder("reshard")
 	if e != nil {
-		panic(e)
+		return e
 	}
+	defer release()
+	db.mergeWG.Wait()
 
-	db.dataFile = df
-	db.fidx = OpenFastIndex(db.indexFileDir, db.indexShardNum)
+	m, e := readManifest(db.indexFileDir)
+	if e != nil {
+		return e
+	}
+	// an index without sharding in the manifest has as many shards as its index files
+	if m.ShardNum == 0 {
+		if m.ShardNum, e = countIndexShards(db.indexFileDir); e != nil {
+			return e
+		}
+	}
+	if e := db.applyManifest(m); e != nil {
+		return e
+	}
+	src, e := OpenFastIndex(db.indexFileDir, db.indexShardNum)
+	if e != nil {
+		return e
+	}
+	src.SetSharder(db.sharder)
+	defer src.Close()
+
+	indexDir := filepath.Clean(db.indexFileDir)
+	tmpDir := indexDir + ".reshard"
+	os.RemoveAll(tmpDir)
+
+	// db is sharded like the new index once it's published
+	fidx, e := db.newShardedIndex(tmpDir, shardNum, sharder)
+	if e != nil {
+		return e
+	}
+	if e := fidx.Reshard(src); e != nil {
+		os.RemoveAll(tmpDir)
+		return e
+	}
+
+	// the generations are resharded alike
+	for _, id := range m.Generations {
+		if e := reshardGeneration(generationDir(db.indexFileDir, id), src, generationDir(tmpDir, id), shardNum, sharder); e != nil {
+			os.RemoveAll(tmpDir)
+			return e
+		}
+	}
+
+	resharded := db.manifest(m.Segments, m.Sizes)
+	resharded.ShardNum, resharded.Sharder = shardNum, sharder.Name()
+	resharded.Generations = m.Generations
+	resharded.KeyIDs = m.KeyIDs
+	if e := resharded.write(tmpDir); e != nil {
+		return e
+	}
+
+	if e := replaceIndex(tmpDir, indexDir); e != nil {
+		return e
+	}
+	db.SetSharding(shardNum, sharder)
+	return nil
+}
+
+// reshardGeneration reshards the generation in dir, sharded like src, into dstDir
+func reshardGeneration(dir string, src *FastIndex, dstDir string, shardNum int, sharder Sharder) error {
+	gen, e := OpenFastIndex(dir, src.shardNum)
+	if e != nil {
+		return e
+	}
+	defer gen.Close()
+	gen.SetSharder(src.sharder)
+	dst, e := NewFastIndex(dstDir, shardNum)
+	if e != nil {
+		return e
+	}
+	dst.SetSharder(sharder)
+	return dst.Reshard(gen)
+}
+
+// newFastIndex creates a FastIndex in dir to build with the options of db
+func (db *DB) newFastIndex(dir string) (*FastIndex, error) {
+	return db.newShardedIndex(dir, db.indexShardNum, db.sharder)
+}
+
+// newShardedIndex creates a FastIndex in dir like newFastIndex, sharded by shardNum and sharder
+func (db *DB) newShardedIndex(dir string, shardNum int, sharder Sharder) (*FastIndex, error) {
+	fidx, e := NewFastIndex(dir, shardNum)
+	if e != nil {
+		return nil, e
+	}
+	fidx.SetSharder(sharder)
+	fidx.OnProgress(db.buildProgress)
+	fidx.SetCorruptPolicy(db.corruptPolicy, db.maxValueSize)
+	fidx.SetMemoryBudget(db.memBudget)
+	fidx.SetVerifyChecksums(db.verifyChecksums)
+	return fidx, nil
+}
+
+// manifest returns the manifest of an index built by db from segments
+func (db *DB) manifest(segments []string, sizes []int64) *manifest {
+	return &manifest{
+		Segments: segments,
+		Sizes:    sizes,
+		ShardNum: db.indexShardNum,
+		Sharder:  db.sharder.Name(),
+	}
+}
+
+// applyManifest uses the sharding of an existing index, an index without it in the manifest
+// is sharded by db's settings
+func (db *DB) applyManifest(m *manifest) error {
+	if m.ShardNum > 0 {
+		db.indexShardNum = m.ShardNum
+	}
+	if m.Sharder == "" {
+		return nil
+	}
+	sharder, ok := SharderByName(m.Sharder)
+	if !ok {
+		return fmt.Errorf("unknown sharder %s in manifest", m.Sharder)
+	}
+	db.sharder = sharder
+	return nil
+}
+
+func (db *DB) valueSizeLimit() int64 {
+	if db.maxValueSize <= 0 {
+		return defaultMaxValueSize
+	}
+	return db.maxValueSize
+}
+
+// Put appends a k-v pair to the last segment of the data file. The value is visible to
+// Get immediately, and it's indexed by the next CreateIndex. The LOCK file is held
+// exclusively from the first Put or Delete until Close, see lock.go.
+func (db *DB) Put(key int64, value []byte) error {
+	return db.put(key, value, 0)
+}
+
+// put puts a k-v pair expiring at expiresAt, 0 means never
+func (db *DB) put(key int64, value []byte, expiresAt int64) error {
+	if int64(len(value)) > db.valueSizeLimit() {
+		return fmt.Errorf("value size %d exceeds the limit %d", len(value), db.valueSizeLimit())
+	}
+	return db.append(key, int64(len(value)), value, expiresAt)
+}
+
+// append appends a k-v pair, or a tombstone with valueSize of tombstoneValueSize, to the
+// last segment, and flushes the memtable when it's full
+func (db *DB) append(key int64, valueSize int64, value []byte, expiresAt int64) error {
+	if key < 0 {
+		return fmt.Errorf("invalid key %d, it must not be negative", key)
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if e := db.checkOpen(); e != nil {
+		return e
+	}
+	if len(db.dataFiles) == 0 {
+		return errors.New("no data file to append")
+	}
+	// the writer holds the LOCK file until Close
+	if _, e := db.holdLock(LockExclusive, "put", true); e != nil {
+		return e
+	}
+
+	segment := len(db.dataFiles) - 1
+	if db.formats[segment].blocked() {
+		return errBlockSegment
+	}
+	if expiresAt != 0 && !db.formats[segment].expiring() {
+		return errNoExpiry
+	}
+	if db.writer == nil {
+		f, e := os.OpenFile(db.dataFiles[segment].Name(), os.O_WRONLY, 0644)
+		if e != nil {
+			return e
+		}
+		// drop a k-v pair partially written before a crash, its nonce can't be reused
+		if db.formats[segment].encrypted() {
+			if info, e := f.Stat(); e != nil || info.Size() > db.writeOff {
+				f.Close()
+				if e != nil {
+					return e
+				}
+				return errPartialSealed
+			}
+		}
+		if e := f.Truncate(db.writeOff); e != nil {
+			f.Close()
+			return e
+		}
+		db.writer = f
+	}
+
+	format := db.formats[segment]
+	if valueSize >= 0 {
+		stored, e := db.storedValue(format, value, expiresAt)
+		if e != nil {
+			return e
+		}
+		value, valueSize = stored, int64(len(stored))
+	}
+	if format.encrypted() && valueSize >= 0 {
+		if db.ciphers[segment] == nil {
+			return errNoKeyProvider
+		}
+		value = db.ciphers[segment].seal(key, db.writeOff+24, value)
+		valueSize = int64(len(value))
+	}
+	if valueSize > db.valueSizeLimit() {
+		return fmt.Errorf("stored value size %d exceeds the limit %d", valueSize, db.valueSizeLimit())
+	}
+
+	record := format.encodeRecord(key, valueSize, value)
+	if _, e := db.writer.WriteAt(record, db.writeOff); e != nil {
+		// the partially written k-v pair is checked when the writer is opened again
+		db.writer.Close()
+		db.writer = nil
+		return e
+	}
+	db.memtable.put(key, valueSize, packValuePos(segment, db.writeOff+24))
+	db.writeOff += int64(len(record))
+
+	if int64(db.memtable.len()*fixIndexItemSize) >= db.memtableSize {
+		return db.flushMemtable()
+	}
+	return nil
+}
+
+// Get returns the value of key, or ErrNotFound if it doesn't exist or it's deleted, or
+// ErrClosed after Close
+func (db *DB) Get(key int64) ([]byte, error) {
+	s, e := db.acquire()
+	if e != nil {
+		return nil, e
+	}
+	defer s.release()
+
+	vsize, vpos := s.find(key)
+	if vsize < 0 {
+		return nil, ErrNotFound
+	}
+
+	return s.readValue(key, vsize, vpos)
+}
+
+// storedValue returns a value as it's stored in a data file of format before sealing,
+// compressed and prefixed by its expiry
+func (db *DB) storedValue(format dataFormat, value []byte, expiresAt int64) ([]byte, error) {
+	if format.valueCoded() {
+		var e error
+		if value, e = db.valueEncoder.encode(value); e != nil {
+			return nil, e
+		}
+	}
+	if format.expiring() {
+		value = withExpiry(expiresAt, value)
+	}
+	return value, nil
+}
+
+// readValue reads the value of key of vsize bytes at vpos, decrypts it if the segment is
+// encrypted and decompresses it if the segment has compressed values. An expired value is
+// ErrNotFound.
+func (s *snapshot) readValue(key int64, vsize int64, vpos int64) ([]byte, error) {
+	segment, offset := unpackValuePos(vpos)
+	if segment >= len(s.dataFiles) {
+		return nil, fmt.Errorf("invalid value position of segment %d", segment)
+	}
+	stored, e := s.readStoredValue(segment, vsize, offset)
+	if e != nil {
+		return nil, e
+	}
+	value, expiresAt, e := s.openValue(segment, key, offset, stored)
+	if e != nil {
+		return nil, e
+	}
+	if expired(expiresAt, time.Now()) {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+// openValue returns the value stored at offset of a segment and its expiry, 0 means
+// never. It's decrypted if the segment is encrypted and decompressed if the segment has
+// compressed values.
+func (s *snapshot) openValue(segment int, key int64, offset int64, stored []byte) ([]byte, int64, error) {
+	format := s.formats[segment]
+	var e error
+	if format.encrypted() {
+		if s.ciphers[segment] == nil {
+			return nil, 0, errNoKeyProvider
+		}
+		if stored, e = s.ciphers[segment].open(key, offset, stored); e != nil {
+			return nil, 0, e
+		}
+	}
+	var expiresAt int64
+	if format.expiring() {
+		if expiresAt, stored, e = splitExpiry(stored); e != nil {
+			return nil, 0, e
+		}
+	}
+	if !format.valueCoded() {
+		return stored, expiresAt, nil
+	}
+	value, e := decodeValue(stored, s.db.valueSizeLimit())
+	return value, expiresAt, e
+}
+
+// readStoredValue reads the value of vsize bytes at offset of a segment, from a block if
+// the segment has blocks
+func (s *snapshot) readStoredValue(segment int, vsize int64, offset int64) ([]byte, error) {
+	format := s.formats[segment]
+	if format.blocked() {
+		return s.readBlockValue(segment, vsize, offset)
+	}
+
+	if s.db.verifyChecksums && format.checksummed() {
+		// read the whole k-v pair to verify its checksum
+		record := make([]byte, format.recordSize(vsize))
+		if _, e := s.dataFiles[segment].ReadAt(record, offset-24); e != nil {
+			return nil, e
+		}
+		if !format.verify(record) {
+			return nil, ErrChecksumMismatch
+		}
+		return record[24 : 24+vsize], nil
+	}
+
+	value := make([]byte, vsize)
+	if _, e := s.dataFiles[segment].ReadAt(value, offset); e != nil {
+		return nil, e
+	}
+	return value, nil
 }
 
 func (db *DB) Find(key int64) string {
-	vBuf := make([]byte, db.maxValueLength)
-	vsize, vpos := db.fidx.Find(key)
-	n, _ := db.dataFile.ReadAt(vBuf, vpos)
-	if n <= 0 {
+	v, e := db.Get(key)
+	if e != nil {
 		//fmt.Println("find error at key:", key)
 		return "error"
 	}
-	v := string(vBuf[:vsize])
-	return v
+	return string(v)
+}
+
+// encodeRecord encodes a k-v pair as <key_size, key, value_size, value>
+func encodeRecord(key int64, value []byte) []byte {
+	return formatV1.encodeRecord(key, int64(len(value)), value)
+}
+
+// segmentKeyIDs returns the IDs of the keys encrypting data files, or nil if none is
+// encrypted
+func segmentKeyIDs(paths []string) []string {
+	keyIDs := make([]string, len(paths))
+	encrypted := false
+	for i, path := range paths {
+		f, e := os.Open(path)
+		if e != nil {
+			continue
+		}
+		if format, e := readDataFormat(f); e == nil && format.encrypted() {
+			keyIDs[i] = format.keyID
+			encrypted = true
+		}
+		f.Close()
+	}
+	if !encrypted {
+		return nil
+	}
+	return keyIDs
 }
 
+// segmentSizes returns the sizes of data files
+func segmentSizes(paths []string) []int64 {
+	sizes := make([]int64, len(paths))
+	for i, path := range paths {
+		if info, e := os.Stat(path); e == nil {
+			sizes[i] = info.Size()
+		}
+	}
+	return sizes
+}
+
+// FindLoop finds loopCnt random keys and returns the average time, it stops when db is
+// closed
 func (db *DB) FindLoop(loopCnt int) int {
 	vBuf := make([]byte, db.maxValueLength)
 	totalTime := 0
@@ -100,8 +773,10 @@ func (db *DB) FindLoop(loopCnt int) int {
 		start := time.Now()
 
 		key := rand.Int63n(db.maxKey)
-		_, vpos := db.fidx.Find(key)
-		n, _ := db.dataFile.ReadAt(vBuf, vpos)
+		n, e := db.findOnce(key, vBuf)
+		if e != nil {
+			break
+		}
 		if n <= 0 {
 			//fmt.Println("find error at key:", key)
 			continue
@@ -112,3 +787,25 @@ func (db *DB) FindLoop(loopCnt int) int {
 	}
 	return totalTime / loopCnt
 }
+
+// findOnce reads the value of key into vBuf, or the value decoded, and returns its size
+func (db *DB) findOnce(key int64, vBuf []byte) (int, error) {
+	s, e := db.acquire()
+	if e != nil {
+		return 0, e
+	}
+	defer s.release()
+
+	vsize, vpos := s.fidx.Find(key)
+	segment, offset := unpackValuePos(vpos)
+	n := 0
+	if format := s.formats[segment]; format.blocked() || format.valueCoded() || format.encrypted() {
+		if vsize >= 0 {
+			v, _ := s.readValue(key, vsize, vpos)
+			n = len(v)
+		}
+	} else {
+		n, _ = s.dataFiles[segment].ReadAt(vBuf, offset)
+	}
+	return n, nil
+}
@@ -1,7 +1,9 @@
 package db
 
 import (
+	"bytes"
 	"fmt"
+	"os"
 	"sync"
 	"testing"
 )
@@ -41,3 +43,241 @@ func Test_db_find_one(t *testing.T) {
 	v := db.Find(k)
 	fmt.Println("key:", k, ", v:", v)
 }
+
+func Test_db_put_get(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+
+	if e := db.Put(2, []byte("new bb")); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Put(4, []byte("dddd")); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Put(-1, []byte("x")); e == nil {
+		t.Error("expected an error for a negative key")
+	}
+
+	expected := map[int64]string{1: "a", 2: "new bb", 3: "ccc", 4: "dddd"}
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+	if _, e := db.Get(5); e != ErrNotFound {
+		t.Errorf("key:5, e:%v, expected ErrNotFound", e)
+	}
+
+	// k-v pairs appended by Put are replayed when opened again
+	db.Close()
+	db = OpenDB(dir)
+	db.InitFind()
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("reopened key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+
+	// and indexed by the next CreateIndex, the latest value wins
+	db.Close()
+	db = OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	if db.memtable.len() != 0 {
+		t.Errorf("%d k-v pairs replayed, expected 0", db.memtable.len())
+	}
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("rebuilt key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+}
+
+func Test_db_ingest(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2}, []string{"a", "bb"})
+	writeRecords(t, dir+"/data/data_0001.d", []int64{3}, []string{"ccc"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	if e := db.CreateIndex(); e != nil {
+		t.Fatal(e)
+	}
+	check := func(stage string, expected map[int64]string) {
+		reader := OpenDB(dir)
+		if e := reader.InitFind(); e != nil {
+			t.Fatalf("%s: %v", stage, e)
+		}
+		defer reader.Close()
+		for k, v := range expected {
+			if found, e := reader.Get(k); e != nil || string(found) != v {
+				t.Errorf("%s key:%d, v:%s, e:%v, expected %s", stage, k, found, e, v)
+			}
+		}
+	}
+
+	// a truncated stream keeps the old data files and index
+	stream := encodeRecords([]int64{4, 5}, []string{"dddd", "eeeee"})
+	if e := db.Ingest(bytes.NewReader(stream[:len(stream)-1])); e == nil {
+		t.Fatal("expected an error for a truncated stream")
+	}
+	check("failed", map[int64]string{1: "a", 2: "bb", 3: "ccc"})
+
+	// the stream replaces every segment
+	if e := db.Ingest(bytes.NewReader(stream)); e != nil {
+		t.Fatal(e)
+	}
+	check("ingested", map[int64]string{4: "dddd", 5: "eeeee"})
+	if segments, _ := listSegments(dir + "/data"); len(segments) != 1 || leftBehind(db.dataFileDir, db.indexFileDir) {
+		t.Errorf("segments:%v, expected data.d only", segments)
+	}
+}
+
+func Test_db_put_after_torn_write(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1}, []string{"a"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	if e := db.Put(2, []byte("bb")); e != nil {
+		t.Fatal(e)
+	}
+
+	// a k-v pair partially written before a crash
+	f, _ := os.OpenFile(dir+"/data/data.d", os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(encodeRecord(3, []byte("ccc"))[:20])
+	f.Close()
+
+	db.Close()
+	db = OpenDB(dir)
+	db.InitFind()
+	if _, e := db.Get(3); e != ErrNotFound {
+		t.Errorf("key:3, e:%v, expected ErrNotFound", e)
+	}
+	if e := db.Put(4, []byte("dddd")); e != nil {
+		t.Fatal(e)
+	}
+
+	db.Close()
+	db = OpenDB(dir)
+	db.InitFind()
+	expected := map[int64]string{1: "a", 2: "bb", 4: "dddd"}
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+}
+
+func Test_db_close(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+
+	// the finding goroutines run until db is closed under them
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				v, e := db.Get(2)
+				if e == ErrClosed {
+					return
+				}
+				if e != nil || string(v) != "bb" {
+					t.Errorf("v:%s, e:%v, expected bb", v, e)
+					return
+				}
+			}
+		}()
+	}
+	if e := db.Close(); e != nil {
+		t.Fatal(e)
+	}
+	wg.Wait()
+
+	if e := db.Close(); e != ErrClosed {
+		t.Errorf("e:%v, expected ErrClosed closing twice", e)
+	}
+	if e := db.Put(4, []byte("d")); e != ErrClosed {
+		t.Errorf("put e:%v, expected ErrClosed", e)
+	}
+	if e := db.Delete(1); e != ErrClosed {
+		t.Errorf("delete e:%v, expected ErrClosed", e)
+	}
+	if e := db.Scan(0, 0, func(int64, []byte) bool { return true }); e != ErrClosed {
+		t.Errorf("scan e:%v, expected ErrClosed", e)
+	}
+	if _, e := db.Compact(); e != ErrClosed {
+		t.Errorf("compact e:%v, expected ErrClosed", e)
+	}
+	if n := db.FindLoop(10); n != 0 {
+		t.Errorf("FindLoop %d, expected nothing found", n)
+	}
+
+	// it's opened again by InitFind
+	db.InitFind()
+	if v, e := db.Get(3); e != nil || string(v) != "ccc" {
+		t.Errorf("reopened v:%s, e:%v", v, e)
+	}
+	if e := db.Close(); e != nil {
+		t.Error(e)
+	}
+}
+
+func Test_db_open_error(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	// neither the data file nor the index exists
+	if db, e := Open(dir); e == nil || db != nil {
+		t.Errorf("db:%v, e:%v, expected an error opening an empty dir", db, e)
+	}
+	if e := OpenDB(dir).CreateIndex(); e == nil {
+		t.Error("expected an error creating index without data file")
+	}
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2}, []string{"a", "bb"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	if e := db.CreateIndex(); e != nil {
+		t.Fatal(e)
+	}
+	db, e := Open(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if v, e := db.Get(2); e != nil || string(v) != "bb" {
+		t.Errorf("v:%s, e:%v, expected bb", v, e)
+	}
+	db.Close()
+
+	// a missing index file fails opening, and it's not opened partially
+	if e := os.Remove(dir + "/index/index_1.idx"); e != nil {
+		t.Fatal(e)
+	}
+	db = OpenDB(dir)
+	if e := db.InitFind(); e == nil {
+		t.Error("expected an error opening index with a missing index file")
+	}
+	if _, e := db.Get(2); e != errNotOpened {
+		t.Errorf("e:%v, expected errNotOpened", e)
+	}
+}
@@ -0,0 +1,246 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+// A Distribution is how DataFileGen draws the keys, the value sizes and the values, so a
+// benchmark could look like a real workload. Keys are below maxKey, and value sizes are at
+// most maxValueLength. The zero value is the original one, uniform keys and value sizes,
+// and values repeating the decimal string of their keys.
+
+const (
+	KeyUniform     = "uniform"
+	KeyZipf        = "zipf"
+	KeySequential  = "sequential"
+	KeyPermutation = "permutation"
+
+	SizeUniform   = "uniform"
+	SizeFixed     = "fixed"
+	SizeLogNormal = "lognormal"
+
+	ContentKey          = "key"
+	ContentRandom       = "random"
+	ContentCompressible = "compressible"
+
+	defaultZipfS         = 1.1
+	defaultCompressRatio = 2
+	// logNormalSigma is the sigma of log-normal value sizes, whose median is a quarter of
+	// maxValueLength
+	logNormalSigma = 1.0
+)
+
+type Distribution struct {
+	// Keys is KeyUniform, KeyZipf with the small keys hot, KeySequential from 0, or
+	// KeyPermutation which draws every key once in a random order before repeating
+	Keys string
+	// ZipfS is the exponent of KeyZipf, it must be > 1, 0 means 1.1
+	ZipfS float64
+	// ValueSize is SizeUniform, SizeFixed of maxValueLength, or SizeLogNormal
+	ValueSize string
+	// Content is ContentKey, ContentRandom, or ContentCompressible which compresses to
+	// about 1/CompressRatio of its size, 0 means 2
+	Content       string
+	CompressRatio float64
+	// Seed makes the keys and the values deterministic, 0 means a random seed
+	Seed int64
+}
+
+// check returns the distribution with the defaults filled, or an error if it's invalid
+func (d Distribution) check() (Distribution, error) {
+	if d.Keys == "" {
+		d.Keys = KeyUniform
+	}
+	if d.ValueSize == "" {
+		d.ValueSize = SizeUniform
+	}
+	if d.Content == "" {
+		d.Content = ContentKey
+	}
+	if d.ZipfS == 0 {
+		d.ZipfS = defaultZipfS
+	}
+	if d.CompressRatio == 0 {
+		d.CompressRatio = defaultCompressRatio
+	}
+
+	switch d.Keys {
+	case KeyUniform, KeyZipf, KeySequential, KeyPermutation:
+	default:
+		return d, fmt.Errorf("unknown key distribution %s", d.Keys)
+	}
+	switch d.ValueSize {
+	case SizeUniform, SizeFixed, SizeLogNormal:
+	default:
+		return d, fmt.Errorf("unknown value size distribution %s", d.ValueSize)
+	}
+	switch d.Content {
+	case ContentKey, ContentRandom, ContentCompressible:
+	default:
+		return d, fmt.Errorf("unknown value content %s", d.Content)
+	}
+	if d.ZipfS <= 1 {
+		return d, fmt.Errorf("invalid zipf exponent %v, it must be > 1", d.ZipfS)
+	}
+	if d.CompressRatio < 1 {
+		return d, fmt.Errorf("invalid compress ratio %v, it must be >= 1", d.CompressRatio)
+	}
+	return d, nil
+}
+
+// SetDistribution sets how CreateData draws the keys and the values
+func (db *DB) SetDistribution(d Distribution) error {
+	d, e := d.check()
+	if e != nil {
+		return e
+	}
+	db.distribution = d
+	return nil
+}
+
+// sampler draws the k-v pairs of a Distribution
+type sampler struct {
+	dist           Distribution
+	maxKey         int64
+	maxValueLength int64
+	seed           int64
+	rng            *rand.Rand
+	zipf           *rand.Zipf
+	// next is the number of keys drawn, of KeySequential and KeyPermutation
+	next int64
+	perm *permutation
+}
+
+func newSampler(d Distribution, maxKey int64, maxValueLength int64) (*sampler, error) {
+	d, e := d.check()
+	if e != nil {
+		return nil, e
+	}
+	if maxKey <= 0 || maxValueLength <= 0 {
+		return nil, fmt.Errorf("invalid maxKey %d or maxValueLength %d", maxKey, maxValueLength)
+	}
+	seed := d.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s := &sampler{dist: d, maxKey: maxKey, maxValueLength: maxValueLength, seed: seed, rng: rand.New(rand.NewSource(seed))}
+	if d.Keys == KeyZipf {
+		s.zipf = rand.NewZipf(s.rng, d.ZipfS, 1, uint64(maxKey-1))
+	} else if d.Keys == KeyPermutation {
+		s.perm = newPermutation(maxKey, s.rng)
+	}
+	return s, nil
+}
+
+// part returns the sampler of the i-th part of parts generated in parallel, which has its
+// own seed derived from the seed of s. The sequential keys and the permutation continue
+// from the i-th of parts equal ranges of keys, so the parts don't draw the same keys
+// unless a part draws more keys than its range.
+func (s *sampler) part(i int, parts int) *sampler {
+	seed := int64(uint64(s.seed) + uint64(i+1)*0x9e3779b97f4a7c15)
+	p := &sampler{dist: s.dist, maxKey: s.maxKey, maxValueLength: s.maxValueLength, seed: seed, rng: rand.New(rand.NewSource(seed))}
+	if s.zipf != nil {
+		p.zipf = rand.NewZipf(p.rng, s.dist.ZipfS, 1, uint64(s.maxKey-1))
+	}
+	p.perm = s.perm
+	p.next = int64(i) * ((s.maxKey + int64(parts) - 1) / int64(parts))
+	return p
+}
+
+func (s *sampler) key() int64 {
+	switch s.dist.Keys {
+	case KeyZipf:
+		return int64(s.zipf.Uint64())
+	case KeySequential:
+		key := s.next % s.maxKey
+		s.next++
+		return key
+	case KeyPermutation:
+		key := s.perm.at(s.next % s.maxKey)
+		s.next++
+		return key
+	}
+	return s.rng.Int63n(s.maxKey)
+}
+
+func (s *sampler) valueSize() int64 {
+	switch s.dist.ValueSize {
+	case SizeFixed:
+		return s.maxValueLength
+	case SizeLogNormal:
+		median := float64(s.maxValueLength) / 4
+		size := int64(median * math.Exp(logNormalSigma*s.rng.NormFloat64()))
+		if size >= s.maxValueLength {
+			return s.maxValueLength - 1
+		}
+		return size
+	}
+	return s.rng.Int63n(s.maxValueLength)
+}
+
+// value returns a value of key of about size bytes
+func (s *sampler) value(key int64, size int64) []byte {
+	switch s.dist.Content {
+	case ContentRandom:
+		value := make([]byte, size)
+		s.rng.Read(value)
+		return value
+	case ContentCompressible:
+		// a random prefix repeated, which compresses to about the prefix
+		value := make([]byte, size)
+		prefix := int64(math.Ceil(float64(size) / s.dist.CompressRatio))
+		s.rng.Read(value[:prefix])
+		for off := prefix; off < size; off += prefix {
+			copy(value[off:], value[:prefix])
+		}
+		return value
+	}
+	keyStr := strconv.FormatInt(key, 10)
+	return bytes.Repeat([]byte(keyStr), int(size/int64(len(keyStr))))
+}
+
+// permutation is a random bijection of [0, n) by a Feistel network over the smallest even
+// number of bits covering n, walking the cycle until it's within n
+type permutation struct {
+	n        int64
+	halfBits uint
+	keys     [4]uint64
+}
+
+func newPermutation(n int64, rng *rand.Rand) *permutation {
+	p := &permutation{n: n, halfBits: 1}
+	for int64(1)<<(2*p.halfBits) < n {
+		p.halfBits++
+	}
+	for i := range p.keys {
+		p.keys[i] = rng.Uint64()
+	}
+	return p
+}
+
+func (p *permutation) at(i int64) int64 {
+	x := uint64(i)
+	for {
+		x = p.encrypt(x)
+		if int64(x) < p.n {
+			return int64(x)
+		}
+	}
+}
+
+func (p *permutation) encrypt(x uint64) uint64 {
+	mask := uint64(1)<<p.halfBits - 1
+	left, right := x>>p.halfBits, x&mask
+	for _, key := range p.keys {
+		// the round function mixes right with the round key
+		h := (right ^ key) * 0x9e3779b97f4a7c15
+		h ^= h >> 29
+		left, right = right, (left^h)&mask
+	}
+	return left<<p.halfBits | right
+}
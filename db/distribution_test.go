@@ -0,0 +1,151 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"sort"
+	"testing"
+)
+
+func Test_permutation(t *testing.T) {
+	for _, n := range []int64{1, 2, 5, 1000, 4097} {
+		s, e := newSampler(Distribution{Keys: KeyPermutation, Seed: 7}, n, KB)
+		if e != nil {
+			t.Fatal(e)
+		}
+		seen := make(map[int64]bool)
+		for i := int64(0); i < n; i++ {
+			key := s.key()
+			if key < 0 || key >= n || seen[key] {
+				t.Fatalf("n:%d, key:%d drawn twice or out of range", n, key)
+			}
+			seen[key] = true
+		}
+		// and every key once more
+		if key := s.key(); !seen[key] {
+			t.Errorf("n:%d, key:%d out of range", n, key)
+		}
+	}
+}
+
+func Test_sampler(t *testing.T) {
+	const n = 10000
+	draw := func(d Distribution) ([]int64, []int64) {
+		s, e := newSampler(d, 1000, KB)
+		if e != nil {
+			t.Fatal(e)
+		}
+		keys := make([]int64, n)
+		sizes := make([]int64, n)
+		for i := range keys {
+			keys[i], sizes[i] = s.key(), s.valueSize()
+		}
+		return keys, sizes
+	}
+
+	keys, sizes := draw(Distribution{Keys: KeySequential, ValueSize: SizeFixed})
+	if keys[0] != 0 || keys[999] != 999 || keys[1000] != 0 || sizes[0] != KB {
+		t.Errorf("keys:%v, sizes:%v, expected sequential keys of fixed size", keys[:3], sizes[:3])
+	}
+
+	// the small keys are hot
+	keys, _ = draw(Distribution{Keys: KeyZipf, Seed: 1})
+	hot := 0
+	for _, key := range keys {
+		if key < 10 {
+			hot++
+		}
+	}
+	if hot < n/3 {
+		t.Errorf("%d keys < 10 of %d, expected zipf", hot, n)
+	}
+
+	// the median of log-normal sizes is a quarter of maxValueLength
+	_, sizes = draw(Distribution{ValueSize: SizeLogNormal, Seed: 1})
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	if median := sizes[n/2]; median < KB/4-32 || median > KB/4+32 || sizes[n-1] >= KB {
+		t.Errorf("median:%d, max:%d, expected %d and < %d", median, sizes[n-1], KB/4, KB)
+	}
+
+	// the same seed draws the same keys
+	a, _ := draw(Distribution{Seed: 3})
+	b, _ := draw(Distribution{Seed: 3})
+	c, _ := draw(Distribution{Seed: 4})
+	if !equalKeys(a, b) || equalKeys(a, c) {
+		t.Error("expected the same keys of the same seed only")
+	}
+
+	for _, bad := range []Distribution{{Keys: "normal"}, {ValueSize: "pareto"}, {Content: "text"}, {Keys: KeyZipf, ZipfS: 0.5},
+		{Content: ContentCompressible, CompressRatio: 0.5}} {
+		if _, e := newSampler(bad, 1000, KB); e == nil {
+			t.Errorf("distribution:%+v, expected an error", bad)
+		}
+	}
+}
+
+func equalKeys(a []int64, b []int64) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func Test_sampler_value(t *testing.T) {
+	s, _ := newSampler(Distribution{Content: ContentCompressible, CompressRatio: 4, Seed: 1}, 1000, 64*KB)
+	value := s.value(1, 64*KB)
+	compressed, _ := flateCodec{}.compress(value)
+	if len(value) != int(64*KB) || len(compressed) < len(value)/5 || len(compressed) > len(value)/3 {
+		t.Errorf("compressed %d of %d, expected about a quarter", len(compressed), len(value))
+	}
+
+	s, _ = newSampler(Distribution{Content: ContentRandom, Seed: 1}, 1000, KB)
+	value = s.value(1, KB)
+	if compressed, _ = (flateCodec{}).compress(value); len(compressed) < len(value) {
+		t.Errorf("compressed %d of %d, expected random", len(compressed), len(value))
+	}
+	key := &sampler{dist: Distribution{Content: ContentKey}}
+	if value := key.value(12, 7); string(value) != "121212" {
+		t.Errorf("v:%s, expected the key repeated", value)
+	}
+}
+
+func Test_data_file_gen_distribution(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	generate := func(path string) []byte {
+		gen := &DataFileGen{
+			maxKey:         500,
+			maxValueLength: 256,
+			writeBufSize:   int(4 * KB),
+			maxSize:        64 * KB,
+			dist:           Distribution{Keys: KeyPermutation, ValueSize: SizeLogNormal, Content: ContentRandom, Seed: 9},
+			path:           path,
+		}
+		if e := gen.generate(); e != nil {
+			t.Fatal(e)
+		}
+		data, _ := ioutil.ReadFile(path)
+		return data
+	}
+	data := generate(dir + "/data/data.d")
+	if !bytes.Equal(data, generate(dir+"/other/data.d")) {
+		t.Error("expected the same data file of the same seed")
+	}
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	found := 0
+	for key := int64(0); key < 500; key++ {
+		if _, e := db.Get(key); e == nil {
+			found++
+		}
+	}
+	if found != 500 {
+		t.Errorf("found %d keys, expected every key of the permutation", found)
+	}
+}
@@ -0,0 +1,250 @@
+package db
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The values of an encrypted data file are sealed by AES-GCM with a key derived by
+// HKDF-SHA256 from the key of key_id in its header and the random salt(16) of the data
+// file, so every data file has its own key. The nonce of a value is its value_position,
+// which is unique in the data file, so a nonce is never reused with a key. The key of the
+// k-v pair is the additional data, so a sealed value can't be moved to another key. Only
+// values are sealed, the keys and sizes are still indexed without the key.
+//
+// A k-v pair partially written before a crash is dropped when appending, and appending at
+// its offset would reuse its nonce, so an encrypted segment with one isn't appended until
+// it's compacted into new data files.
+
+const (
+	// encryptionHeaderSize is the file header before the key_id
+	encryptionHeaderSize = dataFileHeaderSize + saltSize + 2
+	saltSize             = 16
+	sealOverhead         = 16
+)
+
+// subkeyInfo binds the keys derived to sealing values
+var subkeyInfo = []byte("fastindex value key")
+
+var (
+	// ErrDecrypt is returned by Get when a value can't be opened by its key
+	ErrDecrypt = errors.New("value can't be decrypted")
+
+	errNoKeyProvider = errors.New("the data file is encrypted, set a KeyProvider first")
+	errPartialSealed = errors.New("the encrypted last segment has a partially written k-v pair, compact it before appending")
+)
+
+// KeyProvider supplies the AES keys of 16, 24 or 32 bytes by their IDs. The ID of a key is
+// saved in the data files it encrypts, so a key must be kept until no data file uses it.
+type KeyProvider interface {
+	// CurrentKey returns the ID of the key to encrypt new data files
+	CurrentKey() (string, error)
+	// Key returns the key of an ID
+	Key(id string) ([]byte, error)
+}
+
+// StaticKeys is a KeyProvider of fixed keys, Current is the ID of the key to encrypt
+type StaticKeys struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+func (keys *StaticKeys) CurrentKey() (string, error) {
+	if _, ok := keys.Keys[keys.Current]; !ok {
+		return "", fmt.Errorf("unknown current key %q", keys.Current)
+	}
+	return keys.Current, nil
+}
+
+func (keys *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := keys.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// LoadKeyFile reads the keys of a file of lines <id> <hex key>, the last key is the
+// current one. Empty lines and lines starting with # are skipped.
+func LoadKeyFile(path string) (*StaticKeys, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+
+	keys := &StaticKeys{Keys: make(map[string][]byte)}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected <id> <hex key>", path, line)
+		}
+		key, e := hex.DecodeString(fields[1])
+		if e != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, e)
+		}
+		if _, e := aes.NewCipher(key); e != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, e)
+		}
+		keys.Keys[fields[0]] = key
+		keys.Current = fields[0]
+	}
+	if e := scanner.Err(); e != nil {
+		return nil, e
+	}
+	if len(keys.Keys) == 0 {
+		return nil, fmt.Errorf("%s: no key", path)
+	}
+	return keys, nil
+}
+
+// withEncryption returns the format of v2 with the values sealed by the key of keyID,
+// the salt is set by withSalt for every data file
+func (f dataFormat) withEncryption(keyID string) dataFormat {
+	if keyID == "" {
+		f.flags &^= flagEncrypted
+		f.keyID = ""
+		f.salt = [saltSize]byte{}
+		if f.headerSize > dataFileHeaderSize {
+			f.headerSize = dataFileHeaderSize
+		}
+		return f
+	}
+	if f.version < DataFileV2 {
+		f, _ = newDataFormat(DataFileV2)
+	}
+	f.flags |= flagEncrypted
+	f.keyID = keyID
+	f.headerSize = encryptionHeaderSize + int64(len(keyID))
+	return f
+}
+
+// withSalt returns the format with a random salt for a new data file
+func (f dataFormat) withSalt() (dataFormat, error) {
+	if _, e := rand.Read(f.salt[:]); e != nil {
+		return f, e
+	}
+	return f, nil
+}
+
+// deriveKey derives the key of a data file from key and its salt by HKDF-SHA256, see
+// RFC 5869, the derived key is as long as key
+func deriveKey(key []byte, salt []byte) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(key)
+	prk := extract.Sum(nil)
+
+	derived := make([]byte, 0, len(key)+sha256.Size)
+	var block []byte
+	for i := byte(1); len(derived) < len(key); i++ {
+		expand := hmac.New(sha256.New, prk)
+		expand.Write(block)
+		expand.Write(subkeyInfo)
+		expand.Write([]byte{i})
+		block = expand.Sum(nil)
+		derived = append(derived, block...)
+	}
+	return derived[:len(key)]
+}
+
+// valueCipher seals and opens the values of a data file
+type valueCipher struct {
+	aead cipher.AEAD
+}
+
+// newValueCipher returns the cipher of an encrypted data file, or nil if it's not encrypted
+func newValueCipher(format dataFormat, keys KeyProvider) (*valueCipher, error) {
+	if !format.encrypted() {
+		return nil, nil
+	}
+	if keys == nil {
+		return nil, errNoKeyProvider
+	}
+	key, e := keys.Key(format.keyID)
+	if e != nil {
+		return nil, e
+	}
+	block, e := aes.NewCipher(deriveKey(key, format.salt[:]))
+	if e != nil {
+		return nil, e
+	}
+	aead, e := cipher.NewGCM(block)
+	if e != nil {
+		return nil, e
+	}
+	return &valueCipher{aead: aead}, nil
+}
+
+// nonce returns the nonce of the value at pos, <zero(4), value_position(8)>
+func (c *valueCipher) nonce(pos int64) []byte {
+	nonce := make([]byte, c.aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[4:12], uint64(pos))
+	return nonce
+}
+
+// seal seals the value of key at the value_position pos in the data file
+func (c *valueCipher) seal(key int64, pos int64, value []byte) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(key))
+	return c.aead.Seal(make([]byte, 0, len(value)+sealOverhead), c.nonce(pos), value, ad)
+}
+
+func (c *valueCipher) open(key int64, pos int64, sealed []byte) ([]byte, error) {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, uint64(key))
+	value, e := c.aead.Open(nil, c.nonce(pos), sealed, ad)
+	if e != nil {
+		return nil, ErrDecrypt
+	}
+	return value, nil
+}
+
+// sealRecord seals the value of a k-v pair in format at pos, the value of record isn't
+// sealed yet. A tombstone has no value to seal.
+func (c *valueCipher) sealRecord(record []byte, format dataFormat, pos int64) []byte {
+	key := int64(binary.BigEndian.Uint64(record[8:16]))
+	valueSize := int64(binary.BigEndian.Uint64(record[16:24]))
+	if valueSize < 0 {
+		return format.encodeRecord(key, valueSize, nil)
+	}
+	sealed := c.seal(key, pos, record[24:24+valueSize])
+	return format.encodeRecord(key, int64(len(sealed)), sealed)
+}
+
+// openRecord opens the value of a k-v pair in format at pos, the k-v pair is encoded
+// again with the opened value
+func (c *valueCipher) openRecord(record []byte, format dataFormat, pos int64) ([]byte, error) {
+	key := int64(binary.BigEndian.Uint64(record[8:16]))
+	valueSize := int64(binary.BigEndian.Uint64(record[16:24]))
+	if valueSize < 0 {
+		return record, nil
+	}
+	value, e := c.open(key, pos, record[24:24+valueSize])
+	if e != nil {
+		return nil, e
+	}
+	return format.encodeRecord(key, int64(len(value)), value), nil
+}
+
+// SetKeyProvider sets the keys to decrypt values, and to encrypt the new data files of
+// CreateData and Compact with the current key if encrypt. The ID of the key of every
+// segment is recorded in the manifest, so compacting with a new current key rotates it.
+func (db *DB) SetKeyProvider(keys KeyProvider, encrypt bool) {
+	db.keys = keys
+	db.encrypt = encrypt && keys != nil
+}
@@ -0,0 +1,292 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testKeys(current string, ids ...string) *StaticKeys {
+	keys := &StaticKeys{Current: current, Keys: make(map[string][]byte)}
+	for i, id := range ids {
+		keys.Keys[id] = bytes.Repeat([]byte{byte(i + 1)}, 32)
+	}
+	return keys
+}
+
+func Test_value_cipher(t *testing.T) {
+	keys := testKeys("k1", "k1", "k2")
+	format, _ := newDataFormat(DataFileV2)
+	format, _ = format.withEncryption("k1").withSalt()
+
+	parsed, e := parseDataFormat(format.encodeHeader())
+	if e != nil || parsed != format {
+		t.Fatalf("parsed:%+v, e:%v, expected %+v", parsed, e, format)
+	}
+	if _, e := parseDataFormat(format.encodeHeader()[:dataFileHeaderSize]); e == nil {
+		t.Error("expected an error for a truncated header")
+	}
+
+	c, e := newValueCipher(format, keys)
+	if e != nil {
+		t.Fatal(e)
+	}
+	sealed := c.seal(7, 100, []byte("secret"))
+	if len(sealed) != len("secret")+sealOverhead || bytes.Contains(sealed, []byte("secret")) {
+		t.Errorf("sealed:%v", sealed)
+	}
+	if value, e := c.open(7, 100, sealed); e != nil || string(value) != "secret" {
+		t.Errorf("v:%s, e:%v, expected secret", value, e)
+	}
+	// a sealed value is bound to its key and position
+	if _, e := c.open(8, 100, sealed); e != ErrDecrypt {
+		t.Errorf("e:%v, expected ErrDecrypt for another key", e)
+	}
+	if _, e := c.open(7, 101, sealed); e != ErrDecrypt {
+		t.Errorf("e:%v, expected ErrDecrypt for another position", e)
+	}
+
+	// another data file has another salt, and another key id another key
+	other, _ := format.withSalt()
+	c2, _ := newValueCipher(other, keys)
+	if bytes.Equal(c2.seal(7, 100, []byte("secret")), sealed) {
+		t.Error("expected different nonces for different salts")
+	}
+	c3, _ := newValueCipher(format.withEncryption("k2"), keys)
+	if _, e := c3.open(7, 100, sealed); e != ErrDecrypt {
+		t.Errorf("e:%v, expected ErrDecrypt for another key id", e)
+	}
+	if _, e := newValueCipher(format.withEncryption("k3"), keys); e == nil {
+		t.Error("expected an error for an unknown key id")
+	}
+	if _, e := newValueCipher(format, nil); e != errNoKeyProvider {
+		t.Errorf("e:%v, expected errNoKeyProvider", e)
+	}
+}
+
+func Test_value_cipher_subkey(t *testing.T) {
+	keys := testKeys("k1", "k1")
+	format, _ := newDataFormat(DataFileV2)
+	format, _ = format.withEncryption("k1").withSalt()
+	if format.headerSize != dataFileHeaderSize+saltSize+2+2 {
+		t.Fatalf("format:%+v, expected a 16-byte salt", format)
+	}
+
+	// data files differing in the last byte of the salt have different keys
+	other := format
+	other.salt[saltSize-1] ^= 1
+	c, _ := newValueCipher(format, keys)
+	c2, _ := newValueCipher(other, keys)
+	sealed := c.seal(7, 100, []byte("secret"))
+	if bytes.Equal(c2.seal(7, 100, []byte("secret")), sealed) {
+		t.Error("expected different keys for different salts")
+	}
+	if _, e := c2.open(7, 100, sealed); e != ErrDecrypt {
+		t.Errorf("e:%v, expected ErrDecrypt for another salt", e)
+	}
+	if derived := deriveKey(keys.Keys["k1"], format.salt[:]); len(derived) != 32 ||
+		bytes.Equal(derived, deriveKey(keys.Keys["k1"], other.salt[:])) {
+		t.Errorf("derived:%v, expected a 32-byte key for the salt", derived)
+	}
+
+	// the value is sealed by the derived key, with the position as the nonce
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], 100)
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, 7)
+	for _, key := range [][]byte{deriveKey(keys.Keys["k1"], format.salt[:]), keys.Keys["k1"]} {
+		block, _ := aes.NewCipher(key)
+		aead, _ := cipher.NewGCM(block)
+		value, e := aead.Open(nil, nonce, sealed, ad)
+		if derived := !bytes.Equal(key, keys.Keys["k1"]); derived != (e == nil) || derived && string(value) != "secret" {
+			t.Errorf("derived:%v, v:%s, e:%v, expected opened by the derived key only", derived, value, e)
+		}
+	}
+}
+
+func Test_load_key_file(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	path := dir + "/keys"
+	content := "# keys\nk1 " + strings.Repeat("01", 16) + "\n\nk2 " + strings.Repeat("02", 32) + "\n"
+	if e := ioutil.WriteFile(path, []byte(content), 0600); e != nil {
+		t.Fatal(e)
+	}
+	keys, e := LoadKeyFile(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if current, _ := keys.CurrentKey(); current != "k2" || len(keys.Keys["k1"]) != 16 {
+		t.Errorf("keys:%+v, expected k2 current", keys)
+	}
+
+	for _, bad := range []string{"k1\n", "k1 zz\n", "k1 0102\n", ""} {
+		ioutil.WriteFile(path, []byte(bad), 0600)
+		if _, e := LoadKeyFile(path); e == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+func Test_data_file_gen_encrypted(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	keys := testKeys("k1", "k1")
+	gen := &DataFileGen{
+		maxKey:         1 << 20,
+		maxValueLength: 256,
+		writeBufSize:   int(4 * KB),
+		maxSize:        128 * KB,
+		maxSegmentSize: 32 * KB,
+		valueEncoder:   valueEncoder{codec: codecLZ4},
+		keyID:          "k1",
+		keys:           keys,
+		path:           dir + "/data/data.d",
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	if len(db.CorruptRecords()) != 0 {
+		t.Errorf("corrupt records:%v", db.CorruptRecords())
+	}
+	m, _ := readManifest(dir + "/index")
+	if len(m.Segments) < 2 || len(m.KeyIDs) != len(m.Segments) || m.KeyIDs[0] != "k1" {
+		t.Fatalf("manifest:%+v, expected segments encrypted by k1", m)
+	}
+
+	// the values can't be read without the keys
+	db.InitFind()
+	f, _ := os.Open(dir + "/data/data.d")
+	defer f.Close()
+	info, _ := f.Stat()
+	keysFound := make([]int64, 0)
+	forEachRecord(f, db.formats[0], 0, info.Size(), 0, func(record []byte, valuePos int64, read int64) error {
+		keysFound = append(keysFound, int64(binary.BigEndian.Uint64(record[8:16])))
+		return nil
+	}, nil)
+	if len(keysFound) == 0 {
+		t.Fatal("no k-v pairs")
+	}
+	if _, e := db.Get(keysFound[0]); e != errNoKeyProvider {
+		t.Errorf("e:%v, expected errNoKeyProvider", e)
+	}
+
+	db.SetKeyProvider(keys, false)
+	db.InitFind()
+	for _, key := range keysFound {
+		value, e := db.Get(key)
+		if e != nil || strings.Trim(string(value), strconv.FormatInt(key, 10)) != "" {
+			t.Errorf("key:%d, v:%s, e:%v", key, value, e)
+		}
+	}
+}
+
+func Test_db_encryption(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2}, []string{"secret one", "secret two"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+
+	expected := map[int64]string{1: "secret one", 2: "secret two"}
+	check := func(stage string) {
+		for k, v := range expected {
+			if found, e := db.Get(k); e != nil || string(found) != v {
+				t.Errorf("%s key:%d, v:%s, e:%v, expected %s", stage, k, found, e, v)
+			}
+		}
+	}
+	plaintext := func() bool {
+		data, _ := ioutil.ReadFile(dir + "/data/data.d")
+		return bytes.Contains(data, []byte("secret"))
+	}
+	keyIDs := func() []string {
+		m, _ := readManifest(dir + "/index")
+		return m.KeyIDs
+	}
+
+	// compaction encrypts the data file with the current key
+	db.SetKeyProvider(testKeys("k1", "k1"), true)
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	check("encrypted")
+	if plaintext() || len(keyIDs()) != 1 || keyIDs()[0] != "k1" {
+		t.Errorf("key ids:%v, expected encrypted by k1", keyIDs())
+	}
+	if e := db.Put(3, []byte("secret three")); e != nil {
+		t.Fatal(e)
+	}
+	expected[3] = "secret three"
+	check("put")
+	if plaintext() {
+		t.Error("expected the appended value encrypted")
+	}
+
+	// the k-v pairs appended are indexed, and a tampered value can't be opened
+	db.Close()
+	db = OpenDB(dir)
+	db.SetKeyProvider(testKeys("k1", "k1"), false)
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	db.InitFind()
+	check("rebuilt")
+
+	// rotate into k2, k1 isn't needed any more
+	db.SetKeyProvider(testKeys("k2", "k1", "k2"), true)
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	if len(keyIDs()) != 1 || keyIDs()[0] != "k2" {
+		t.Errorf("key ids:%v, expected rotated into k2", keyIDs())
+	}
+	db.Close()
+	db = OpenDB(dir)
+	db.SetKeyProvider(&StaticKeys{Current: "k2", Keys: map[string][]byte{"k2": testKeys("k2", "k1", "k2").Keys["k2"]}}, false)
+	db.InitFind()
+	check("rotated")
+
+	data, _ := ioutil.ReadFile(dir + "/data/data.d")
+	tampered := append([]byte{}, data...)
+	format, _ := parseDataFormat(data)
+	tampered[format.headerSize+24] ^= 1
+	ioutil.WriteFile(dir+"/data/data.d", tampered, 0644)
+	db.InitFind()
+	if _, e := db.Get(1); e != ErrDecrypt {
+		t.Errorf("e:%v, expected ErrDecrypt", e)
+	}
+
+	// a partially written k-v pair isn't overwritten
+	ioutil.WriteFile(dir+"/data/data.d", append(data, 0, 0, 0), 0644)
+	db.InitFind()
+	if e := db.Put(4, []byte("four")); e != errPartialSealed {
+		t.Errorf("e:%v, expected errPartialSealed", e)
+	}
+
+	// and decrypted into a plaintext data file
+	db.SetKeyProvider(db.keys, false)
+	db.SetDataFileVersion(DataFileV1)
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	check("decrypted")
+	if !plaintext() || keyIDs() != nil {
+		t.Errorf("key ids:%v, expected plaintext", keyIDs())
+	}
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// With flagExpiry every value of a data file starts with <expires_at(8)>, the unix time in
+// seconds when the k-v pair expires, 0 means never. It's in front of the value compressed
+// by the value codec, and it's sealed along with the value in an encrypted data file. An
+// expired k-v pair is still indexed, but Get treats it as absent and Compact drops it.
+
+const expirySize = 8
+
+var errNoExpiry = errors.New("the last segment has no expiry, compact it with SetTTL first")
+
+// splitExpiry returns the expiry and the rest of a stored value
+func splitExpiry(stored []byte) (int64, []byte, error) {
+	if len(stored) < expirySize {
+		return 0, nil, errors.New("value without expiry")
+	}
+	return int64(binary.BigEndian.Uint64(stored[:expirySize])), stored[expirySize:], nil
+}
+
+// withExpiry returns the value prefixed by its expiry
+func withExpiry(expiresAt int64, value []byte) []byte {
+	stored := make([]byte, expirySize+len(value))
+	binary.BigEndian.PutUint64(stored, uint64(expiresAt))
+	copy(stored[expirySize:], value)
+	return stored
+}
+
+// expired tells whether a k-v pair with expiresAt is expired at now
+func expired(expiresAt int64, now time.Time) bool {
+	return expiresAt > 0 && now.Unix() >= expiresAt
+}
+
+// withExpiry returns the format of v2 with an expiry in every value if expiring
+func (f dataFormat) withExpiry(expiring bool) dataFormat {
+	if !expiring {
+		f.flags &^= flagExpiry
+		return f
+	}
+	if f.version < DataFileV2 {
+		f, _ = newDataFormat(DataFileV2)
+	}
+	f.flags |= flagExpiry
+	return f
+}
+
+func (f dataFormat) expiring() bool {
+	return f.flags&flagExpiry != 0
+}
+
+// SetTTL makes the new data files of CreateData and Compact have an expiry in every k-v
+// pair, and the k-v pairs created by CreateData expire randomly within ttl. 0 means no
+// expiry. The k-v pairs rewritten by Compact keep their expiry.
+func (db *DB) SetTTL(ttl time.Duration) {
+	db.ttl = ttl
+}
+
+// PutWithTTL puts a k-v pair which expires after ttl, see PutWithExpiry
+func (db *DB) PutWithTTL(key int64, value []byte, ttl time.Duration) error {
+	return db.PutWithExpiry(key, value, time.Now().Add(ttl))
+}
+
+// PutWithExpiry puts a k-v pair which is absent for Get from expiresAt, and is dropped by
+// the next Compact. The last segment must have been created with SetTTL.
+func (db *DB) PutWithExpiry(key int64, value []byte, expiresAt time.Time) error {
+	return db.put(key, value, expiresAt.Unix())
+}
@@ -0,0 +1,141 @@
+package db
+
+import (
+	"encoding/binary"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_db_expiry(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2}, []string{"a", "bb"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	if e := db.PutWithTTL(3, []byte("ccc"), time.Hour); e != errNoExpiry {
+		t.Errorf("e:%v, expected errNoExpiry", e)
+	}
+
+	// compaction converts the data file into one with expiry
+	db.SetTTL(time.Hour)
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	if !db.formats[0].expiring() {
+		t.Fatalf("format:%+v, expected expiry", db.formats[0])
+	}
+	if e := db.PutWithTTL(3, []byte("ccc"), time.Hour); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.PutWithExpiry(4, []byte("dddd"), time.Now().Add(-time.Second)); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.PutWithExpiry(1, []byte("expired a"), time.Now().Add(-time.Second)); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Put(5, []byte("eeeee")); e != nil {
+		t.Fatal(e)
+	}
+
+	expected := map[int64]string{2: "bb", 3: "ccc", 5: "eeeee"}
+	check := func(stage string) {
+		for k, v := range expected {
+			if found, e := db.Get(k); e != nil || string(found) != v {
+				t.Errorf("%s key:%d, v:%s, e:%v, expected %s", stage, k, found, e, v)
+			}
+		}
+		for _, k := range []int64{1, 4} {
+			if _, e := db.Get(k); e != ErrNotFound {
+				t.Errorf("%s expired key:%d, e:%v, expected ErrNotFound", stage, k, e)
+			}
+		}
+	}
+	check("put")
+	db.InitFind()
+	check("replayed")
+
+	// compaction drops the expired k-v pairs, along with compressing and encrypting
+	db.SetValueCompression("lz4", 0)
+	db.SetKeyProvider(testKeys("k1", "k1"), true)
+	stats, e := db.Compact()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if stats.Records != 3 || stats.Expired != 2 {
+		t.Errorf("stats:%+v, expected 3 records and 2 expired", stats)
+	}
+	check("compacted")
+	for _, k := range []int64{1, 4} {
+		if vsize, _ := db.fidx.Find(k); vsize >= 0 {
+			t.Errorf("expired key:%d is still indexed", k)
+		}
+	}
+	if e := db.PutWithExpiry(2, []byte("expired bb"), time.Now().Add(-time.Second)); e != nil {
+		t.Fatal(e)
+	}
+	delete(expected, 2)
+	if _, e := db.Get(2); e != ErrNotFound {
+		t.Errorf("expired key:2, e:%v, expected ErrNotFound", e)
+	}
+
+	// and the expiry is stripped from a data file without it
+	db.SetTTL(0)
+	db.SetValueCompression("none", 0)
+	db.SetKeyProvider(db.keys, false)
+	db.SetDataFileVersion(DataFileV1)
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	check("stripped")
+	if db.formats[0] != formatV1 {
+		t.Errorf("format:%+v, expected v1", db.formats[0])
+	}
+}
+
+func Test_data_file_gen_ttl(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	gen := &DataFileGen{
+		maxKey:         1 << 20,
+		maxValueLength: 64,
+		writeBufSize:   int(4 * KB),
+		maxSize:        32 * KB,
+		ttl:            time.Hour,
+		path:           dir + "/data/data.d",
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	db.InitFind()
+
+	f, _ := os.Open(dir + "/data/data.d")
+	defer f.Close()
+	info, _ := f.Stat()
+	now := time.Now()
+	e := forEachRecord(f, db.formats[0], 0, info.Size(), 0, func(record []byte, valuePos int64, read int64) error {
+		key := int64(binary.BigEndian.Uint64(record[8:16]))
+		expiresAt, _, e := splitExpiry(record[24 : 24+binary.BigEndian.Uint64(record[16:24])])
+		if e != nil || expiresAt <= now.Unix() || expiresAt > now.Add(time.Hour+time.Second).Unix() {
+			t.Fatalf("key:%d, expires at %d, e:%v, expected within an hour", key, expiresAt, e)
+		}
+		if found, e := db.Get(key); e != nil || strings.Trim(string(found), strconv.FormatInt(key, 10)) != "" {
+			t.Errorf("key:%d, v:%s, e:%v", key, found, e)
+		}
+		return nil
+	}, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+}
@@ -0,0 +1,300 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Export writes the k-v pairs as JSON Lines, CSV or a hex dump, in data file order or in
+// key order by the index. The values are read like Get, they are decrypted, decompressed,
+// and the expired ones are left out. In data file order, All dumps every k-v pair with its
+// position instead, the overwritten ones, the tombstones and the expired ones included.
+
+const (
+	ExportJSONL = "jsonl"
+	ExportCSV   = "csv"
+	ExportHex   = "hex"
+
+	OrderData = "data"
+	OrderKey  = "key"
+)
+
+// ExportOptions is which k-v pairs are exported and how
+type ExportOptions struct {
+	// Format is ExportJSONL, ExportCSV or ExportHex
+	Format string
+	// Order is OrderData or OrderKey
+	Order string
+	// From and To are the key range [From, To), To <= 0 means no end
+	From int64
+	To   int64
+	// Sample exports about the fraction of keys, 0 means all. The keys are sampled by
+	// their hash, so the same keys are sampled in both orders.
+	Sample float64
+	// All includes the k-v pairs which aren't live, only in OrderData
+	All bool
+}
+
+// ExportStats is the result of Export
+type ExportStats struct {
+	Records int64
+	// Bytes is the size of the output
+	Bytes int64
+}
+
+// exportRecord is a k-v pair being exported, value is nil for a tombstone
+type exportRecord struct {
+	key       int64
+	value     []byte
+	expiresAt int64
+	vsize     int64
+	vpos      int64
+	live      bool
+}
+
+// Export writes the k-v pairs of db selected by opts into w. The writers wait until it's
+// completed.
+func (db *DB) Export(w io.Writer, opts ExportOptions) (ExportStats, error) {
+	stats := ExportStats{}
+	if opts.Order == "" {
+		opts.Order = OrderData
+	}
+	if opts.Order != OrderData && opts.Order != OrderKey {
+		return stats, fmt.Errorf("unknown export order %s", opts.Order)
+	}
+	if opts.All && opts.Order != OrderData {
+		return stats, errors.New("all k-v pairs are only exported in data file order")
+	}
+	if opts.Sample < 0 || opts.Sample > 1 {
+		return stats, fmt.Errorf("invalid sample %v, it must be within [0, 1]", opts.Sample)
+	}
+
+	counter := &countingWriter{w: w}
+	buffered := bufio.NewWriterSize(counter, int(MB))
+	out, e := newRecordWriter(buffered, opts.Format)
+	if e != nil {
+		return stats, e
+	}
+
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if e := db.checkOpen(); e != nil {
+		return stats, e
+	}
+	// the generations won't change while exporting
+	db.mergeWG.Wait()
+
+	now := time.Now()
+	export := func(r exportRecord) error {
+		if r.live && expired(r.expiresAt, now) {
+			return nil
+		}
+		stats.Records++
+		return out.write(r)
+	}
+	if opts.Order == OrderData {
+		e = db.exportByData(opts, export)
+	} else {
+		e = db.exportByKey(opts, export)
+	}
+	if e == nil {
+		e = out.flush()
+	}
+	if e == nil {
+		e = buffered.Flush()
+	}
+	stats.Bytes = counter.n
+	return stats, e
+}
+
+// selected tells whether key is in the key range and the sample of opts
+func (opts ExportOptions) selected(key int64) bool {
+	if key < opts.From || (opts.To > 0 && key >= opts.To) {
+		return false
+	}
+	if opts.Sample <= 0 || opts.Sample >= 1 {
+		return true
+	}
+	return HashSharder{}.Shard(key, 1<<30) < int(opts.Sample*(1<<30))
+}
+
+// exportByData reads the segments in data file order, a k-v pair is live if it's the one
+// found for its key, like Compact
+func (db *DB) exportByData(opts ExportOptions, export func(exportRecord) error) error {
+	sizes, e := db.openedSizes()
+	if e != nil {
+		return e
+	}
+	for segment, df := range db.dataFiles {
+		e := forEachRecord(df, db.formats[segment], segment, sizes[segment], db.maxValueSize, func(record []byte, valuePos int64, read int64) error {
+			key := int64(binary.BigEndian.Uint64(record[8:16]))
+			if !opts.selected(key) {
+				return nil
+			}
+			r := exportRecord{key: key, vsize: int64(binary.BigEndian.Uint64(record[16:24])), vpos: valuePos}
+			vsize, vpos := db.find(key)
+			r.live = vsize >= 0 && vpos == valuePos
+			if !r.live && !opts.All {
+				return nil
+			}
+			if r.vsize >= 0 {
+				_, offset := unpackValuePos(valuePos)
+				var e error
+				r.value, r.expiresAt, e = db.openValue(segment, key, offset, record[24:24+r.vsize])
+				if e != nil {
+					return fmt.Errorf("segment %d: key %d: %s", segment, key, e)
+				}
+			}
+			return export(r)
+		}, nil)
+		if e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// exportByKey exports the k-v pair found for every key in key order
+func (db *DB) exportByKey(opts ExportOptions, export func(exportRecord) error) error {
+	return db.forEachKey(opts.From, opts.To, func(key int64, vsize int64, vpos int64) error {
+		if !opts.selected(key) {
+			return nil
+		}
+		r := exportRecord{key: key, vsize: vsize, vpos: vpos, live: true}
+		segment, offset := unpackValuePos(vpos)
+		stored, e := db.readStoredValue(segment, vsize, offset)
+		if e != nil {
+			return fmt.Errorf("key %d: %s", key, e)
+		}
+		if r.value, r.expiresAt, e = db.openValue(segment, key, offset, stored); e != nil {
+			return fmt.Errorf("key %d: %s", key, e)
+		}
+		return export(r)
+	})
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, e := c.w.Write(p)
+	c.n += int64(n)
+	return n, e
+}
+
+// recordWriter writes the k-v pairs exported in a format
+type recordWriter interface {
+	write(r exportRecord) error
+	flush() error
+}
+
+func newRecordWriter(w *bufio.Writer, format string) (recordWriter, error) {
+	switch format {
+	case ExportJSONL, "":
+		return &jsonRecordWriter{w: w}, nil
+	case ExportCSV:
+		cw := csv.NewWriter(w)
+		if e := cw.Write([]string{"key", "value"}); e != nil {
+			return nil, e
+		}
+		return &csvRecordWriter{w: cw}, nil
+	case ExportHex:
+		return &hexRecordWriter{w: w}, nil
+	}
+	return nil, fmt.Errorf("unknown export format %s", format)
+}
+
+// jsonRecordWriter writes a line of {"key":..., "value":...} per k-v pair. A value which
+// isn't valid UTF-8 is valueHex instead, a tombstone is deleted and a k-v pair which isn't
+// live is stale.
+type jsonRecordWriter struct {
+	w *bufio.Writer
+}
+
+type jsonRecord struct {
+	Key       int64   `json:"key"`
+	Value     *string `json:"value,omitempty"`
+	ValueHex  string  `json:"valueHex,omitempty"`
+	ExpiresAt int64   `json:"expiresAt,omitempty"`
+	Deleted   bool    `json:"deleted,omitempty"`
+	Stale     bool    `json:"stale,omitempty"`
+}
+
+func (j *jsonRecordWriter) write(r exportRecord) error {
+	line := jsonRecord{Key: r.key, ExpiresAt: r.expiresAt, Deleted: r.vsize < 0, Stale: !r.live && r.vsize >= 0}
+	if r.vsize >= 0 {
+		if utf8.Valid(r.value) {
+			value := string(r.value)
+			line.Value = &value
+		} else {
+			line.ValueHex = hex.EncodeToString(r.value)
+		}
+	}
+	b, e := json.Marshal(line)
+	if e != nil {
+		return e
+	}
+	j.w.Write(b)
+	return j.w.WriteByte('\n')
+}
+
+func (j *jsonRecordWriter) flush() error {
+	return nil
+}
+
+// csvRecordWriter writes a header of key,value and a row per k-v pair, so the output
+// could be imported again
+type csvRecordWriter struct {
+	w *csv.Writer
+}
+
+func (c *csvRecordWriter) write(r exportRecord) error {
+	return c.w.Write([]string{strconv.FormatInt(r.key, 10), string(r.value)})
+}
+
+func (c *csvRecordWriter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// hexRecordWriter writes a line of the key and the position per k-v pair, and the hex
+// dump of its value
+type hexRecordWriter struct {
+	w *bufio.Writer
+}
+
+func (h *hexRecordWriter) write(r exportRecord) error {
+	segment, offset := unpackValuePos(r.vpos)
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "key:%d, valueSize:%d, segment:%d, valuePos:%d", r.key, r.vsize, segment, offset)
+	if r.expiresAt > 0 {
+		fmt.Fprintf(&line, ", expiresAt:%s", time.Unix(r.expiresAt, 0).UTC().Format(time.RFC3339))
+	}
+	if r.vsize < 0 {
+		line.WriteString(", deleted")
+	} else if !r.live {
+		line.WriteString(", stale")
+	}
+	line.WriteByte('\n')
+	if len(r.value) > 0 {
+		line.WriteString(hex.Dump(r.value))
+	}
+	_, e := h.w.Write(line.Bytes())
+	return e
+}
+
+func (h *hexRecordWriter) flush() error {
+	return nil
+}
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_export(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{5, 1, 3, 2, 3}, []string{"e", "a", "c", "b", "new c"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	// a k-v pair in a generation, one in the memtable and a deleted one
+	db.SetMemtableSize(fixIndexItemSize)
+	if e := db.Put(4, []byte{0xff, 0}); e != nil {
+		t.Fatal(e)
+	}
+	db.SetMemtableSize(defaultMemtableSize)
+	db.Put(9, []byte("i"))
+	db.Delete(1)
+
+	export := func(opts ExportOptions) string {
+		var out bytes.Buffer
+		stats, e := db.Export(&out, opts)
+		if e != nil {
+			t.Fatalf("opts:%+v, e:%v", opts, e)
+		}
+		if stats.Bytes != int64(out.Len()) {
+			t.Errorf("stats:%+v, expected %d bytes", stats, out.Len())
+		}
+		return out.String()
+	}
+	keysOf := func(jsonl string) string {
+		keys := make([]string, 0)
+		for _, line := range strings.Split(strings.TrimSpace(jsonl), "\n") {
+			r := jsonRecord{}
+			if e := json.Unmarshal([]byte(line), &r); e != nil {
+				t.Fatalf("line %q: %s", line, e)
+			}
+			keys = append(keys, fmt.Sprint(r.Key))
+		}
+		return strings.Join(keys, ",")
+	}
+
+	byKey := export(ExportOptions{Format: ExportJSONL, Order: OrderKey})
+	if keysOf(byKey) != "2,3,4,5,9" || !strings.Contains(byKey, `{"key":3,"value":"new c"}`) ||
+		!strings.Contains(byKey, `{"key":4,"valueHex":"ff00"}`) {
+		t.Errorf("key order:\n%s", byKey)
+	}
+	if byData := export(ExportOptions{}); keysOf(byData) != "5,2,3,4,9" {
+		t.Errorf("data order:\n%s", byData)
+	}
+	all := export(ExportOptions{All: true})
+	if keysOf(all) != "5,1,3,2,3,4,9,1" || !strings.Contains(all, `{"key":3,"value":"c","stale":true}`) ||
+		!strings.Contains(all, `{"key":1,"deleted":true}`) {
+		t.Errorf("all:\n%s", all)
+	}
+	if ranged := export(ExportOptions{Order: OrderKey, From: 3, To: 5}); keysOf(ranged) != "3,4" {
+		t.Errorf("range:\n%s", ranged)
+	}
+	if hex := export(ExportOptions{Format: ExportHex, Order: OrderKey, From: 4, To: 5}); !strings.HasPrefix(hex,
+		"key:4, valueSize:2, segment:0, valuePos:") || !strings.Contains(hex, "ff 00") {
+		t.Errorf("hex:\n%s", hex)
+	}
+
+	// the same keys are sampled in both orders
+	sampleByKey := export(ExportOptions{Order: OrderKey, Sample: 0.5})
+	sampleByData := export(ExportOptions{Sample: 0.5})
+	if len(sampleByKey) == 0 || len(sampleByKey) >= len(byKey) || len(sampleByKey) != len(sampleByData) {
+		t.Errorf("sampled by key:\n%s, by data:\n%s", sampleByKey, sampleByData)
+	}
+
+	// CSV could be imported again
+	csv := export(ExportOptions{Format: ExportCSV, Order: OrderKey, To: 4})
+	if csv != "key,value\n2,b\n3,new c\n" {
+		t.Errorf("csv:\n%s", csv)
+	}
+	copied := OpenDB(dir + "/copy")
+	copied.indexShardNum = 4
+	if _, e := copied.Import(strings.NewReader(csv), ImportOptions{Format: ImportCSV, Header: true,
+		KeyColumn: "key", ValueColumn: "value", Index: true}); e != nil {
+		t.Fatal(e)
+	}
+	copied.InitFind()
+	if v, e := copied.Get(3); e != nil || string(v) != "new c" {
+		t.Errorf("v:%s, e:%v, expected new c", v, e)
+	}
+
+	// the values are decrypted and decompressed, and the expired ones left out
+	db.SetValueCompression("lz4", 0)
+	db.SetKeyProvider(testKeys("k1", "k1"), true)
+	db.SetTTL(time.Hour)
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	db.PutWithExpiry(2, []byte("expired"), time.Now().Add(-time.Second))
+	db.PutWithTTL(6, []byte("f"), time.Hour)
+	converted := export(ExportOptions{Order: OrderKey})
+	if keysOf(converted) != "3,4,5,6,9" || !strings.Contains(converted, `{"key":3,"value":"new c"}`) ||
+		!strings.Contains(converted, `"key":6,"value":"f","expiresAt":`) {
+		t.Errorf("converted:\n%s", converted)
+	}
+	if byData := export(ExportOptions{}); keysOf(byData) != "5,3,4,9,6" {
+		t.Errorf("converted data order:\n%s", byData)
+	}
+
+	for _, bad := range []ExportOptions{{Format: "xml"}, {Order: "size"}, {Order: OrderKey, All: true}, {Sample: 2}} {
+		if _, e := db.Export(&bytes.Buffer{}, bad); e == nil {
+			t.Errorf("opts:%+v, expected an error", bad)
+		}
+	}
+}
@@ -4,9 +4,12 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"sync"
 	"syscall"
 )
 
@@ -24,6 +27,30 @@ type FastIndex struct {
 	dir      string
 	shardNum int
 	shards   []*IndexShard
+	sharder  Sharder
+
+	// pool is shared by all shards to buffer index items within memBudget
+	pool      *bufferPool
+	memBudget int64
+
+	// progress is called while building, could be nil
+	progress ProgressFunc
+
+	// corrupt k-v pairs handling while building
+	corruptPolicy CorruptPolicy
+	maxValueSize  int64
+	corrupted     []CorruptRecord
+	quarantine    *os.File
+
+	// format of the data file being built, and whether to verify the checksums of k-v pairs
+	format          dataFormat
+	verifyChecksums bool
+
+	// gens are the generations flushed from the memtable, newest last. genMu is held by
+	// Find, so Close waits for the finding goroutines before unmapping.
+	genMu  sync.RWMutex
+	gens   []*FastIndex
+	closed bool
 }
 
 type IndexShard struct {
@@ -31,33 +58,47 @@ type IndexShard struct {
 	fileName string
 	shard    int
 
-	buf          *bytes.Buffer
+	// blocks from pool buffer index items, the last one is being written
+	pool         *bufferPool
+	blocks       [][]byte
+	buffered     int
 	writeBufSize int
 	totalSize    int64
 
 	file     *os.File
 	fileSize int64
-	items    items
 
-	// mmap indexFile's data
-	dataRef []byte
+	// mmap indexFile's data, mapped once when it's opened
+	dataRef  []byte
+	mmapOnce sync.Once
+	mmapErr  error
 }
 
-func NewFastIndex(dir string, shardNum int) *FastIndex {
+// NewFastIndex creates the index files of shardNum shards in dir to build a FastIndex
+func NewFastIndex(dir string, shardNum int) (*FastIndex, error) {
 	fidx := &FastIndex{
 		dir:      dir,
 		shardNum: shardNum,
+		sharder:  ModSharder{},
 	}
 
-	fidx.shards = make([]*IndexShard, shardNum)
+	fidx.pool = newBufferPool(0)
+	fidx.shards = make([]*IndexShard, 0, shardNum)
 	for i := 0; i < shardNum; i++ {
-		fidx.shards[i] = NewIndexShard(dir, i)
+		idx, e := NewIndexShard(dir, i)
+		if e != nil {
+			fidx.closeShards()
+			return nil, e
+		}
+		idx.pool = fidx.pool
+		fidx.shards = append(fidx.shards, idx)
 	}
+	fidx.pool.shards = fidx.shards
 
-	return fidx
+	return fidx, nil
 }
 
-func NewIndexShard(dir string, shard int) *IndexShard {
+func NewIndexShard(dir string, shard int) (*IndexShard, error) {
 	idx := &IndexShard{
 		dir:          dir,
 		shard:        shard,
@@ -65,33 +106,44 @@ func NewIndexShard(dir string, shard int) *IndexShard {
 	}
 
 	idx.fileName = dir + "/index_" + strconv.Itoa(shard) + ".idx"
-	createDirIfNotExist(dir)
+	if e := createDirIfNotExist(dir); e != nil {
+		return nil, e
+	}
 	file, e := os.Create(idx.fileName)
 	if e != nil {
-		panic(e)
+		return nil, e
 	}
 	idx.file = file
 
-	idx.buf = bytes.NewBuffer([]byte{})
+	idx.pool = newBufferPool(0)
+	idx.pool.shards = []*IndexShard{idx}
 
-	return idx
+	return idx, nil
 }
 
-func OpenFastIndex(idxDir string, shardNum int) *FastIndex {
+// OpenFastIndex opens the index files of shardNum shards in idxDir and maps them into memory
+// to find
+func OpenFastIndex(idxDir string, shardNum int) (*FastIndex, error) {
 	fidx := &FastIndex{
 		dir:      idxDir,
 		shardNum: shardNum,
+		sharder:  ModSharder{},
 	}
 
-	fidx.shards = make([]*IndexShard, shardNum)
+	fidx.shards = make([]*IndexShard, 0, shardNum)
 	for i := 0; i < shardNum; i++ {
-		fidx.shards[i] = OpenIndexShard(idxDir, i)
+		idx, e := OpenIndexShard(idxDir, i)
+		if e != nil {
+			fidx.closeShards()
+			return nil, e
+		}
+		fidx.shards = append(fidx.shards, idx)
 	}
 
-	return fidx
+	return fidx, nil
 }
 
-func OpenIndexShard(idxDir string, shard int) *IndexShard {
+func OpenIndexShard(idxDir string, shard int) (*IndexShard, error) {
 	idx := &IndexShard{
 		dir:          idxDir,
 		shard:        shard,
@@ -99,87 +151,269 @@ func OpenIndexShard(idxDir string, shard int) *IndexShard {
 	}
 
 	idx.fileName = idxDir + "/index_" + strconv.Itoa(shard) + ".idx"
-	createDirIfNotExist(idxDir)
 	file, e := os.Open(idx.fileName)
 	if e != nil {
-		panic(e)
+		return nil, e
 	}
 
 	dfInfo, e := file.Stat()
 	if e != nil {
-		panic("OpenIndexShard : open indexShardFile error")
+		file.Close()
+		return nil, fmt.Errorf("OpenIndexShard : stat %s error: %s", idx.fileName, e)
 	}
 	size := dfInfo.Size()
 
 	idx.file = file
 	idx.fileSize = size
+	if e := idx.mmap(); e != nil {
+		file.Close()
+		return nil, e
+	}
 
-	return idx
+	return idx, nil
 }
 
-// Build builds a FastIndex from existed data file
-func (fidx *FastIndex) Build(dataPath string, readBufSize int) {
-	dfile, e := os.Open(dataPath)
-	defer dfile.Close()
+// closeShards closes the index files of the shards created or opened, and unmaps them
+func (fidx *FastIndex) closeShards() {
+	for _, idx := range fidx.shards {
+		if len(idx.dataRef) > 0 {
+			syscall.Munmap(idx.dataRef)
+			idx.dataRef = nil
+		}
+		idx.file.Close()
+	}
+}
+
+// SetSharder sets how index items are sharded, it must be the same one the index was built with
+func (fidx *FastIndex) SetSharder(sharder Sharder) {
+	fidx.sharder = sharder
+}
 
+// SetMemoryBudget limits the memory of buffers used by Build and Reshard, including the
+// read buffer, the buffers of all shards and the runs sorted in memory. budget <= 0
+// means unlimited.
+func (fidx *FastIndex) SetMemoryBudget(budget int64) {
+	if budget > 0 && budget < minMemoryBudget {
+		budget = minMemoryBudget
+	}
+	fidx.memBudget = budget
+}
+
+// budgetReadBuf returns the read buffer's size within the memory budget, and gives the
+// rest of the budget to the pool
+func (fidx *FastIndex) budgetReadBuf(readBufSize int) int {
+	if fidx.memBudget <= 0 {
+		return readBufSize
+	}
+
+	if limit := int(fidx.memBudget / 4); readBufSize > limit {
+		readBufSize = limit
+	}
+	fidx.pool.budget = fidx.memBudget - int64(readBufSize)
+	return readBufSize
+}
+
+// countIndexShards counts the index files in idxDir
+func countIndexShards(idxDir string) (int, error) {
+	files, e := filepath.Glob(filepath.Join(idxDir, "index_*.idx"))
 	if e != nil {
-		panic("Build index : open dataFile error")
+		return 0, e
 	}
+	return len(files), nil
+}
+
+// SetVerifyChecksums makes Build verify the checksum of every k-v pair in a data file
+// which has checksums, a k-v pair with a wrong checksum is handled as a corrupt one
+func (fidx *FastIndex) SetVerifyChecksums(verify bool) {
+	fidx.verifyChecksums = verify
+}
+
+// OnProgress registers a callback which is called while Build is running
+func (fidx *FastIndex) OnProgress(fn ProgressFunc) {
+	fidx.progress = fn
+}
+
+// Build builds a FastIndex from existed data file
+func (fidx *FastIndex) Build(dataPath string, readBufSize int) error {
+	return fidx.BuildSegments([]string{dataPath}, readBufSize)
+}
+
+// BuildSegments builds a FastIndex from a set of data files, the position of a data file
+// in dataPaths is its segment ID. The index files are closed even if it fails.
+func (fidx *FastIndex) BuildSegments(dataPaths []string, readBufSize int) error {
+	if len(dataPaths) > maxSegmentNum {
+		fidx.closeShards()
+		return fmt.Errorf("Build index : too many segments %d, at most %d", len(dataPaths), maxSegmentNum)
+	}
+
+	dfiles := make([]*os.File, len(dataPaths))
+	var totalSize int64 = 0
+	for i, dataPath := range dataPaths {
+		dfile, e := os.Open(dataPath)
+		if e != nil {
+			fidx.closeShards()
+			return fmt.Errorf("Build index : open dataFile error: %s", e)
+		}
+		defer dfile.Close()
+
+		dfInfo, e := dfile.Stat()
+		if e != nil {
+			fidx.closeShards()
+			return fmt.Errorf("Build index : open dataFile error: %s", e)
+		}
+		dfiles[i] = dfile
+		totalSize += dfInfo.Size()
+	}
+	reporter := newProgressReporter(fidx.progress, totalSize, fidx.shardNum)
+	fidx.corrupted = nil
+	defer fidx.closeQuarantine()
+
+	buf := make([]byte, fidx.budgetReadBuf(readBufSize))
+	var parsed int64 = 0
+	var records int64 = 0
+	for segment, dfile := range dfiles {
+		var e error
+		if parsed, records, e = fidx.scan(segment, dfile, buf, reporter, parsed, records); e != nil {
+			fidx.closeShards()
+			return e
+		}
+	}
+
+	return fidx.finish(reporter)
+}
+
+// scan indexes every k-v pair of a segment, parsed and records count the progress of
+// the whole build
+func (fidx *FastIndex) scan(segment int, dfile *os.File, buf []byte, reporter *progressReporter,
+	parsed int64, records int64) (int64, int64, error) {
 	dfInfo, e := dfile.Stat()
 	if e != nil {
-		panic("Build index : open dataFile error")
+		return 0, 0, fmt.Errorf("Build index : open dataFile error: %s", e)
 	}
 	size := dfInfo.Size()
+	if fidx.format, e = readDataFormat(dfile); e != nil {
+		return 0, 0, fmt.Errorf("Build index : segment %d: %s", segment, e)
+	}
+	if fidx.format.blocked() {
+		return fidx.scanBlocks(segment, dfile, size, reporter, parsed, records)
+	}
 
-	var fReadOff int64 = 0
+	// k-v pairs follow the file header
+	var fReadOff int64 = fidx.format.headerSize
 	var kvReadOff int64 = 0
 	var valuePos int64 = 0
-	buf := make([]byte, readBufSize)
 	valuePosByte := make([]byte, 8)
+	// buf grown for a large k-v pair is reserved from the budget of the pool
+	var reserved int64 = 0
+	defer func() { fidx.pool.unreserve(reserved) }()
 	for fReadOff < size {
 		// reset kv read offset
 		kvReadOff = 0
 		n, e := dfile.ReadAt(buf, fReadOff)
-		if e != nil {
-			//panic("Build index: read dataFile error")
+		if e != nil && e != io.EOF {
+			return 0, 0, fmt.Errorf("Build index : read dataFile error: %s", e)
 		}
 
 		len := int64(n)
 		for kvReadOff < len {
+			pos := fReadOff + kvReadOff
+
 			// next read can't read whole kv pair's size columns, reload buf
-			if len-kvReadOff-24 < 0 {
+			if len-kvReadOff-24 < 0 && pos+24 <= size {
 				break
 			}
 
+			// skip the corrupt k-v pair to the next plausible one
+			if reason := fidx.checkHeader(buf[kvReadOff:len], pos, size); reason != "" {
+				next := fidx.resync(dfile, pos, size)
+				if e := fidx.corruptAt(dfile, segment, pos, next, reason); e != nil {
+					return 0, 0, fmt.Errorf("Build index : %s", e)
+				}
+				kvReadOff = next - fReadOff
+				continue
+			}
+
 			// write into indexShard
 			keyByte, key, valueSizeByte, valueSize := fidx.readKV(buf, kvReadOff)
 
 			// current read can'r read a whole k-v pair, reload buf
-			if len-kvReadOff-24-valueSize < 0 {
+			recordSize := fidx.format.recordSize(valueSize)
+			if len-kvReadOff-recordSize < 0 {
 				break
 			}
 
-			// valuePos is the absolute position of current value in the dataFile
-			valuePos = fReadOff + kvReadOff + 24
+			// a k-v pair with a wrong checksum is corrupt, but the following one is in place
+			if fidx.verifyChecksums && !fidx.format.verify(buf[kvReadOff:kvReadOff+recordSize]) {
+				if e := fidx.corruptAt(dfile, segment, pos, pos+recordSize, "checksum mismatch"); e != nil {
+					return 0, 0, fmt.Errorf("Build index : %s", e)
+				}
+				kvReadOff += recordSize
+				continue
+			}
+
+			// valuePos is the absolute position of current value in the dataFile,
+			// together with the segment it belongs to
+			valuePos = packValuePos(segment, pos+24)
 
 			// shard by key and write indexShard
-			shard := key % int64(fidx.shardNum)
 			binary.BigEndian.PutUint64(valuePosByte, uint64(valuePos))
-			fidx.shards[shard].Write(keyByte, valueSizeByte, valuePosByte)
+			if e := fidx.write(key, keyByte, valueSizeByte, valuePosByte); e != nil {
+				return 0, 0, e
+			}
 
 			// keep going kvRead
-			kvReadOff += 24 + valueSize
+			kvReadOff += recordSize
+			records++
+		}
+
+		// the k-v pair is larger than buf, grow buf to read it
+		if kvReadOff == 0 {
+			grown := 2*int64(cap(buf)) + 24
+			if e := fidx.pool.reserve(grown - int64(cap(buf))); e != nil {
+				return 0, 0, fmt.Errorf("Build index : k-v pair at %d: %s", fReadOff, e)
+			}
+			reserved += grown - int64(cap(buf))
+			buf = make([]byte, grown)
 		}
 
 		fReadOff += kvReadOff
+		reporter.scanned(parsed+fReadOff, records)
 	}
 
-	// write every indexShard's remain data
-	for _, idxShard := range fidx.shards {
-		idxShard.writeCompletely()
-		idxShard.sort()
-		idxShard.file.Close()
+	return parsed + fReadOff, records, nil
+}
+
+// write shards an index item by key and writes it into the indexShard
+func (fidx *FastIndex) write(key int64, keyByte []byte, valueSizeByte []byte, valuePosByte []byte) error {
+	shard := fidx.sharder.Shard(key, fidx.shardNum)
+	if shard < 0 || shard >= len(fidx.shards) {
+		return fmt.Errorf("key %d is sharded into %d, out of %d shards", key, shard, len(fidx.shards))
 	}
+	return fidx.shards[shard].Write(keyByte, valueSizeByte, valuePosByte)
+}
+
+// finish writes every indexShard's remain data, then sorts and closes them, they're
+// closed even if it fails
+func (fidx *FastIndex) finish(reporter *progressReporter) error {
+	defer fidx.closeShards()
+
+	reporter.phase(PhaseFlush)
+	for i, idxShard := range fidx.shards {
+		if e := idxShard.writeCompletely(); e != nil {
+			return e
+		}
+		reporter.shardDone(i + 1)
+	}
+
+	fidx.pool.release()
+	reporter.phase(PhaseSort)
+	for i, idxShard := range fidx.shards {
+		if e := idxShard.sort(); e != nil {
+			return e
+		}
+		reporter.shardDone(i + 1)
+	}
+	return nil
 }
 
 func (fidx *FastIndex) readKV(buf []byte, readOff int64) ([]byte, int64, []byte, int64) {
@@ -193,99 +427,178 @@ func (fidx *FastIndex) readKV(buf []byte, readOff int64) ([]byte, int64, []byte,
 
 	valueSizeByte := buf[readOff : readOff+8]
 	valueSize := int64(binary.BigEndian.Uint64(valueSizeByte))
-	readOff += 8 + valueSize
+	readOff += 8 + valueLength(valueSize)
 
 	return keyByte, key, valueSizeByte, valueSize
 }
 
-// FindLoop query indexShard and returns the valuePos of the key, or empty []byte if key not exists
+// Find query indexShard and returns the valueSize and the valuePos of the key, or -1 as
+// valueSize if key not exists or it's deleted. Use unpackValuePos to get the segment and offset of valuePos.
+// A closed FastIndex finds nothing.
 func (fidx *FastIndex) Find(key int64) (int64, int64) {
-	shard := key % int64(fidx.shardNum)
+	shard := fidx.sharder.Shard(key, fidx.shardNum)
+
+	// a newer generation shadows the older ones and the base index, even with a tombstone
+	fidx.genMu.RLock()
+	defer fidx.genMu.RUnlock()
+	if fidx.closed {
+		return -1, 0
+	}
+	for i := len(fidx.gens) - 1; i >= 0; i-- {
+		if vsize, vpos, ok := fidx.gens[i].shards[shard].find(key); ok {
+			return vsize, vpos
+		}
+	}
 	return fidx.shards[shard].Find(key)
 }
 
-func (idx *IndexShard) Write(key []byte, valueSize []byte, valuePos []byte) {
-	idx.buf.Write(key)
-	idx.buf.Write(valueSize)
-	idx.buf.Write(valuePos)
-
-	len := idx.buf.Len()
-	if len >= idx.writeBufSize {
-		if _, e := idx.buf.WriteTo(idx.file); e != nil {
-			fmt.Errorf("write to index_%d error", idx.shard)
+// Write buffers an index item, and writes the buffered ones into the index file when
+// they're full
+func (idx *IndexShard) Write(key []byte, valueSize []byte, valuePos []byte) error {
+	// take a new block when the last one is full, it could flush this shard
+	last := len(idx.blocks) - 1
+	if last < 0 || len(idx.blocks[last])+fixIndexItemSize > cap(idx.blocks[last]) {
+		block, e := idx.pool.get()
+		if e != nil {
+			return e
 		}
-		idx.totalSize += int64(len)
+		idx.blocks = append(idx.blocks, block)
+		last = len(idx.blocks) - 1
 	}
+
+	block := idx.blocks[last]
+	block = append(block, key...)
+	block = append(block, valueSize...)
+	block = append(block, valuePos...)
+	idx.blocks[last] = block
+	idx.buffered += fixIndexItemSize
+
+	if idx.buffered >= idx.writeBufSize {
+		return idx.flush()
+	}
+	return nil
 }
 
-func (idx *IndexShard) writeCompletely() {
-	len := idx.buf.Len()
-	if len > 0 {
-		if _, e := idx.buf.WriteTo(idx.file); e != nil {
-			fmt.Errorf("write to index_%d error", idx.shard)
+// flush writes the buffered index items into the index file and gives the blocks back
+// once all are written, a block which fails to write is still held by the indexShard
+func (idx *IndexShard) flush() error {
+	for _, block := range idx.blocks {
+		if _, e := idx.file.Write(block); e != nil {
+			return fmt.Errorf("write to index_%d error: %s", idx.shard, e)
 		}
-		idx.totalSize += int64(len)
 	}
+	for _, block := range idx.blocks {
+		idx.pool.put(block)
+	}
+
+	idx.totalSize += int64(idx.buffered)
+	idx.blocks = idx.blocks[:0]
+	idx.buffered = 0
+	return nil
+}
+
+func (idx *IndexShard) writeCompletely() error {
+	if idx.buffered > 0 {
+		return idx.flush()
+	}
+	return nil
 }
 
-// sort sorts small indexShard file, with O(N*logN)
-func (idx *IndexShard) sort() {
-	//buf = buf[:]
+// sort sorts the indexShard file in place, with O(N*logN). A file larger than the budget
+// of the pool is sorted in runs of the budget, which are merged after.
+func (idx *IndexShard) sort() error {
 	fInfo, e := idx.file.Stat()
 	if e != nil {
-		fmt.Errorf("get file info error")
+		return fmt.Errorf("sort index_%d error: %s", idx.shard, e)
 	}
 
 	size := fInfo.Size()
+	if runSize := idx.pool.runSize(); runSize > 0 && size > runSize {
+		return idx.sortRuns(size, runSize)
+	}
 	buf := make([]byte, size)
 
-	cnt, e := idx.file.ReadAt(buf, 0)
-	if e != nil {
-		fmt.Println("error when read index file, cnt:", cnt, ", e:", e)
-		return
+	if _, e := idx.file.ReadAt(buf, 0); e != nil && e != io.EOF {
+		return fmt.Errorf("sort index_%d error: %s", idx.shard, e)
 	}
 
-	// sort indexShard
-	itemNum := size / fixIndexItemSize
-	idx.items = make(items, itemNum)
-	var i int64 = 0
-	var offset int64 = 0
-	for ; i < itemNum; i++ {
-		offset = fixIndexItemSize * i
-		idx.items[i] = convertByteToItem(buf[offset : offset+fixIndexItemSize])
+	// sort indexShard, and write it back
+	sort.Sort(itemBytes(buf[:size-size%fixIndexItemSize]))
+	if n, e := idx.file.WriteAt(buf, 0); e != nil {
+		return fmt.Errorf("writeBack index_%d error:%s, writed n:%d", idx.shard, e, n)
 	}
-	sort.Sort(idx.items)
+	return nil
+}
 
-	// write back sorted indexShard
-	idx.writeBack(buf)
+// sortRuns sorts the runs of runSize in the indexShard file of size in place, one at a
+// time, and merges them
+func (idx *IndexShard) sortRuns(size int64, runSize int64) error {
+	size -= size % fixIndexItemSize
+	buf := make([]byte, runSize)
+	runs := make([]int64, 0, size/runSize+1)
+	for start := int64(0); start < size; start += runSize {
+		run := buf
+		if start+runSize > size {
+			run = buf[:size-start]
+		}
+		if _, e := idx.file.ReadAt(run, start); e != nil && e != io.EOF {
+			return fmt.Errorf("sort index_%d error: %s", idx.shard, e)
+		}
+		sort.Sort(itemBytes(run))
+		if n, e := idx.file.WriteAt(run, start); e != nil {
+			return fmt.Errorf("writeBack index_%d error:%s, writed n:%d", idx.shard, e, n)
+		}
+		runs = append(runs, start)
+	}
+
+	return idx.merge(runs)
 }
 
-type items []*indexItem
-type indexItem struct {
-	key  int64
-	vsz  int64
-	vpos int64
+// lessItem orders index items by key and then by value_position
+func lessItem(x []byte, y []byte) bool {
+	kx := int64(binary.BigEndian.Uint64(x[0:8]))
+	ky := int64(binary.BigEndian.Uint64(y[0:8]))
+	if kx != ky {
+		return kx < ky
+	}
+	px := int64(binary.BigEndian.Uint64(x[16:24]))
+	py := int64(binary.BigEndian.Uint64(y[16:24]))
+	return px < py
 }
 
+// itemBytes sorts index items in their encoded form, by key and then by value_position,
+// so the k-v pairs of the same key are in the order they were written
+type itemBytes []byte
+
 // Len is the number of elements in the collection.
-func (items items) Len() int {
-	return len(items)
+func (b itemBytes) Len() int {
+	return len(b) / fixIndexItemSize
 }
 
 // Less reports whether the element with
 // index i should sort before the element with index j.
-func (items items) Less(i, j int) bool {
-	return items[i].key <= items[j].key
+func (b itemBytes) Less(i, j int) bool {
+	return lessItem(b[i*fixIndexItemSize:], b[j*fixIndexItemSize:])
 }
 
 // Swap swaps the elements with indexes i and j.
-func (items items) Swap(i, j int) {
-	items[i], items[j] = items[j], items[i]
+func (b itemBytes) Swap(i, j int) {
+	var tmp [fixIndexItemSize]byte
+	x := b[i*fixIndexItemSize : (i+1)*fixIndexItemSize]
+	y := b[j*fixIndexItemSize : (j+1)*fixIndexItemSize]
+	copy(tmp[:], x)
+	copy(x, y)
+	copy(y, tmp[:])
+}
+
+type indexItem struct {
+	key  int64
+	vsz  int64
+	vpos int64
 }
 
 func convertByteToItem(buf []byte) *indexItem {
 	if len(buf) != 24 {
-		fmt.Errorf("invalid data size:%d, expected 24", len(buf))
 		return nil
 	}
 
@@ -302,62 +615,72 @@ func convertByteToItem(buf []byte) *indexItem {
 	return item
 }
 
-func (idx *IndexShard) writeBack(buf []byte) {
-	var offset int64 = 0
-	_buf := make([]byte, 8)
-	for _, item := range idx.items {
-		binary.BigEndian.PutUint64(_buf, uint64(item.key))
-		copy(buf[offset:], _buf)
-
-		offset += 8
-		binary.BigEndian.PutUint64(_buf, uint64(item.vsz))
-		copy(buf[offset:], _buf)
-
-		offset += 8
-		binary.BigEndian.PutUint64(_buf, uint64(item.vpos))
-		copy(buf[offset:], _buf)
+// Close unmaps and closes the index files of the FastIndex and its generations, after the
+// finding goroutines are done. It returns ErrClosed if it's closed already.
+func (fidx *FastIndex) Close() error {
+	fidx.genMu.Lock()
+	defer fidx.genMu.Unlock()
+	if fidx.closed {
+		return ErrClosed
+	}
+	fidx.closed = true
 
-		offset += 8
+	var err error
+	for _, gen := range fidx.gens {
+		if e := gen.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
+	fidx.gens = nil
 
-	if n, e := idx.file.WriteAt(buf, 0); e != nil {
-		fmt.Printf("writeBack indexShard error:%s, writed n:%d", e, n)
+	for _, idx := range fidx.shards {
+		if len(idx.dataRef) > 0 {
+			if e := syscall.Munmap(idx.dataRef); e != nil && err == nil {
+				err = e
+			}
+			idx.dataRef = nil
+		}
+		if e := idx.file.Close(); e != nil && err == nil {
+			err = e
+		}
 	}
+	return err
 }
 
 // Find using mmap to reduce concern of memory's alloc and free
 func (idx *IndexShard) Find(key int64) (int64, int64) {
-	// init mmap
-	if len(idx.dataRef) == 0 {
-		b, err := syscall.Mmap(int(idx.file.Fd()), 0, int(idx.fileSize), syscall.PROT_READ, syscall.MAP_SHARED)
-
-		if err != nil {
-			// todo
-		}
-
-		idx.dataRef = b
+	vsize, vpos, ok := idx.find(key)
+	if !ok {
+		return -1, 0
+	}
+	return vsize, vpos
+}
 
-		// Advise the kernel that the mmap is accessed randomly.
-		if err := madvise(b, syscall.MADV_RANDOM); err != nil {
-			fmt.Errorf("madvise: %s", err)
-		}
+// find returns the latest item of key, and whether it's in the indexShard. The valueSize
+// of a deleted key is tombstoneValueSize.
+func (idx *IndexShard) find(key int64) (int64, int64, bool) {
+	// it's mapped when opened, an empty indexShard has nothing to map
+	if len(idx.dataRef) == 0 {
+		return -1, 0, false
 	}
 
 	_buf := make([]byte, 8)
 	binary.BigEndian.PutUint64(_buf, uint64(key))
 
-	// binary search with time complex as O(logN)
-	index := sort.Search(len(idx.dataRef)/24, func(i int) bool {
+	// binary search with time complex as O(logN), the items of the same key are in
+	// the order they were written, so the last one is the latest
+	itemNum := len(idx.dataRef) / 24
+	index := sort.Search(itemNum, func(i int) bool {
 		result := bytes.Compare(idx.dataRef[i*24:i*24+8], _buf)
-		return result != -1
-	})
-	if index <= 0 {
-		return -1, 0
+		return result == 1
+	}) - 1
+	if index < 0 || !bytes.Equal(idx.dataRef[index*24:index*24+8], _buf) {
+		return -1, 0, false
 	}
 
 	// convert vsize, vpos from []byte to int64
 	offset := index * 24
 	vsize := int64(binary.BigEndian.Uint64(idx.dataRef[offset+8 : offset+16]))
 	vpos := int64(binary.BigEndian.Uint64(idx.dataRef[offset+16 : offset+24]))
-	return vsize, vpos
+	return vsize, vpos, true
 }
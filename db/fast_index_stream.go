@@ -0,0 +1,148 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// BuildFromReader builds a FastIndex from a stream of k-v pairs, such as stdin, a pipe
+// or a decompressor. The k-v pairs are copied into a new data file at dataPath while
+// they are indexed, so the data is ingested in a single pass. The index files are closed
+// even if it fails.
+func (fidx *FastIndex) BuildFromReader(r io.Reader, dataPath string, readBufSize int) error {
+	defer fidx.closeShards()
+
+	if e := createDirIfNotExist(filepath.Dir(dataPath)); e != nil {
+		return e
+	}
+	dfile, e := os.Create(dataPath)
+	if e != nil {
+		return e
+	}
+	defer dfile.Close()
+
+	if readBufSize <= 0 {
+		readBufSize = int(MB)
+	}
+	// the reader and the writer both have a buffer of readBufSize
+	readBufSize = fidx.budgetReadBuf(2*readBufSize) / 2
+	if readBufSize < int(KB) {
+		readBufSize = int(KB)
+	}
+	reader := bufio.NewReaderSize(r, readBufSize)
+	writer := bufio.NewWriterSize(dfile, readBufSize)
+	reporter := newProgressReporter(fidx.progress, 0, fidx.shardNum)
+	fidx.corrupted = nil
+	defer fidx.closeQuarantine()
+
+	var offset int64 = 0
+	var lastReport int64 = 0
+	var records int64 = 0
+	kv := make([]byte, 24)
+	valuePosByte := make([]byte, 8)
+	trailer := make([]byte, checksumSize)
+
+	// the file header of a v2 stream is copied as it is
+	fidx.format = formatV1
+	if magic, _ := reader.Peek(len(dataFileMagic)); string(magic) == dataFileMagic {
+		header, _ := reader.Peek(dataFileHeaderSize)
+		if size := headerSizeOf(header); size > dataFileHeaderSize && size <= maxHeaderSize {
+			header, _ = reader.Peek(int(size))
+		}
+		if fidx.format, e = parseDataFormat(header); e != nil {
+			return e
+		}
+		// the block index is at the end of a data file with blocks
+		if fidx.format.blocked() {
+			return fmt.Errorf("data file with compressed blocks can't be ingested from a stream")
+		}
+		if _, e := io.CopyN(writer, reader, fidx.format.headerSize); e != nil {
+			return fmt.Errorf("read data file header: %s", e)
+		}
+		offset = fidx.format.headerSize
+	}
+
+	for {
+		// a clean EOF before a k-v pair means the stream is finished
+		header, e := reader.Peek(24)
+		if len(header) == 0 && e == io.EOF {
+			break
+		} else if e != nil && e != io.EOF {
+			return fmt.Errorf("read k-v pair at offset %d: %s", offset, e)
+		}
+
+		// skip the corrupt k-v pair to the next plausible one, the skipped bytes are
+		// copied into the data file as well, so the offsets are the same as the stream's
+		if reason := fidx.checkHeader(header, offset, -1); reason != "" {
+			skipped, e := fidx.skipStream(reader, writer, offset, reason)
+			if e != nil {
+				return e
+			}
+			offset += skipped
+			continue
+		}
+		copy(kv, header)
+		key := int64(binary.BigEndian.Uint64(kv[8:16]))
+		valueSize := int64(binary.BigEndian.Uint64(kv[16:24]))
+
+		// copy the k-v pair into the data file, and its checksum
+		checksum := crc32.New(crc32c)
+		n, e := io.CopyN(io.MultiWriter(writer, checksum), reader, 24+valueLength(valueSize))
+		if e == nil && fidx.format.checksummed() {
+			var m int
+			m, e = io.ReadFull(reader, trailer)
+			if e == io.ErrUnexpectedEOF {
+				e = io.EOF
+			}
+			writer.Write(trailer[:m])
+			n += int64(m)
+		}
+		if e == io.EOF {
+			// the stream ends in the middle of the last k-v pair
+			if e := writer.Flush(); e != nil {
+				return e
+			}
+			if e := fidx.corruptAt(dfile, 0, offset, offset+n, "truncated record"); e != nil {
+				return e
+			}
+			offset += n
+			break
+		} else if e != nil {
+			return fmt.Errorf("read k-v pair at offset %d: %s", offset, e)
+		}
+
+		recordSize := fidx.format.recordSize(valueSize)
+		if fidx.verifyChecksums && fidx.format.checksummed() && checksum.Sum32() != binary.BigEndian.Uint32(trailer) {
+			// the k-v pair is in the data file, but it's not indexed
+			record := CorruptRecord{Offset: offset, Length: recordSize, Reason: "checksum mismatch"}
+			if e := fidx.corrupt(record, nil); e != nil {
+				return e
+			}
+			offset += recordSize
+			continue
+		}
+
+		binary.BigEndian.PutUint64(valuePosByte, uint64(offset+24))
+		if e := fidx.write(key, kv[8:16], kv[16:24], valuePosByte); e != nil {
+			return e
+		}
+
+		offset += recordSize
+		records++
+		if offset-lastReport >= int64(readBufSize) {
+			reporter.scanned(offset, records)
+			lastReport = offset
+		}
+	}
+	reporter.scanned(offset, records)
+
+	if e := writer.Flush(); e != nil {
+		return e
+	}
+	return fidx.finish(reporter)
+}
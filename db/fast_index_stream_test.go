@@ -0,0 +1,82 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strconv"
+	"testing"
+)
+
+func Test_fast_index_build_from_reader(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	dataPath := dir + "/data/data.d"
+	gen := &DataFileGen{
+		maxKey:         1 << 20,
+		maxValueLength: 64,
+		writeBufSize:   int(4 * KB),
+		maxSize:        128 * KB,
+		path:           dataPath,
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+	data, e := ioutil.ReadFile(dataPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	// index the same data from a file and from a stream
+	buildTestIndex(t, dir+"/index", 4, dataPath, int(16*KB))
+	streamPath := dir + "/stream/data.d"
+	fidx := newTestIndex(t, dir+"/stream_index", 4)
+	if e := fidx.BuildFromReader(bytes.NewReader(data), streamPath, int(KB)); e != nil {
+		t.Fatal(e)
+	}
+
+	copied, e := ioutil.ReadFile(streamPath)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !bytes.Equal(copied, data) {
+		t.Fatalf("copied data file differs, size %d, expected %d", len(copied), len(data))
+	}
+
+	for i := 0; i < 4; i++ {
+		name := "/index_" + strconv.Itoa(i) + ".idx"
+		expected, _ := ioutil.ReadFile(dir + "/index" + name)
+		idx, _ := ioutil.ReadFile(dir + "/stream_index" + name)
+		if len(expected) == 0 || !bytes.Equal(idx, expected) {
+			t.Fatalf("index shard %d differs from Build", i)
+		}
+	}
+}
+
+func Test_fast_index_build_from_truncated_reader(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	buf := bytes.NewBuffer([]byte{})
+	gen := &DataFileGen{maxKey: 1 << 20, maxValueLength: 64}
+	sampler, e := newSampler(gen.dist, gen.maxKey, gen.maxValueLength)
+	if e != nil {
+		t.Fatal(e)
+	}
+	gen.sampler = sampler
+	for i := 0; i < 10; i++ {
+		gen.fillBuf(buf)
+	}
+
+	data := buf.Bytes()[:buf.Len()-1]
+	fidx := newTestIndex(t, dir+"/index", 4)
+	if e := fidx.BuildFromReader(bytes.NewReader(data), dir+"/data/data.d", 0); e == nil {
+		t.Fatal("expected an error for a truncated stream")
+	}
+	// the index files are closed on failure
+	for i, idx := range fidx.shards {
+		if e := idx.file.Close(); e == nil {
+			t.Errorf("index_%d is still open", i)
+		}
+	}
+}
@@ -12,10 +12,38 @@ import (
 const indexDir = "/Users/Cuber_Q/goproj/fastindex/index"
 const dataFilePath = "/Users/Cuber_Q/goproj/fastindex/data/data.d"
 
+// newTestIndex creates a FastIndex in dir to build
+func newTestIndex(t *testing.T, dir string, shardNum int) *FastIndex {
+	fidx, e := NewFastIndex(dir, shardNum)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return fidx
+}
+
+// openTestIndex opens the FastIndex built in dir
+func openTestIndex(t *testing.T, dir string, shardNum int) *FastIndex {
+	fidx, e := OpenFastIndex(dir, shardNum)
+	if e != nil {
+		t.Fatal(e)
+	}
+	return fidx
+}
+
+// buildTestIndex builds the FastIndex of dataPath in dir
+func buildTestIndex(t *testing.T, dir string, shardNum int, dataPath string, readBufSize int) {
+	if e := newTestIndex(t, dir, shardNum).Build(dataPath, readBufSize); e != nil {
+		t.Fatal(e)
+	}
+}
+
 func Test_index_shard_create(t *testing.T) {
 	testBuf := make([]byte, 8)
 	for i := 0; i < 1000; i++ {
-		idx := NewIndexShard(indexDir, i)
+		idx, e := NewIndexShard(indexDir, i)
+		if e != nil {
+			t.Fatal(e)
+		}
 		for j := 0; j < 1024*1024; j++ {
 			idx.Write(testBuf, testBuf, testBuf)
 		}
@@ -24,7 +52,7 @@ func Test_index_shard_create(t *testing.T) {
 
 func Test_fast_index_create(t *testing.T) {
 	shardNum := 1000
-	fidx := NewFastIndex(indexDir, shardNum)
+	fidx := newTestIndex(t, indexDir, shardNum)
 	wg := sync.WaitGroup{}
 	wg.Add(shardNum)
 	for i := 0; i < shardNum; i++ {
@@ -66,7 +94,10 @@ func Test_index_shard_sort(t *testing.T) {
 
 func oneShard(shard int, key int64) {
 	_buf := make([]byte, 8)
-	idx := NewIndexShard(indexDir, shard)
+	idx, e := NewIndexShard(indexDir, shard)
+	if e != nil {
+		panic(e)
+	}
 	for j := 0; j < 1024*1024; j++ {
 		key = rand.Int63n(1 << 31)
 		binary.BigEndian.PutUint64(_buf, uint64(key))
@@ -78,12 +109,14 @@ func oneShard(shard int, key int64) {
 }
 
 func Test_fast_index_build(t *testing.T) {
-	fidx := NewFastIndex(indexDir, 10)
-	fidx.Build(dataFilePath, 0)
+	fidx := newTestIndex(t, indexDir, 10)
+	if e := fidx.Build(dataFilePath, 0); e != nil {
+		t.Fatal(e)
+	}
 }
 
 func Test_fast_index_random_find(t *testing.T) {
-	fidx := OpenFastIndex(indexDir, 10)
+	fidx := openTestIndex(t, indexDir, 10)
 	failCnt := 0
 	for i := 0; i < 100; i++ {
 		key := rand.Int63n(1 << 30)
@@ -97,7 +130,7 @@ func Test_fast_index_random_find(t *testing.T) {
 }
 
 func Test_fast_index_point_find(t *testing.T) {
-	fidx := OpenFastIndex(indexDir, 1024)
+	fidx := openTestIndex(t, indexDir, 1024)
 	keys := []int64{134020434, 164029137, 957743134, 958990240}
 	dataF, _ := os.Open(dataFilePath)
 
@@ -123,7 +156,7 @@ func Test_fast_index_point_find(t *testing.T) {
 }
 
 func Test_print_index_shard(t *testing.T) {
-	fidx := OpenFastIndex(indexDir, 10)
+	fidx := openTestIndex(t, indexDir, 10)
 	// init dataref
 	fidx.shards[0].Find(1210)
 
@@ -148,3 +181,89 @@ func Test_print_index_shard(t *testing.T) {
 		fmt.Println()
 	}
 }
+
+func Test_fast_index_close(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	buildTestIndex(t, dir+"/index", 4, dir+"/data/data.d", int(KB))
+	fidx := openTestIndex(t, dir+"/index", 4)
+
+	// the shards are mapped once by the concurrent finds
+	wg := sync.WaitGroup{}
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if vsize, _ := fidx.Find(2); vsize != 2 {
+				t.Errorf("vsize:%d, expected 2", vsize)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if e := fidx.Close(); e != nil {
+		t.Fatal(e)
+	}
+	if vsize, _ := fidx.Find(2); vsize != -1 {
+		t.Errorf("vsize:%d, expected nothing found after Close", vsize)
+	}
+	if e := fidx.Close(); e != ErrClosed {
+		t.Errorf("e:%v, expected ErrClosed closing twice", e)
+	}
+}
+
+func Test_fast_index_open_error(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	if _, e := OpenFastIndex(dir+"/index", 4); e == nil {
+		t.Error("expected an error opening a missing index")
+	}
+	if e := newTestIndex(t, dir+"/index", 4).Build(dir+"/data/data.d", int(KB)); e == nil {
+		t.Error("expected an error building from a missing data file")
+	}
+
+	// the index dir can't be created under a file
+	writeRecords(t, dir+"/data/data.d", []int64{1}, []string{"a"})
+	if _, e := NewFastIndex(dir+"/data/data.d/index", 4); e == nil {
+		t.Error("expected an error creating an index under a file")
+	}
+
+	// a shard which can't be mapped fails opening, rather than finding nothing in it
+	buildTestIndex(t, dir+"/index", 4, dir+"/data/data.d", int(KB))
+	os.Remove(dir + "/index/index_1.idx")
+	if e := os.Mkdir(dir+"/index/index_1.idx", 0755); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := OpenFastIndex(dir+"/index", 4); e == nil {
+		t.Error("expected an error opening an index shard which can't be mapped")
+	}
+	if _, e := Open(dir); e == nil {
+		t.Error("expected an error opening a db with an index shard which can't be mapped")
+	}
+}
+
+// outOfRangeSharder shards every key out of the shards
+type outOfRangeSharder struct{}
+
+func (outOfRangeSharder) Name() string {
+	return "out-of-range"
+}
+
+func (outOfRangeSharder) Shard(key int64, shardNum int) int {
+	return -1
+}
+
+func Test_fast_index_write_out_of_range(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2}, []string{"a", "bb"})
+	fidx := newTestIndex(t, dir+"/index", 4)
+	fidx.SetSharder(outOfRangeSharder{})
+	if e := fidx.Build(dir+"/data/data.d", int(KB)); e == nil {
+		t.Error("expected an error for a key sharded out of the shards")
+	}
+}
@@ -0,0 +1,261 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+)
+
+// When the memtable is full, it's flushed into a generation, which is an immutable
+// sorted index with the same shard layout as the base index, in index/gen_<id>/.
+// FastIndex.Find consults the generations newest-first before the base index. When
+// there are more than maxGenerations, they are merged into one in the background,
+// so the cost of a lookup stays bounded. The generations are listed in the manifest
+// in the order they were flushed.
+
+const (
+	// defaultMemtableSize is the size of index items in the memtable to flush
+	defaultMemtableSize = 4 * MB
+	maxGenerations      = 4
+)
+
+func generationDir(indexDir string, id int) string {
+	return filepath.Join(indexDir, fmt.Sprintf("gen_%06d", id))
+}
+
+// removeGenerations removes every generation in indexDir, they are stale once the base
+// index is rebuilt
+func removeGenerations(indexDir string) {
+	dirs, _ := filepath.Glob(filepath.Join(indexDir, "gen_*"))
+	for _, dir := range dirs {
+		os.RemoveAll(dir)
+	}
+}
+
+// openGeneration opens a generation, it's mapped into memory by OpenFastIndex before it's
+// swapped in while other goroutines are finding
+func openGeneration(dir string, shardNum int, sharder Sharder) (*FastIndex, error) {
+	gen, e := OpenFastIndex(dir, shardNum)
+	if e != nil {
+		return nil, e
+	}
+	gen.SetSharder(sharder)
+	return gen, nil
+}
+
+// buildGeneration writes items into a new generation in dir with the same shard layout as fidx
+func (fidx *FastIndex) buildGeneration(dir string, items []indexItem) (*FastIndex, error) {
+	gen, e := NewFastIndex(dir, fidx.shardNum)
+	if e != nil {
+		return nil, e
+	}
+	gen.SetSharder(fidx.sharder)
+
+	buf := make([]byte, fixIndexItemSize)
+	for _, item := range items {
+		binary.BigEndian.PutUint64(buf[0:8], uint64(item.key))
+		binary.BigEndian.PutUint64(buf[8:16], uint64(item.vsz))
+		binary.BigEndian.PutUint64(buf[16:24], uint64(item.vpos))
+		if e := gen.write(item.key, buf[0:8], buf[8:16], buf[16:24]); e != nil {
+			gen.closeShards()
+			return nil, e
+		}
+	}
+	if e := gen.finish(newProgressReporter(nil, 0, fidx.shardNum)); e != nil {
+		return nil, e
+	}
+
+	return openGeneration(dir, fidx.shardNum, fidx.sharder)
+}
+
+// mergeGenerations merges gens into a new generation in dir, the newer generation wins
+// if a key is in many of them
+func (fidx *FastIndex) mergeGenerations(gens []*FastIndex, dir string) (*FastIndex, error) {
+	latest := make(map[int64]indexItem)
+	for _, gen := range gens {
+		for _, idx := range gen.shards {
+			for off := 0; off+fixIndexItemSize <= len(idx.dataRef); off += fixIndexItemSize {
+				item := convertByteToItem(idx.dataRef[off : off+fixIndexItemSize])
+				latest[item.key] = *item
+			}
+		}
+	}
+
+	items := make([]indexItem, 0, len(latest))
+	for _, item := range latest {
+		items = append(items, item)
+	}
+	return fidx.buildGeneration(dir, items)
+}
+
+// generations returns the generations of fidx, newest last
+func (fidx *FastIndex) generations() []*FastIndex {
+	fidx.genMu.RLock()
+	defer fidx.genMu.RUnlock()
+	return append([]*FastIndex{}, fidx.gens...)
+}
+
+func (fidx *FastIndex) addGeneration(gen *FastIndex) {
+	fidx.genMu.Lock()
+	fidx.gens = append(fidx.gens, gen)
+	fidx.genMu.Unlock()
+}
+
+// replaceGenerations replaces the oldest n generations with merged, and returns them. It
+// waits for the finding goroutines, so the replaced ones could be closed after.
+func (fidx *FastIndex) replaceGenerations(n int, merged *FastIndex) []*FastIndex {
+	fidx.genMu.Lock()
+	defer fidx.genMu.Unlock()
+
+	replaced := fidx.gens[:n]
+	fidx.gens = append([]*FastIndex{merged}, fidx.gens[n:]...)
+	return replaced
+}
+
+// mmap maps the indexShard file into memory once, and returns the error of mapping it,
+// an empty one has nothing to map
+func (idx *IndexShard) mmap() error {
+	idx.mmapOnce.Do(func() {
+		if idx.fileSize == 0 {
+			return
+		}
+
+		b, err := syscall.Mmap(int(idx.file.Fd()), 0, int(idx.fileSize), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err != nil {
+			idx.mmapErr = fmt.Errorf("mmap %s error: %s", idx.fileName, err)
+			return
+		}
+		idx.dataRef = b
+
+		// Advise the kernel that the mmap is accessed randomly.
+		madvise(b, syscall.MADV_RANDOM)
+	})
+	return idx.mmapErr
+}
+
+// SetMemtableSize sets the size of index items in the memtable to flush it into a generation
+func (db *DB) SetMemtableSize(size int64) {
+	db.memtableSize = size
+}
+
+// flushMemtable flushes the memtable into a new generation, it's called with writeMu held
+func (db *DB) flushMemtable() error {
+	items := db.memtable.snapshot()
+	if len(items) == 0 {
+		return nil
+	}
+
+	db.manifestMu.Lock()
+	defer db.manifestMu.Unlock()
+
+	id := db.nextGen
+	db.nextGen++
+	dir := generationDir(db.indexFileDir, id)
+	gen, e := db.fidx.buildGeneration(dir, items)
+	if e != nil {
+		os.RemoveAll(dir)
+		return e
+	}
+
+	// the k-v pairs up to writeOff are indexed by the generations now
+	m := *db.m
+	m.Generations = append(append([]int{}, db.m.Generations...), id)
+	m.Sizes = make([]int64, len(db.dataFiles))
+	for i, df := range db.dataFiles {
+		if i == len(db.dataFiles)-1 {
+			m.Sizes[i] = db.writeOff
+		} else if info, e := df.Stat(); e == nil {
+			m.Sizes[i] = info.Size()
+		}
+	}
+	if e := db.publish(&m); e != nil {
+		gen.Close()
+		os.RemoveAll(dir)
+		return e
+	}
+
+	db.fidx.addGeneration(gen)
+	db.memtable.reset()
+
+	if len(m.Generations) > maxGenerations && !db.merging {
+		db.merging = true
+		db.mergeWG.Add(1)
+		go db.mergeGenerations()
+	}
+	return nil
+}
+
+// mergeGenerations merges the generations in the background, the ones flushed during
+// the merge are kept after the merged one
+func (db *DB) mergeGenerations() {
+	defer db.mergeWG.Done()
+
+	db.manifestMu.Lock()
+	ids := append([]int{}, db.m.Generations...)
+	gens := db.fidx.generations()
+	id := db.nextGen
+	db.nextGen++
+	db.manifestMu.Unlock()
+
+	dir := generationDir(db.indexFileDir, id)
+	// the generations failed to merge are merged again after the next flush
+	merged, e := db.fidx.mergeGenerations(gens, dir)
+	if e != nil {
+		db.manifestMu.Lock()
+		db.merging = false
+		db.manifestMu.Unlock()
+		os.RemoveAll(dir)
+		return
+	}
+
+	db.manifestMu.Lock()
+	m := *db.m
+	m.Generations = append([]int{id}, db.m.Generations[len(ids):]...)
+	if e := db.publish(&m); e != nil {
+		db.merging = false
+		db.manifestMu.Unlock()
+		merged.Close()
+		os.RemoveAll(dir)
+		return
+	}
+	replaced := db.fidx.replaceGenerations(len(ids), merged)
+	db.merging = false
+	db.manifestMu.Unlock()
+
+	for i, gen := range replaced {
+		gen.Close()
+		os.RemoveAll(generationDir(db.indexFileDir, ids[i]))
+	}
+}
+
+// publish writes the manifest of the snapshot, it's called with manifestMu held
+func (db *DB) publish(m *manifest) error {
+	if e := m.write(db.indexFileDir); e != nil {
+		return e
+	}
+	db.m = m
+	db.published, _ = os.Stat(filepath.Join(db.indexFileDir, manifestFileName))
+	return nil
+}
+
+// openGenerations opens the generations listed in the manifest into fidx
+func (db *DB) openGenerations(fidx *FastIndex, m *manifest) error {
+	ids := append([]int{}, m.Generations...)
+	for _, id := range ids {
+		gen, e := openGeneration(generationDir(db.indexFileDir, id), db.indexShardNum, db.sharder)
+		if e != nil {
+			return e
+		}
+		fidx.addGeneration(gen)
+	}
+
+	sort.Ints(ids)
+	db.nextGen = 1
+	if len(ids) > 0 {
+		db.nextGen = ids[len(ids)-1] + 1
+	}
+	return nil
+}
@@ -0,0 +1,135 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func Test_db_flush_memtable(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	db.SetMemtableSize(2 * fixIndexItemSize)
+
+	expected := map[int64]string{1: "a", 2: "bb", 3: "ccc"}
+	if e := db.Put(2, []byte("new bb")); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Put(4, []byte("dddd")); e != nil {
+		t.Fatal(e)
+	}
+	expected[2], expected[4] = "new bb", "dddd"
+
+	if db.memtable.len() != 0 {
+		t.Errorf("%d items in memtable, expected 0 after flushing", db.memtable.len())
+	}
+	if len(db.m.Generations) != 1 {
+		t.Fatalf("generations:%v, expected 1", db.m.Generations)
+	}
+	if _, e := os.Stat(generationDir(db.indexFileDir, db.m.Generations[0])); e != nil {
+		t.Error(e)
+	}
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+
+	// the generations are opened from the manifest, nothing is replayed
+	db.Close()
+	db = OpenDB(dir)
+	db.InitFind()
+	if db.memtable.len() != 0 {
+		t.Errorf("%d k-v pairs replayed, expected 0", db.memtable.len())
+	}
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("reopened key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+
+	// a new index covers the generations
+	db.Close()
+	db = OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	if len(db.m.Generations) != 0 || len(db.fidx.generations()) != 0 {
+		t.Errorf("generations:%v, expected none", db.m.Generations)
+	}
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("rebuilt key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+}
+
+func Test_db_merge_generations(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1}, []string{"a"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	db.SetMemtableSize(2 * fixIndexItemSize)
+
+	// every key is written in several generations, the latest value wins
+	expected := map[int64]string{1: "a"}
+	for round := 0; round < 3; round++ {
+		for k := int64(0); k < 8; k++ {
+			v := fmt.Sprintf("v%d_%d", k, round)
+			if e := db.Put(k, []byte(v)); e != nil {
+				t.Fatal(e)
+			}
+			expected[k] = v
+		}
+	}
+	db.mergeWG.Wait()
+
+	if n := len(db.fidx.generations()); n > maxGenerations+1 {
+		t.Errorf("%d generations, expected them merged", n)
+	}
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+
+	// the merged generations are removed, and the manifest lists the remaining ones
+	db.Close()
+	db = OpenDB(dir)
+	db.InitFind()
+	gens, _ := listGenerationDirs(db.indexFileDir)
+	if len(gens) != len(db.m.Generations) {
+		t.Errorf("generation dirs:%v, expected %v", gens, db.m.Generations)
+	}
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("reopened key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+}
+
+func listGenerationDirs(indexDir string) ([]string, error) {
+	f, e := os.Open(indexDir)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	names, e := f.Readdirnames(-1)
+	gens := make([]string, 0)
+	for _, name := range names {
+		if len(name) > 4 && name[:4] == "gen_" {
+			gens = append(gens, name)
+		}
+	}
+	return gens, e
+}
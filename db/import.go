@@ -0,0 +1,328 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Import converts rows of CSV, TSV or JSON Lines into the data file, a row is a k-v pair
+// of its key column and value column. A key is parsed as an int64, or hashed from its
+// bytes by KeyOfBytes.
+
+const (
+	ImportCSV   = "csv"
+	ImportTSV   = "tsv"
+	ImportJSONL = "jsonl"
+
+	KeyInt64 = "int64"
+	KeyBytes = "bytes"
+)
+
+// ImportOptions is how rows are converted into k-v pairs
+type ImportOptions struct {
+	// Format is ImportCSV, ImportTSV or ImportJSONL
+	Format string
+	// Header means the first row of CSV or TSV is the column names
+	Header bool
+	// KeyColumn and ValueColumn are the column names or 0-based numbers of CSV or TSV, or
+	// the fields of JSON Lines. An empty ValueColumn of JSON Lines is the whole line.
+	KeyColumn   string
+	ValueColumn string
+	// KeyType is KeyInt64 or KeyBytes
+	KeyType string
+	// Index builds the index in the same pass
+	Index bool
+}
+
+// ImportStats is the result of Import
+type ImportStats struct {
+	Records int64
+	// Bytes is the size of the input
+	Bytes int64
+}
+
+// KeyOfBytes returns the key of a key of bytes, the FNV-64a hash of it in 63 bits
+func KeyOfBytes(b []byte) int64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return int64(h.Sum64() & (1<<63 - 1))
+}
+
+func parseKey(b []byte, keyType string) (int64, error) {
+	if keyType == KeyBytes {
+		return KeyOfBytes(b), nil
+	}
+	key, e := strconv.ParseInt(string(bytes.TrimSpace(b)), 10, 64)
+	if e != nil {
+		return 0, fmt.Errorf("invalid int64 key %q", b)
+	}
+	if key < 0 {
+		return 0, fmt.Errorf("invalid key %d, it must not be negative", key)
+	}
+	return key, nil
+}
+
+// rowReader reads the key and the value of the next row, it returns io.EOF at the end
+type rowReader interface {
+	next() ([]byte, []byte, error)
+	// row returns the number of the last row read, from 1
+	row() int
+}
+
+// Import replaces the data file with the k-v pairs converted from the rows read from r,
+// in the format set to db. The index is built along with it if opts.Index, otherwise
+// the old index is removed, and CreateIndex builds it later. They're written aside and
+// published once all rows are converted, so a row which can't be converted stops the
+// import with its row, and the dataset is kept as it was.
+func (db *DB) Import(r io.Reader, opts ImportOptions) (ImportStats, error) {
+	stats := ImportStats{}
+	if opts.KeyType == "" {
+		opts.KeyType = KeyInt64
+	}
+	if opts.KeyType != KeyInt64 && opts.KeyType != KeyBytes {
+		return stats, fmt.Errorf("unknown key type %s", opts.KeyType)
+	}
+	format, e := db.dataFormat()
+	if e != nil {
+		return stats, e
+	}
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	release, e := db.lockBuilder("import")
+	if e != nil {
+		return stats, e
+	}
+	defer release()
+	db.mergeWG.Wait()
+
+	counter := &countingReader{r: r}
+	rows, e := newRowReader(counter, opts)
+	if e != nil {
+		return stats, e
+	}
+
+	rw, e := db.newRewrite(format)
+	if e != nil {
+		return stats, e
+	}
+	w, fidx := rw.w, rw.fidx
+	if !opts.Index {
+		fidx = nil
+	}
+	reporter := newProgressReporter(db.buildProgress, 0, db.indexShardNum)
+
+	keyByte := make([]byte, 8)
+	valueSizeByte := make([]byte, 8)
+	valuePosByte := make([]byte, 8)
+	for {
+		keyField, value, e := rows.next()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			rw.abort()
+			return stats, e
+		}
+		key, e := parseKey(keyField, opts.KeyType)
+		if e != nil {
+			rw.abort()
+			return stats, fmt.Errorf("row %d: %s", rows.row(), e)
+		}
+		if int64(len(value)) > db.valueSizeLimit() {
+			rw.abort()
+			return stats, fmt.Errorf("row %d: value size %d exceeds the limit %d", rows.row(), len(value), db.valueSizeLimit())
+		}
+
+		stored, e := db.storedValue(format, value, 0)
+		if e != nil {
+			rw.abort()
+			return stats, e
+		}
+		segment, pos, e := w.writeRecord(format.encodeRecord(key, int64(len(stored)), stored))
+		if e != nil {
+			rw.abort()
+			return stats, e
+		}
+		if fidx != nil {
+			binary.BigEndian.PutUint64(keyByte, uint64(key))
+			binary.BigEndian.PutUint64(valueSizeByte, uint64(w.valueSize(int64(len(stored)))))
+			binary.BigEndian.PutUint64(valuePosByte, uint64(packValuePos(segment, pos)))
+			if e := fidx.write(key, keyByte, valueSizeByte, valuePosByte); e != nil {
+				rw.abort()
+				return stats, e
+			}
+		}
+		stats.Records++
+		if stats.Records%10000 == 0 {
+			reporter.scanned(counter.n, stats.Records)
+		}
+	}
+	stats.Bytes = counter.n
+	reporter.scanned(counter.n, stats.Records)
+	if fidx == nil {
+		return stats, rw.publishData()
+	}
+	return stats, rw.publish(reporter)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, e := c.r.Read(p)
+	c.n += int64(n)
+	return n, e
+}
+
+func newRowReader(r io.Reader, opts ImportOptions) (rowReader, error) {
+	switch opts.Format {
+	case ImportCSV, ImportTSV:
+		rows := &csvRows{}
+		if opts.Format == ImportCSV {
+			reader := csv.NewReader(bufio.NewReaderSize(r, int(MB)))
+			reader.FieldsPerRecord = -1
+			reader.ReuseRecord = true
+			rows.read = reader.Read
+		} else {
+			rows.read = tsvReader(bufio.NewReaderSize(r, int(MB)))
+		}
+		var header []string
+		if opts.Header {
+			first, e := rows.read()
+			if e != nil {
+				return nil, fmt.Errorf("read header: %s", e)
+			}
+			header = append([]string{}, first...)
+			rows.rows++
+		}
+		var e error
+		if rows.keyColumn, e = columnIndex(opts.KeyColumn, header); e != nil {
+			return nil, e
+		}
+		if rows.valueColumn, e = columnIndex(opts.ValueColumn, header); e != nil {
+			return nil, e
+		}
+		return rows, nil
+	case ImportJSONL:
+		if opts.KeyColumn == "" {
+			return nil, fmt.Errorf("key field of JSON Lines is required")
+		}
+		return &jsonRows{reader: bufio.NewReaderSize(r, int(MB)), keyField: opts.KeyColumn, valueField: opts.ValueColumn}, nil
+	}
+	return nil, fmt.Errorf("unknown import format %s", opts.Format)
+}
+
+// columnIndex returns the number of a column by its name in header or its number
+func columnIndex(column string, header []string) (int, error) {
+	for i, name := range header {
+		if name == column {
+			return i, nil
+		}
+	}
+	i, e := strconv.Atoi(column)
+	if e != nil || i < 0 {
+		return 0, fmt.Errorf("unknown column %q", column)
+	}
+	return i, nil
+}
+
+// tsvReader reads the lines of tab separated columns, which are never quoted
+func tsvReader(reader *bufio.Reader) func() ([]string, error) {
+	return func() ([]string, error) {
+		for {
+			line, e := reader.ReadString('\n')
+			if len(line) == 0 && e != nil {
+				return nil, e
+			}
+			// empty lines are skipped like CSV
+			if line = strings.TrimRight(line, "\r\n"); line != "" {
+				return strings.Split(line, "\t"), nil
+			}
+		}
+	}
+}
+
+// csvRows reads the rows of CSV or TSV
+type csvRows struct {
+	read        func() ([]string, error)
+	keyColumn   int
+	valueColumn int
+	rows        int
+}
+
+func (rows *csvRows) next() ([]byte, []byte, error) {
+	record, e := rows.read()
+	if e != nil {
+		return nil, nil, e
+	}
+	rows.rows++
+	if rows.keyColumn >= len(record) || rows.valueColumn >= len(record) {
+		return nil, nil, fmt.Errorf("row %d: %d columns, expected key column %d and value column %d",
+			rows.rows, len(record), rows.keyColumn, rows.valueColumn)
+	}
+	return []byte(record[rows.keyColumn]), []byte(record[rows.valueColumn]), nil
+}
+
+func (rows *csvRows) row() int {
+	return rows.rows
+}
+
+type jsonRows struct {
+	reader     *bufio.Reader
+	keyField   string
+	valueField string
+	line       int
+}
+
+func (rows *jsonRows) next() ([]byte, []byte, error) {
+	for {
+		text, e := rows.reader.ReadBytes('\n')
+		if len(text) == 0 && e != nil {
+			return nil, nil, e
+		}
+		rows.line++
+		text = bytes.TrimSpace(text)
+		if len(text) == 0 {
+			continue
+		}
+
+		fields := make(map[string]json.RawMessage)
+		if e := json.Unmarshal(text, &fields); e != nil {
+			return nil, nil, fmt.Errorf("row %d: %s", rows.line, e)
+		}
+		key, ok := fields[rows.keyField]
+		if !ok {
+			return nil, nil, fmt.Errorf("row %d: missing key field %q", rows.line, rows.keyField)
+		}
+		if rows.valueField == "" {
+			return jsonText(key), text, nil
+		}
+		value, ok := fields[rows.valueField]
+		if !ok {
+			return nil, nil, fmt.Errorf("row %d: missing value field %q", rows.line, rows.valueField)
+		}
+		return jsonText(key), jsonText(value), nil
+	}
+}
+
+func (rows *jsonRows) row() int {
+	return rows.line
+}
+
+// jsonText returns a JSON string as its text, and other JSON values as they are
+func jsonText(raw json.RawMessage) []byte {
+	var s string
+	if len(raw) > 0 && raw[0] == '"' && json.Unmarshal(raw, &s) == nil {
+		return []byte(s)
+	}
+	return raw
+}
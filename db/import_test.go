@@ -0,0 +1,99 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func Test_import(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	check := func(stage string, expected map[int64]string) {
+		db.InitFind()
+		for k, v := range expected {
+			if found, e := db.Get(k); e != nil || string(found) != v {
+				t.Errorf("%s key:%d, v:%s, e:%v, expected %s", stage, k, found, e, v)
+			}
+		}
+	}
+
+	// CSV with a header, indexed in the same pass
+	csv := "id,name,payload\n1,a,\"x,1\"\n2,b,y2\n1,c,new x\n"
+	stats, e := db.Import(strings.NewReader(csv), ImportOptions{Format: ImportCSV, Header: true,
+		KeyColumn: "id", ValueColumn: "payload", Index: true})
+	if e != nil {
+		t.Fatal(e)
+	}
+	if stats.Records != 3 || stats.Bytes != int64(len(csv)) {
+		t.Errorf("stats:%+v, expected 3 records of %d bytes", stats, len(csv))
+	}
+	check("csv", map[int64]string{1: "new x", 2: "y2"})
+
+	// TSV by column numbers, indexed later
+	tsv := "a\t10\t\"quoted\n\n" + "b\t11\tplain\r\n"
+	if _, e := db.Import(strings.NewReader(tsv), ImportOptions{Format: ImportTSV, KeyColumn: "1", ValueColumn: "2"}); e != nil {
+		t.Fatal(e)
+	}
+	// the old index is removed, as it doesn't index the new data file
+	if exists(db.indexFileDir) || leftBehind(db.dataFileDir, db.indexFileDir) {
+		t.Error("expected the old index removed and the new data file published")
+	}
+	db.CreateIndex()
+	check("tsv", map[int64]string{10: "\"quoted", 11: "plain"})
+
+	// JSON Lines with keys of bytes, a value of a string, a number or the whole line
+	jsonl := `{"user":"alice","v":"hello"}` + "\n\n" + `{"user":"bob","v":42}` + "\n" + `{"user":7,"v":{"a":1}}`
+	if _, e := db.Import(strings.NewReader(jsonl), ImportOptions{Format: ImportJSONL, KeyColumn: "user", ValueColumn: "v",
+		KeyType: KeyBytes, Index: true}); e != nil {
+		t.Fatal(e)
+	}
+	check("jsonl", map[int64]string{KeyOfBytes([]byte("alice")): "hello", KeyOfBytes([]byte("bob")): "42",
+		KeyOfBytes([]byte("7")): `{"a":1}`})
+	if _, e := db.Import(strings.NewReader(jsonl), ImportOptions{Format: ImportJSONL, KeyColumn: "user",
+		KeyType: KeyBytes, Index: true}); e != nil {
+		t.Fatal(e)
+	}
+	check("jsonl line", map[int64]string{KeyOfBytes([]byte("alice")): `{"user":"alice","v":"hello"}`})
+
+	// into a compressed and encrypted data file
+	db.SetValueCompression("flate", 0)
+	db.SetKeyProvider(testKeys("k1", "k1"), true)
+	if _, e := db.Import(strings.NewReader(csv), ImportOptions{Format: ImportCSV, Header: true,
+		KeyColumn: "id", ValueColumn: "2", Index: true}); e != nil {
+		t.Fatal(e)
+	}
+	check("encrypted", map[int64]string{1: "new x", 2: "y2"})
+
+	for _, bad := range []struct {
+		input string
+		opts  ImportOptions
+		err   string
+	}{
+		{"1,a\nx,b\n", ImportOptions{Format: ImportCSV, KeyColumn: "0", ValueColumn: "1"}, "row 2"},
+		{"1,a\n-1,b\n", ImportOptions{Format: ImportCSV, KeyColumn: "0", ValueColumn: "1"}, "negative"},
+		{"1,a\n2\n", ImportOptions{Format: ImportCSV, KeyColumn: "0", ValueColumn: "1"}, "row 2"},
+		{"id\n1\n", ImportOptions{Format: ImportCSV, Header: true, KeyColumn: "id", ValueColumn: "v"}, "unknown column"},
+		{`{"k":1}` + "\n" + `{"v":2}`, ImportOptions{Format: ImportJSONL, KeyColumn: "k"}, "row 2"},
+		{"", ImportOptions{Format: "xml"}, "unknown import format"},
+	} {
+		if _, e := db.Import(strings.NewReader(bad.input), bad.opts); e == nil || !strings.Contains(e.Error(), bad.err) {
+			t.Errorf("input %q: e:%v, expected %s", bad.input, e, bad.err)
+		}
+	}
+	// the failed imports keep the dataset, with or without the index
+	if _, e := db.Import(strings.NewReader("3,c\nx,d\n"), ImportOptions{Format: ImportCSV, KeyColumn: "0", ValueColumn: "1",
+		Index: true}); e == nil {
+		t.Error("expected an error for a malformed row")
+	}
+	if leftBehind(db.dataFileDir, db.indexFileDir) {
+		t.Error("expected the new data file and index removed")
+	}
+	check("failed", map[int64]string{1: "new x", 2: "y2"})
+
+	if KeyOfBytes([]byte("alice")) < 0 || KeyOfBytes(nil) < 0 {
+		t.Error("expected non-negative keys")
+	}
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The key manifest is the ground truth of a data file created by DataFileGen, a sidecar
+// of the keys generated and the checksums of their values, in the order they were written:
+//
+//	<magic(4)="FIKM", version(2), flags(2), max_key(8), entry...>
+//	entry: <key(8), crc32c of the value(4)>
+//
+// The last entry of a key is its value. Every key is below max_key, so a key from max_key
+// is a miss. Find tests sample the keys of it to measure hits and misses apart, and to
+// verify the values found. It's only true until the data file is changed by Put or Delete.
+
+const (
+	keyManifestMagic      = "FIKM"
+	keyManifestVersion    = 1
+	keyManifestHeaderSize = 16
+	keyManifestEntrySize  = 12
+
+	// keyManifestExpiring means the k-v pairs expire, so a key could be missing
+	keyManifestExpiring = 1
+)
+
+// keyManifestWriter writes the entries of a key manifest
+type keyManifestWriter struct {
+	file   *os.File
+	writer *bufio.Writer
+	entry  []byte
+}
+
+func newKeyManifestWriter(path string, maxKey int64, expiring bool) (*keyManifestWriter, error) {
+	if e := createDirIfNotExist(filepath.Dir(path)); e != nil {
+		return nil, e
+	}
+	f, e := os.Create(path)
+	if e != nil {
+		return nil, e
+	}
+	w := &keyManifestWriter{file: f, writer: bufio.NewWriterSize(f, int(MB)), entry: make([]byte, keyManifestHeaderSize)}
+	copy(w.entry, keyManifestMagic)
+	binary.BigEndian.PutUint16(w.entry[4:6], keyManifestVersion)
+	if expiring {
+		binary.BigEndian.PutUint16(w.entry[6:8], keyManifestExpiring)
+	}
+	binary.BigEndian.PutUint64(w.entry[8:16], uint64(maxKey))
+	w.writer.Write(w.entry)
+	return w, nil
+}
+
+// add adds the key and the checksum of its value, the errors are returned by close
+func (w *keyManifestWriter) add(key int64, value []byte) {
+	binary.BigEndian.PutUint64(w.entry[0:8], uint64(key))
+	binary.BigEndian.PutUint32(w.entry[8:12], crc32Checksum(value))
+	w.writer.Write(w.entry[:keyManifestEntrySize])
+}
+
+// keyManifestPartPath returns the path of the key manifest of the i-th part of a data file
+// generated in parallel
+func keyManifestPartPath(path string, i int) string {
+	return fmt.Sprintf("%s.part%d", path, i)
+}
+
+// append appends the entries of the key manifest at path, and removes it
+func (w *keyManifestWriter) append(path string) error {
+	f, e := os.Open(path)
+	if e != nil {
+		return e
+	}
+	defer os.Remove(path)
+	defer f.Close()
+	if _, e := f.Seek(keyManifestHeaderSize, io.SeekStart); e != nil {
+		return e
+	}
+	_, e = io.Copy(w.writer, f)
+	return e
+}
+
+func (w *keyManifestWriter) close() error {
+	e := w.writer.Flush()
+	if ce := w.file.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
+
+// TestKey is a key to find in a find test, a hit with the checksum of its value, or a miss
+type TestKey struct {
+	Key      int64
+	Checksum uint32
+	Hit      bool
+}
+
+// keyManifestReader reads the entries of a key manifest
+type keyManifestReader struct {
+	maxKey   int64
+	expiring bool
+	entries  int64
+}
+
+func openKeyManifest(path string) (*os.File, *keyManifestReader, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, nil, e
+	}
+	header := make([]byte, keyManifestHeaderSize)
+	if _, e := io.ReadFull(f, header); e != nil || string(header[:4]) != keyManifestMagic {
+		f.Close()
+		return nil, nil, fmt.Errorf("invalid key manifest %s", path)
+	}
+	if version := binary.BigEndian.Uint16(header[4:6]); version != keyManifestVersion {
+		f.Close()
+		return nil, nil, fmt.Errorf("unsupported key manifest version %d", version)
+	}
+	info, e := f.Stat()
+	if e != nil {
+		f.Close()
+		return nil, nil, e
+	}
+	r := &keyManifestReader{
+		expiring: binary.BigEndian.Uint16(header[6:8])&keyManifestExpiring != 0,
+		maxKey:   int64(binary.BigEndian.Uint64(header[8:16])),
+		entries:  (info.Size() - keyManifestHeaderSize) / keyManifestEntrySize,
+	}
+	return f, r, nil
+}
+
+// forEach calls fn with the entries of the key manifest in the order they were written
+func (r *keyManifestReader) forEach(f *os.File, fn func(key int64, checksum uint32)) error {
+	reader := bufio.NewReaderSize(io.NewSectionReader(f, keyManifestHeaderSize, r.entries*keyManifestEntrySize), int(MB))
+	entry := make([]byte, keyManifestEntrySize)
+	for i := int64(0); i < r.entries; i++ {
+		if _, e := io.ReadFull(reader, entry); e != nil {
+			return e
+		}
+		fn(int64(binary.BigEndian.Uint64(entry[0:8])), binary.BigEndian.Uint32(entry[8:12]))
+	}
+	return nil
+}
+
+// SetKeyManifest makes CreateData write the key manifest of the data file next to it
+func (db *DB) SetKeyManifest(enabled bool) {
+	db.keyManifest = enabled
+}
+
+// TestKeys samples n keys of the key manifest written by CreateData, about hitRatio of
+// them are generated keys, and the others are keys which were never generated. The
+// same seed samples the same keys. It also tells whether the k-v pairs could expire.
+func (db *DB) TestKeys(n int, hitRatio float64, seed int64) ([]TestKey, bool, error) {
+	if hitRatio < 0 || hitRatio > 1 {
+		return nil, false, fmt.Errorf("invalid hit ratio %v, it must be within [0, 1]", hitRatio)
+	}
+	f, r, e := openKeyManifest(db.keyManifestPath)
+	if e != nil {
+		return nil, false, e
+	}
+	defer f.Close()
+	if r.entries == 0 && hitRatio > 0 {
+		return nil, false, errors.New("no keys in key manifest")
+	}
+
+	rng := rand.New(rand.NewSource(seed))
+	keys := make([]TestKey, n)
+	// the entries of hits sampled, and which keys of them
+	sampled := make(map[int64][]int)
+	for i := range keys {
+		if rng.Float64() < hitRatio {
+			keys[i].Hit = true
+			entry := rng.Int63n(r.entries)
+			sampled[entry] = append(sampled[entry], i)
+		} else {
+			keys[i].Key = r.maxKey + rng.Int63n(r.maxKey)
+		}
+	}
+
+	// the keys of the entries sampled, then the last checksums of the keys
+	var entry int64 = 0
+	checksums := make(map[int64]uint32)
+	e = r.forEach(f, func(key int64, checksum uint32) {
+		for _, i := range sampled[entry] {
+			keys[i].Key = key
+			checksums[key] = 0
+		}
+		entry++
+	})
+	if e != nil {
+		return nil, false, e
+	}
+	e = r.forEach(f, func(key int64, checksum uint32) {
+		if _, ok := checksums[key]; ok {
+			checksums[key] = checksum
+		}
+	})
+	if e != nil {
+		return nil, false, e
+	}
+	for i := range keys {
+		if keys[i].Hit {
+			keys[i].Checksum = checksums[keys[i].Key]
+		}
+	}
+	return keys, r.expiring, nil
+}
+
+// FindTestStats is the result of FindTest
+type FindTestStats struct {
+	Hits   int64
+	Misses int64
+	// Expired is the hits not found, which are expected only if the k-v pairs expire
+	Expired int64
+	// Wrong is the keys found with another value, or a miss found, or an error
+	Wrong int64
+	// HitTime and MissTime are the time of getting the hits and the misses
+	HitTime  time.Duration
+	MissTime time.Duration
+}
+
+// FindTest gets every key of keys, verifies the value of a hit by its checksum, and a
+// miss not found. A hit not found is expired if expiring, otherwise it's wrong.
+func (db *DB) FindTest(keys []TestKey, expiring bool) FindTestStats {
+	stats := FindTestStats{}
+	for _, key := range keys {
+		start := time.Now()
+		value, e := db.Get(key.Key)
+		cost := time.Since(start)
+
+		if !key.Hit {
+			stats.Misses++
+			stats.MissTime += cost
+			if e != ErrNotFound {
+				stats.Wrong++
+			}
+			continue
+		}
+		stats.Hits++
+		stats.HitTime += cost
+		if e == ErrNotFound && expiring {
+			stats.Expired++
+		} else if e != nil || crc32Checksum(value) != key.Checksum {
+			stats.Wrong++
+		}
+	}
+	return stats
+}
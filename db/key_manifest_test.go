@@ -0,0 +1,72 @@
+package db
+
+import (
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func Test_key_manifest(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.maxKey = 1000
+	db.maxValueLength = 64
+	db.writeBufSize = int(4 * KB)
+	db.SetKeyManifest(true)
+	db.SetDistribution(Distribution{Content: ContentRandom, Seed: 1})
+	db.CreateData(64 * KB)
+	db.CreateIndex()
+	db.InitFind()
+
+	keys, expiring, e := db.TestKeys(1000, 0.8, 7)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if again, _, _ := db.TestKeys(1000, 0.8, 7); !reflect.DeepEqual(keys, again) || expiring {
+		t.Error("expected the same keys of the same seed, which don't expire")
+	}
+	stats := db.FindTest(keys, expiring)
+	if stats.Hits < 700 || stats.Hits > 900 || stats.Hits+stats.Misses != 1000 || stats.Wrong != 0 || stats.Expired != 0 {
+		t.Errorf("stats:%+v, expected about 800 hits, all right", stats)
+	}
+
+	// a value changed after is wrong, and so is a miss found
+	var hit TestKey
+	for _, key := range keys {
+		if key.Hit {
+			hit = key
+			break
+		}
+	}
+	db.Put(hit.Key, []byte("changed"))
+	db.Put(5000, []byte("miss"))
+	if stats := db.FindTest([]TestKey{hit, {Key: 5000}}, expiring); stats.Wrong != 2 {
+		t.Errorf("stats:%+v, expected 2 wrong", stats)
+	}
+
+	// the hits of k-v pairs expiring could be expired
+	db.SetTTL(time.Hour)
+	db.CreateData(16 * KB)
+	db.CreateIndex()
+	db.InitFind()
+	if keys, expiring, e = db.TestKeys(100, 1, 1); e != nil || !expiring {
+		t.Fatalf("expiring:%v, e:%v, expected expiring", expiring, e)
+	}
+	if stats := db.FindTest(keys, expiring); stats.Hits != 100 || stats.Wrong != 0 {
+		t.Errorf("stats:%+v, expected 100 right hits", stats)
+	}
+
+	// and it's removed with a data file without it
+	db.SetKeyManifest(false)
+	db.CreateData(16 * KB)
+	if _, e := os.Stat(dir + "/data.keys"); !os.IsNotExist(e) {
+		t.Errorf("e:%v, expected the stale key manifest removed", e)
+	}
+	if _, _, e := db.TestKeys(100, 2, 1); e == nil {
+		t.Error("expected an error for an invalid hit ratio")
+	}
+}
@@ -0,0 +1,243 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The LOCK file in the base dir is an advisory flock, so processes don't clobber the data
+// files and the index of each other. The builders, CreateData, CreateIndex, Ingest, Import,
+// Reshard, Compact and SortData, hold it exclusively while they run, and the writers, Put
+// and Delete, from their first write until Close. The readers hold it shared while opening
+// the data files and the index by InitFind or Reload, so they never open a dataset being
+// replaced, and they keep finding in the opened ones while a builder runs. The exclusive
+// holder writes who it is into the LOCK file for the others to tell.
+//
+// As a writer keeps the lock exclusively until Close, no other process could open the
+// dataset by InitFind or Reload, or build it, while a writer is open. A process writing
+// in batches now and then should Close between them. Converting a flock between shared
+// and exclusive isn't atomic, the lock held is dropped before taking the other mode, so
+// the lock is taken back in the mode held if converting fails, or given up if another
+// process took it meanwhile.
+
+const lockFileName = "LOCK"
+
+type LockMode int
+
+const (
+	LockShared LockMode = iota
+	LockExclusive
+)
+
+// holderUnknown is the Holder of a LockError if the exclusive holder doesn't tell who it is
+const holderUnknown = "an unknown holder"
+
+// the holder written just after the lock is taken is read again a few times
+const (
+	holderReadRetries  = 3
+	holderReadInterval = 10 * time.Millisecond
+)
+
+// LockError is returned if the LOCK file is held in a conflicting mode by another process,
+// or another DB of the same base dir
+type LockError struct {
+	Path string
+	// Holder is who holds it exclusively, "" if it's held shared by readers, or
+	// "an unknown holder" if the exclusive holder isn't written
+	Holder string
+}
+
+func (e *LockError) Error() string {
+	if e.Holder == "" {
+		return fmt.Sprintf("%s is locked by readers", e.Path)
+	}
+	return fmt.Sprintf("%s is locked by %s", e.Path, e.Holder)
+}
+
+// dirLock is the LOCK file held by a DB
+type dirLock struct {
+	path string
+	file *os.File
+	mode LockMode
+	// kept is held until Close in keptMode, by the writers or by Lock
+	kept     bool
+	keptMode LockMode
+}
+
+func lockDir(dir string, mode LockMode, op string) (*dirLock, error) {
+	if e := createDirIfNotExist(dir); e != nil {
+		return nil, e
+	}
+	path := filepath.Join(dir, lockFileName)
+	f, e := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if e != nil {
+		return nil, e
+	}
+	l := &dirLock{path: path, file: f}
+	if e := l.flock(mode, op); e != nil {
+		f.Close()
+		return nil, e
+	}
+	return l, nil
+}
+
+// flock locks the LOCK file in mode without blocking, or converts the lock held into mode
+func (l *dirLock) flock(mode LockMode, op string) error {
+	how := syscall.LOCK_SH
+	if mode == LockExclusive {
+		how = syscall.LOCK_EX
+	}
+	if e := syscall.Flock(int(l.file.Fd()), how|syscall.LOCK_NB); e == syscall.EWOULDBLOCK {
+		return &LockError{Path: l.path, Holder: l.holder(mode)}
+	} else if e != nil {
+		return e
+	}
+	converted := l.mode == LockExclusive
+	l.mode = mode
+
+	// only the exclusive holder writes who it is, the readers leave it alone, but the
+	// holder written is stale once it's converted into shared
+	if mode != LockExclusive {
+		if converted {
+			return l.file.Truncate(0)
+		}
+		return nil
+	}
+	host, _ := os.Hostname()
+	holder := fmt.Sprintf("pid %d on %s, %s since %s\n", os.Getpid(), host, op, time.Now().Format(time.RFC3339))
+	if _, e := l.file.WriteAt([]byte(holder), 0); e != nil {
+		return e
+	}
+	return l.file.Truncate(int64(len(holder)))
+}
+
+// holder returns who holds the LOCK file in conflict with mode, "" if it's shared by
+// readers. The exclusive holder is read again if it's not written yet, and it's unknown
+// if it's never written.
+func (l *dirLock) holder(mode LockMode) string {
+	if mode == LockExclusive && l.shared() {
+		return ""
+	}
+	for i := 0; i < holderReadRetries; i++ {
+		if i > 0 {
+			time.Sleep(holderReadInterval)
+		}
+		data, e := ioutil.ReadFile(l.path)
+		if holder := strings.TrimSpace(string(data)); e == nil && holder != "" {
+			return holder
+		}
+	}
+	return holderUnknown
+}
+
+// shared tells whether the LOCK file could be locked shared, so it's held by readers
+// rather than exclusively
+func (l *dirLock) shared() bool {
+	f, e := os.Open(l.path)
+	if e != nil {
+		return false
+	}
+	defer f.Close()
+	if e := syscall.Flock(int(f.Fd()), syscall.LOCK_SH|syscall.LOCK_NB); e != nil {
+		return false
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return true
+}
+
+func (l *dirLock) unlock() error {
+	if l.mode == LockExclusive {
+		l.file.Truncate(0)
+	}
+	e := syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if ce := l.file.Close(); e == nil {
+		e = ce
+	}
+	return e
+}
+
+// holdLock holds the LOCK file in mode for op, and returns the func to release it, or keeps
+// it until Close if keep. The lock held by db already is reused, a shared one is converted
+// into exclusive until released.
+func (db *DB) holdLock(mode LockMode, op string, keep bool) (func(), error) {
+	db.lockMu.Lock()
+	defer db.lockMu.Unlock()
+
+	l := db.lock
+	if l == nil {
+		var e error
+		if l, e = lockDir(db.baseDir, mode, op); e != nil {
+			return nil, e
+		}
+		db.lock = l
+	} else if l.mode == LockExclusive || mode == LockShared {
+		// the one holding it releases it
+		l.keep(mode, keep)
+		return func() {}, nil
+	} else if e := l.flock(LockExclusive, op); e != nil {
+		db.restoreLock(l, LockShared)
+		return nil, e
+	}
+	l.keep(mode, keep)
+	return func() { db.releaseLock(l) }, nil
+}
+
+// keep keeps the lock in mode until Close if keep
+func (l *dirLock) keep(mode LockMode, keep bool) {
+	if !keep {
+		return
+	}
+	if !l.kept || mode > l.keptMode {
+		l.keptMode = mode
+	}
+	l.kept = true
+}
+
+// releaseLock releases the lock held, or converts it into the mode kept
+func (db *DB) releaseLock(l *dirLock) {
+	db.lockMu.Lock()
+	defer db.lockMu.Unlock()
+	if db.lock != l {
+		return
+	}
+	if !l.kept {
+		l.unlock()
+		db.lock = nil
+	} else if l.mode != l.keptMode {
+		db.restoreLock(l, l.keptMode)
+	}
+}
+
+// restoreLock takes the lock dropped by converting it back in mode, or gives it up if
+// it's taken by another process, it's called with lockMu held
+func (db *DB) restoreLock(l *dirLock, mode LockMode) {
+	if e := l.flock(mode, ""); e != nil {
+		l.unlock()
+		db.lock = nil
+	}
+}
+
+// Lock holds the LOCK file of db in mode until Unlock or Close, so other processes can't
+// replace the dataset with LockShared, or neither read nor write it with LockExclusive.
+// It returns a LockError telling who holds it if it's held in a conflicting mode.
+func (db *DB) Lock(mode LockMode) error {
+	_, e := db.holdLock(mode, "lock", true)
+	return e
+}
+
+// Unlock releases the LOCK file held by db
+func (db *DB) Unlock() error {
+	db.lockMu.Lock()
+	defer db.lockMu.Unlock()
+	if db.lock == nil {
+		return nil
+	}
+	e := db.lock.unlock()
+	db.lock = nil
+	return e
+}
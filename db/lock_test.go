@@ -0,0 +1,174 @@
+package db
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func Test_lock(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2}, []string{"a", "bb"})
+	writer := OpenDB(dir)
+	writer.indexShardNum = 4
+	writer.CreateIndex()
+	writer.InitFind()
+
+	// the writer holds it exclusively until Close, and tells who it is
+	if e := writer.Put(3, []byte("ccc")); e != nil {
+		t.Fatal(e)
+	}
+	reader := OpenDB(dir)
+	e := reader.Reload()
+	if lockErr, ok := e.(*LockError); !ok || !strings.Contains(lockErr.Holder, fmt.Sprintf("pid %d", os.Getpid())) ||
+		!strings.Contains(lockErr.Holder, "put") {
+		t.Fatalf("e:%v, expected locked by the writer", e)
+	}
+	if e := reader.Reshard(2, ModSharder{}); e == nil {
+		t.Error("expected the builder locked out")
+	}
+	writer.Close()
+
+	// the readers share it only while opening, unless they lock it
+	if e := reader.Reload(); e != nil {
+		t.Fatal(e)
+	}
+	if e := reader.Lock(LockShared); e != nil {
+		t.Fatal(e)
+	}
+	other := OpenDB(dir)
+	if e := other.Lock(LockShared); e != nil {
+		t.Fatal(e)
+	}
+	builder := OpenDB(dir)
+	e = builder.Ingest(strings.NewReader(""))
+	if lockErr, ok := e.(*LockError); !ok || lockErr.Holder != "" || !strings.Contains(e.Error(), "locked by readers") {
+		t.Fatalf("e:%v, expected locked by readers", e)
+	}
+	other.Unlock()
+
+	// a shared lock is converted into exclusive while building, and back
+	release, e := reader.holdLock(LockExclusive, "compact", false)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := other.Lock(LockShared); e == nil || !strings.Contains(e.Error(), "compact") {
+		t.Errorf("e:%v, expected locked by compact", e)
+	}
+	release()
+	if e := other.Lock(LockShared); e != nil {
+		t.Errorf("e:%v, expected the lock shared again", e)
+	}
+	other.Unlock()
+
+	if e := reader.Close(); e != nil {
+		t.Fatal(e)
+	}
+	if e := builder.Lock(LockExclusive); e != nil {
+		t.Errorf("e:%v, expected the lock released by Close", e)
+	}
+}
+
+func Test_lock_convert_failed(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	reader := OpenDB(dir)
+	if e := reader.Lock(LockShared); e != nil {
+		t.Fatal(e)
+	}
+	other := OpenDB(dir)
+	if e := other.Lock(LockShared); e != nil {
+		t.Fatal(e)
+	}
+
+	// converting fails on the other reader, and the shared lock is taken back
+	if _, e := reader.holdLock(LockExclusive, "compact", false); e == nil {
+		t.Fatal("expected converting locked out by the other reader")
+	}
+	if reader.lock == nil || reader.lock.mode != LockShared {
+		t.Fatalf("lock:%+v, expected held shared", reader.lock)
+	}
+	other.Unlock()
+	builder := OpenDB(dir)
+	if e := builder.Lock(LockExclusive); e == nil {
+		t.Error("expected the builder locked out by the reader")
+	}
+
+	// or given up if another process took it meanwhile, as recorded
+	l := reader.lock
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+	if e := builder.Lock(LockExclusive); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := reader.holdLock(LockExclusive, "compact", false); e == nil {
+		t.Fatal("expected converting locked out by the builder")
+	}
+	if reader.lock != nil {
+		t.Errorf("lock:%+v, expected given up", reader.lock)
+	}
+	builder.Unlock()
+	reader.Close()
+}
+
+func Test_lock_holder(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	// the readers don't clear the holder written, and a stale one isn't told for them
+	path := dir + "/" + lockFileName
+	stale := "pid 1 on host, compact since 2020-01-01T00:00:00Z"
+	if e := ioutil.WriteFile(path, []byte(stale+"\n"), 0644); e != nil {
+		t.Fatal(e)
+	}
+	reader := OpenDB(dir)
+	if e := reader.Lock(LockShared); e != nil {
+		t.Fatal(e)
+	}
+	if data, _ := ioutil.ReadFile(path); strings.TrimSpace(string(data)) != stale {
+		t.Errorf("LOCK:%q, expected left alone by the reader", data)
+	}
+	builder := OpenDB(dir)
+	e := builder.Lock(LockExclusive)
+	if lockErr, ok := e.(*LockError); !ok || lockErr.Holder != "" {
+		t.Errorf("e:%v, expected locked by readers", e)
+	}
+	reader.Unlock()
+
+	// an exclusive holder which doesn't tell who it is is unknown, rather than readers
+	ioutil.WriteFile(path, nil, 0644)
+	f, _ := os.Open(path)
+	defer f.Close()
+	if e := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); e != nil {
+		t.Fatal(e)
+	}
+	for _, mode := range []LockMode{LockShared, LockExclusive} {
+		e := OpenDB(dir).Lock(mode)
+		if lockErr, ok := e.(*LockError); !ok || lockErr.Holder != holderUnknown || !strings.Contains(e.Error(), "unknown") {
+			t.Errorf("mode:%d, e:%v, expected locked by an unknown holder", mode, e)
+		}
+	}
+	syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	// the holder converted into shared is cleared
+	if e := builder.Lock(LockShared); e != nil {
+		t.Fatal(e)
+	}
+	release, e := builder.holdLock(LockExclusive, "compact", false)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if data, _ := ioutil.ReadFile(path); !strings.Contains(string(data), "compact") {
+		t.Errorf("LOCK:%q, expected held by compact", data)
+	}
+	release()
+	if data, _ := ioutil.ReadFile(path); len(data) != 0 {
+		t.Errorf("LOCK:%q, expected cleared once shared", data)
+	}
+	builder.Unlock()
+}
@@ -0,0 +1,87 @@
+package db
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+// The memtable indexes the k-v pairs appended by Put after the index was built. It
+// overlays the mmapped index shards, so a new value is visible to Get immediately.
+// The k-v pairs are appended to the data file as well, so they are replayed into the
+// memtable from the indexed size of the segment when the DB is opened again.
+
+type memtable struct {
+	sync.RWMutex
+	items map[int64]indexItem
+}
+
+func newMemtable() *memtable {
+	return &memtable{items: make(map[int64]indexItem)}
+}
+
+func (m *memtable) put(key int64, vsz int64, vpos int64) {
+	m.Lock()
+	m.items[key] = indexItem{key: key, vsz: vsz, vpos: vpos}
+	m.Unlock()
+}
+
+// get returns the valueSize and valuePos of key, and whether it's in the memtable
+func (m *memtable) get(key int64) (int64, int64, bool) {
+	m.RLock()
+	item, ok := m.items[key]
+	m.RUnlock()
+	return item.vsz, item.vpos, ok
+}
+
+func (m *memtable) len() int {
+	m.RLock()
+	defer m.RUnlock()
+	return len(m.items)
+}
+
+// snapshot returns the items in the memtable
+func (m *memtable) snapshot() []indexItem {
+	m.RLock()
+	defer m.RUnlock()
+	items := make([]indexItem, 0, len(m.items))
+	for _, item := range m.items {
+		items = append(items, item)
+	}
+	return items
+}
+
+// reset empties the memtable once its items are flushed
+func (m *memtable) reset() {
+	m.Lock()
+	m.items = make(map[int64]indexItem)
+	m.Unlock()
+}
+
+// replay puts the k-v pairs of a segment in [from, size) into the memtable. It stops at
+// the first corrupt k-v pair, such as one partially written when the process crashed,
+// and returns its offset, which is where the next k-v pair should be appended.
+func (m *memtable) replay(dfile *os.File, format dataFormat, segment int, from int64, size int64,
+	maxValueSize int64) (int64, error) {
+	header := make([]byte, 24)
+	pos := from
+	if pos < format.headerSize {
+		pos = format.headerSize
+	}
+	for pos < size {
+		n, e := dfile.ReadAt(header, pos)
+		if e != nil && e != io.EOF {
+			return pos, e
+		}
+		if checkRecordHeader(format, header[:n], pos, size, maxValueSize) != "" {
+			break
+		}
+
+		key := int64(binary.BigEndian.Uint64(header[8:16]))
+		valueSize := int64(binary.BigEndian.Uint64(header[16:24]))
+		m.put(key, valueSize, packValuePos(segment, pos+24))
+		pos += format.recordSize(valueSize)
+	}
+	return pos, nil
+}
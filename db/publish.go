@@ -0,0 +1,170 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// A new dataset is built aside, the index in <index>.build or <index>.reshard, or both the
+// data files and the index in <dir>.build by Ingest or <dir>.compact, and it's published
+// by renaming the old dirs to <dir>.old and the new ones into place. The manifest of the
+// new index is written before the renames, so it's the commit point: the dirs left by a
+// process crashed in between are rolled forward if the new index has its manifest, or
+// rolled back otherwise, by the next builder or reader opening the dataset. The data files imported without an
+// index have no manifest to commit, so the old index is removed before they're published,
+// and the dataset left is either the old or the new data files, without an index.
+
+// buildSuffixes are the suffixes of the dirs a new dataset is built in
+var buildSuffixes = []string{".build", ".reshard", ".compact"}
+
+// buildDir returns the empty dir to build the index or the data files of dir in, before
+// replacing it
+func buildDir(dir string) string {
+	dir = filepath.Clean(dir) + ".build"
+	os.RemoveAll(dir)
+	return dir
+}
+
+// replaceIndex replaces the index in indexDir by the one built in tmpDir at once, so the
+// readers never open index files partially written, and the ones opened before are kept
+// readable until they're closed
+func replaceIndex(tmpDir string, indexDir string) error {
+	return replaceDirs([][2]string{{tmpDir, filepath.Clean(indexDir)}})
+}
+
+// removeIndex removes the index in indexDir, it's renamed to <index>.stale first, so it's
+// never opened partially removed
+func removeIndex(indexDir string) error {
+	stale := filepath.Clean(indexDir) + ".stale"
+	os.RemoveAll(stale)
+	if e := os.Rename(filepath.Clean(indexDir), stale); e != nil && !os.IsNotExist(e) {
+		return e
+	}
+	return os.RemoveAll(stale)
+}
+
+// replaceDirs replaces every dir by the new one built aside, dirs are pairs of the new dir
+// and the dir. The new dirs without a manifest written must not be replaced by it.
+func replaceDirs(dirs [][2]string) error {
+	for _, d := range dirs {
+		os.RemoveAll(d[1] + ".old")
+		if e := os.Rename(d[1], d[1]+".old"); e != nil && !os.IsNotExist(e) {
+			return e
+		}
+	}
+	for _, d := range dirs {
+		if e := os.Rename(d[0], d[1]); e != nil {
+			return e
+		}
+	}
+	for _, d := range dirs {
+		if e := os.RemoveAll(d[1] + ".old"); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// lockBuilder holds the LOCK file exclusively for a builder, after recovering the dataset
+// left by a builder crashed before
+func (db *DB) lockBuilder(op string) (func(), error) {
+	if e := db.recover(); e != nil {
+		return nil, e
+	}
+	return db.holdLock(LockExclusive, op, false)
+}
+
+// recover recovers the dirs left by a builder crashed while publishing. It's done with the
+// LOCK file held exclusively, so it's skipped if a builder is running, or db holds the
+// LOCK file already as a builder of db could be running.
+func (db *DB) recover() error {
+	dataDir, indexDir := filepath.Clean(db.dataFileDir), filepath.Clean(db.indexFileDir)
+	if !leftBehind(dataDir, indexDir) {
+		return nil
+	}
+
+	db.lockMu.Lock()
+	defer db.lockMu.Unlock()
+	if db.lock != nil {
+		return nil
+	}
+	l, e := lockDir(db.baseDir, LockExclusive, "recover")
+	if _, locked := e.(*LockError); locked {
+		return nil
+	} else if e != nil {
+		return e
+	}
+	e = recoverDirs(dataDir, indexDir)
+	if ue := l.unlock(); e == nil {
+		e = ue
+	}
+	return e
+}
+
+// leftBehind tells whether any dir of a new dataset or an old one is left
+func leftBehind(dataDir string, indexDir string) bool {
+	for _, dir := range []string{dataDir, indexDir} {
+		for _, suffix := range append(buildSuffixes, ".old", ".stale") {
+			if exists(dir + suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recoverDirs rolls forward the new dataset with its manifest written, and rolls back the
+// one without it, then removes the old dataset
+func recoverDirs(dataDir string, indexDir string) error {
+	for _, suffix := range buildSuffixes {
+		dirs := [][2]string{{dataDir + suffix, dataDir}, {indexDir + suffix, indexDir}}
+		if !exists(filepath.Join(indexDir+suffix, manifestFileName)) {
+			for _, d := range dirs {
+				if e := os.RemoveAll(d[0]); e != nil {
+					return e
+				}
+			}
+			continue
+		}
+
+		// the dirs not renamed yet are renamed, the new dirs are renamed in order after
+		// all the old ones
+		for _, d := range dirs {
+			if !exists(d[0]) {
+				continue
+			}
+			if exists(d[1]) {
+				os.RemoveAll(d[1] + ".old")
+				if e := os.Rename(d[1], d[1]+".old"); e != nil {
+					return e
+				}
+			}
+		}
+		for _, d := range dirs {
+			if !exists(d[0]) {
+				continue
+			}
+			if e := os.Rename(d[0], d[1]); e != nil {
+				return e
+			}
+		}
+	}
+
+	for _, dir := range []string{dataDir, indexDir} {
+		// an old dir without the new one is of a dataset rolled back
+		if !exists(dir) && exists(dir+".old") {
+			if e := os.Rename(dir+".old", dir); e != nil {
+				return e
+			}
+		}
+		if e := os.RemoveAll(dir + ".old"); e != nil {
+			return e
+		}
+	}
+	return os.RemoveAll(indexDir + ".stale")
+}
+
+func exists(path string) bool {
+	_, e := os.Stat(path)
+	return e == nil
+}
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyDir copies the files of src into dst
+func copyDir(t *testing.T, src string, dst string) {
+	infos, e := ioutil.ReadDir(src)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if e := os.MkdirAll(dst, 0755); e != nil {
+		t.Fatal(e)
+	}
+	for _, info := range infos {
+		if info.IsDir() {
+			copyDir(t, filepath.Join(src, info.Name()), filepath.Join(dst, info.Name()))
+			continue
+		}
+		data, e := ioutil.ReadFile(filepath.Join(src, info.Name()))
+		if e != nil {
+			t.Fatal(e)
+		}
+		if e := ioutil.WriteFile(filepath.Join(dst, info.Name()), data, 0644); e != nil {
+			t.Fatal(e)
+		}
+	}
+}
+
+func Test_publish_recovery(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	// the old dataset and the new one compacted aside
+	for _, d := range []struct {
+		name   string
+		values []string
+	}{{"old", []string{"a", "bb"}}, {"new", []string{"aa", "b"}}} {
+		writeRecords(t, filepath.Join(dir, d.name, "data", "data.d"), []int64{1, 2}, d.values)
+		db := OpenDB(filepath.Join(dir, d.name))
+		db.indexShardNum = 4
+		if e := db.CreateIndex(); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	// the renames of publishing, a crash could happen after any of them
+	renames := [][2]string{{"data", "data.old"}, {"index", "index.old"}, {"data.compact", "data"}, {"index.compact", "index"}}
+	for crashed := 0; crashed <= len(renames); crashed++ {
+		for _, committed := range []bool{true, false} {
+			// the manifest is written before the renames
+			if !committed && crashed > 0 {
+				continue
+			}
+			base := filepath.Join(dir, "crashed")
+			os.RemoveAll(base)
+			copyDir(t, filepath.Join(dir, "old", "data"), filepath.Join(base, "data"))
+			copyDir(t, filepath.Join(dir, "old", "index"), filepath.Join(base, "index"))
+			copyDir(t, filepath.Join(dir, "new", "data"), filepath.Join(base, "data.compact"))
+			copyDir(t, filepath.Join(dir, "new", "index"), filepath.Join(base, "index.compact"))
+			if !committed {
+				os.Remove(filepath.Join(base, "index.compact", manifestFileName))
+			}
+			for _, rename := range renames[:crashed] {
+				if e := os.Rename(filepath.Join(base, rename[0]), filepath.Join(base, rename[1])); e != nil {
+					t.Fatal(e)
+				}
+			}
+
+			db, e := Open(base)
+			if e != nil {
+				t.Fatalf("crashed after %d renames: %s", crashed, e)
+			}
+			expected := "aa"
+			if !committed {
+				expected = "a"
+			}
+			if v, e := db.Get(1); e != nil || string(v) != expected {
+				t.Errorf("crashed after %d renames, committed %v: v:%s, e:%v, expected %s", crashed, committed, v, e, expected)
+			}
+			db.Close()
+			for _, left := range []string{"data.old", "index.old", "data.compact", "index.compact"} {
+				if exists(filepath.Join(base, left)) {
+					t.Errorf("crashed after %d renames: %s is left", crashed, left)
+				}
+			}
+		}
+	}
+
+	// a builder running isn't recovered
+	base := filepath.Join(dir, "crashed")
+	copyDir(t, filepath.Join(dir, "new", "index"), filepath.Join(base, "index.build"))
+	builder := OpenDB(base)
+	if e := builder.Lock(LockExclusive); e != nil {
+		t.Fatal(e)
+	}
+	if e := OpenDB(base).recover(); e != nil {
+		t.Fatal(e)
+	}
+	if !exists(filepath.Join(base, "index.build")) {
+		t.Error("expected the dir of a builder running kept")
+	}
+	builder.Unlock()
+}
@@ -0,0 +1,165 @@
+package db
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// recordFunc is called with every k-v pair of a segment, record is the whole k-v pair
+// in the format of the segment and valuePos is the value_position of its value. read is
+// how many bytes of the segment have been read. record is only valid in the call.
+type recordFunc func(record []byte, valuePos int64, read int64) error
+
+// corruptFunc is called with the corrupt bytes skipped, it stops reading if it returns an
+// error
+type corruptFunc func(record CorruptRecord) error
+
+// forEachRecord calls fn with the k-v pairs of a segment in [0, size) in data file order.
+// Corrupt bytes are skipped to the next plausible k-v pair, and a block which can't be
+// decompressed or parsed is skipped from where it's corrupt, they're passed to corrupt
+// if it's not nil.
+func forEachRecord(df *os.File, format dataFormat, segment int, size int64, maxValueSize int64, fn recordFunc,
+	corrupt corruptFunc) error {
+	if corrupt == nil {
+		corrupt = func(CorruptRecord) error { return nil }
+	}
+	if format.blocked() {
+		return forEachBlockRecord(df, format, segment, size, maxValueSize, fn, corrupt)
+	}
+
+	// scanner resyncs after corrupt bytes with the format of the segment
+	scanner := &FastIndex{format: format, maxValueSize: maxValueSize}
+	reader := bufio.NewReaderSize(io.NewSectionReader(df, 0, size), int(MB))
+	record := make([]byte, 0, KB)
+
+	pos := format.headerSize
+	if _, e := reader.Discard(int(pos)); e != nil {
+		return e
+	}
+	for pos < size {
+		header, e := reader.Peek(24)
+		if e != nil && e != io.EOF {
+			return e
+		}
+
+		// skip the corrupt bytes to the next plausible k-v pair
+		if reason := checkRecordHeader(format, header, pos, size, scanner.valueSizeLimit()); reason != "" {
+			next := scanner.resync(df, pos, size)
+			if e := corrupt(CorruptRecord{Segment: segment, Offset: pos, Length: next - pos, Reason: reason}); e != nil {
+				return e
+			}
+			if _, e := reader.Discard(int(next - pos)); e != nil && e != io.EOF {
+				return e
+			}
+			pos = next
+			continue
+		}
+
+		recordSize := format.recordSize(int64(binary.BigEndian.Uint64(header[16:24])))
+		if int64(cap(record)) < recordSize {
+			record = make([]byte, recordSize)
+		}
+		record = record[:recordSize]
+		if _, e := io.ReadFull(reader, record); e != nil {
+			return e
+		}
+
+		if e := fn(record, packValuePos(segment, pos+24), pos+recordSize); e != nil {
+			return e
+		}
+		pos += recordSize
+	}
+	return nil
+}
+
+func forEachBlockRecord(df *os.File, format dataFormat, segment int, size int64, maxValueSize int64, fn recordFunc,
+	corrupt corruptFunc) error {
+	offsets, e := readBlockIndex(df, format, size)
+	if e != nil {
+		return e
+	}
+	if maxValueSize <= 0 {
+		maxValueSize = defaultMaxValueSize
+	}
+
+	for block := 0; block+1 < len(offsets); block++ {
+		from, to := offsets[block], offsets[block+1]
+		raw, e := readBlock(df, format, from, to)
+		if e != nil {
+			if e := corrupt(CorruptRecord{Segment: segment, Offset: from, Length: to - from, Reason: e.Error()}); e != nil {
+				return e
+			}
+			continue
+		}
+
+		rawSize := int64(len(raw))
+		for off := int64(0); off < rawSize; {
+			// the rest of the block can't be parsed
+			if reason := checkRecordHeader(format, raw[off:], off, rawSize, maxValueSize); reason != "" {
+				record := CorruptRecord{Segment: segment, Offset: from, Length: to - from,
+					Reason: fmt.Sprintf("%s in block %d at %d, %d bytes decompressed", reason, block, off, rawSize-off)}
+				if e := corrupt(record); e != nil {
+					return e
+				}
+				break
+			}
+			recordSize := format.recordSize(int64(binary.BigEndian.Uint64(raw[off+16 : off+24])))
+			valuePos := packValuePos(segment, packBlockPos(int64(block), off+24))
+			if e := fn(raw[off:off+recordSize], valuePos, offsets[block+1]); e != nil {
+				return e
+			}
+			off += recordSize
+		}
+	}
+	return nil
+}
+
+// convertRecord converts a k-v pair from a format into another, a checksum is kept if
+// both formats have it. A value is encoded by enc if only the new format has the flags
+// byte of values, and decoded within maxValueSize if only the old one has it. The expiry
+// is kept if both formats have it, and a value without it never expires. The value of
+// record must not be sealed.
+func convertRecord(record []byte, from dataFormat, to dataFormat, enc valueEncoder, maxValueSize int64) ([]byte, error) {
+	valueSize := int64(binary.BigEndian.Uint64(record[16:24]))
+	if valueSize >= 0 && (from.valueCoded() != to.valueCoded() || from.expiring() != to.expiring()) {
+		value := record[24 : 24+valueSize]
+		var expiresAt int64
+		var e error
+		if from.expiring() {
+			if expiresAt, value, e = splitExpiry(value); e != nil {
+				return nil, e
+			}
+		}
+		if from.valueCoded() != to.valueCoded() {
+			if to.valueCoded() {
+				value, e = enc.encode(value)
+			} else {
+				value, e = decodeValue(value, maxValueSize)
+			}
+			if e != nil {
+				return nil, e
+			}
+		}
+		if to.expiring() {
+			value = withExpiry(expiresAt, value)
+		}
+		key := int64(binary.BigEndian.Uint64(record[8:16]))
+		return to.encodeRecord(key, int64(len(value)), value), nil
+	}
+
+	if from.checksummed() == to.checksummed() {
+		return record, nil
+	}
+	body := record[:int64(len(record))-from.trailerSize()]
+	if !to.checksummed() {
+		return body, nil
+	}
+
+	converted := make([]byte, len(body)+checksumSize)
+	copy(converted, body)
+	binary.BigEndian.PutUint32(converted[len(body):], crc32Checksum(body))
+	return converted, nil
+}
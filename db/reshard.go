@@ -0,0 +1,205 @@
+package db
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Reshard builds a FastIndex from the items of another index with a different shard
+// count or sharder, without rescanning the data file. Every indexShard of src is
+// sorted and read where it's mapped, so it adds a sorted run to each new indexShard.
+// The run boundaries are recorded while the items are redistributed, and the runs of
+// each new indexShard are merged in sorted order in the end. The index files are
+// closed even if it fails.
+func (fidx *FastIndex) Reshard(src *FastIndex) error {
+	defer fidx.closeShards()
+
+	var totalSize int64 = 0
+	for _, idx := range src.shards {
+		totalSize += idx.fileSize
+	}
+	reporter := newProgressReporter(fidx.progress, totalSize, fidx.shardNum)
+	fidx.pool.budget = fidx.memBudget
+
+	// runs[i] are the offsets in the i-th new indexShard where a run starts
+	runs := make([][]int64, fidx.shardNum)
+	var parsed int64 = 0
+	var records int64 = 0
+	for _, idx := range src.shards {
+		for i, dst := range fidx.shards {
+			runs[i] = append(runs[i], dst.totalSize+int64(dst.buffered))
+		}
+
+		// the items are read from the mapped indexShard, rather than into memory
+		buf := idx.dataRef
+		for off := 0; off+fixIndexItemSize <= len(buf); off += fixIndexItemSize {
+			key := int64(binary.BigEndian.Uint64(buf[off : off+8]))
+			if e := fidx.write(key, buf[off:off+8], buf[off+8:off+16], buf[off+16:off+24]); e != nil {
+				return e
+			}
+			records++
+		}
+
+		parsed += int64(len(buf))
+		reporter.scanned(parsed, records)
+	}
+
+	reporter.phase(PhaseFlush)
+	for i, dst := range fidx.shards {
+		if e := dst.writeCompletely(); e != nil {
+			return e
+		}
+		reporter.shardDone(i + 1)
+	}
+
+	fidx.pool.release()
+	reporter.phase(PhaseSort)
+	for i, dst := range fidx.shards {
+		if e := dst.merge(runs[i]); e != nil {
+			return e
+		}
+		reporter.shardDone(i + 1)
+	}
+	return nil
+}
+
+// merge merges the sorted runs of indexShard file which start at runs into a new file,
+// every run is read through a buffer within the budget of the pool, then the new file
+// replaces the indexShard file. More runs than the budget could buffer at once are
+// merged in passes, each one merges the runs by groups into fewer and longer runs.
+func (idx *IndexShard) merge(runs []int64) error {
+	for {
+		fanIn := idx.pool.mergeFanIn(len(runs))
+		merged, e := idx.mergePass(runs, fanIn)
+		if e != nil {
+			return fmt.Errorf("merge index_%d error: %s", idx.shard, e)
+		}
+		if len(merged) <= 1 {
+			return nil
+		}
+		runs = merged
+	}
+}
+
+// mergePass merges every fanIn runs of the indexShard file into one in a new file, which
+// replaces the indexShard file, and returns where the merged runs start
+func (idx *IndexShard) mergePass(runs []int64, fanIn int) ([]int64, error) {
+	fInfo, e := idx.file.Stat()
+	if e != nil {
+		return nil, e
+	}
+
+	size := fInfo.Size()
+	bufSize := idx.pool.mergeBufSize(fanIn + 1)
+	mergedName := idx.fileName + ".merge"
+	merged, e := os.Create(mergedName)
+	if e != nil {
+		return nil, e
+	}
+	w := bufio.NewWriterSize(merged, bufSize)
+
+	// a merged run has the size of its group, so it starts where the group does
+	starts := make([]int64, 0, len(runs)/fanIn+1)
+	for g := 0; g < len(runs); g += fanIn {
+		h := &runHeap{}
+		for i := g; i < g+fanIn && i < len(runs); i++ {
+			end := size
+			if i+1 < len(runs) {
+				end = runs[i+1]
+			}
+			if runs[i] >= end {
+				continue
+			}
+			run := &itemRun{reader: bufio.NewReaderSize(io.NewSectionReader(idx.file, runs[i], end-runs[i]), bufSize)}
+			if e = run.next(); e != nil {
+				break
+			}
+			h.runs = append(h.runs, run)
+		}
+		if e == nil {
+			heap.Init(h)
+			e = idx.writeMerged(h, w)
+		}
+		if e != nil {
+			merged.Close()
+			os.Remove(mergedName)
+			return nil, e
+		}
+		starts = append(starts, runs[g])
+	}
+
+	if e := w.Flush(); e != nil {
+		merged.Close()
+		os.Remove(mergedName)
+		return nil, e
+	}
+	if e := os.Rename(mergedName, idx.fileName); e != nil {
+		merged.Close()
+		os.Remove(mergedName)
+		return nil, e
+	}
+	idx.file.Close()
+	idx.file = merged
+	return starts, nil
+}
+
+// writeMerged writes the index items of the runs in h into w in sorted order
+func (idx *IndexShard) writeMerged(h *runHeap, w *bufio.Writer) error {
+	for h.Len() > 0 {
+		run := h.runs[0]
+		if _, e := w.Write(run.item[:]); e != nil {
+			return e
+		}
+		if e := run.next(); e == io.EOF {
+			heap.Pop(h)
+		} else if e != nil {
+			return e
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return nil
+}
+
+// itemRun is a sorted run of index items, item is the next one
+type itemRun struct {
+	reader *bufio.Reader
+	item   [fixIndexItemSize]byte
+}
+
+// next reads the next index item of the run, it returns io.EOF after the last one
+func (r *itemRun) next() error {
+	_, e := io.ReadFull(r.reader, r.item[:])
+	return e
+}
+
+// runHeap orders runs by their next index item, as itemBytes does
+type runHeap struct {
+	runs []*itemRun
+}
+
+func (h *runHeap) Len() int {
+	return len(h.runs)
+}
+
+func (h *runHeap) Less(i, j int) bool {
+	return lessItem(h.runs[i].item[:], h.runs[j].item[:])
+}
+
+func (h *runHeap) Swap(i, j int) {
+	h.runs[i], h.runs[j] = h.runs[j], h.runs[i]
+}
+
+func (h *runHeap) Push(x interface{}) {
+	h.runs = append(h.runs, x.(*itemRun))
+}
+
+func (h *runHeap) Pop() interface{} {
+	last := h.runs[len(h.runs)-1]
+	h.runs = h.runs[:len(h.runs)-1]
+	return last
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+)
+
+func Test_fast_index_reshard(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	dataPath := dir + "/data/data.d"
+	gen := &DataFileGen{
+		maxKey:         1 << 12,
+		maxValueLength: 32,
+		writeBufSize:   int(4 * KB),
+		maxSize:        256 * KB,
+		path:           dataPath,
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+
+	buildTestIndex(t, dir+"/index", 8, dataPath, int(16*KB))
+
+	// a resharded index is the same as the one built from the data file
+	expected := newTestIndex(t, dir+"/expected", 5)
+	expected.SetSharder(HashSharder{})
+	if e := expected.Build(dataPath, int(16*KB)); e != nil {
+		t.Fatal(e)
+	}
+
+	src := openTestIndex(t, dir+"/index", 8)
+	defer src.Close()
+	fidx := newTestIndex(t, dir+"/reshard", 5)
+	fidx.SetSharder(HashSharder{})
+	if e := fidx.Reshard(src); e != nil {
+		t.Fatal(e)
+	}
+
+	for i := 0; i < 5; i++ {
+		name := "/index_" + strconv.Itoa(i) + ".idx"
+		idx, _ := ioutil.ReadFile(dir + "/reshard" + name)
+		exp, _ := ioutil.ReadFile(dir + "/expected" + name)
+		if len(exp) == 0 || !bytes.Equal(idx, exp) {
+			t.Fatalf("index shard %d differs from the built one", i)
+		}
+	}
+}
+
+func Test_db_reshard(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	keys := []int64{}
+	values := []string{}
+	for k := int64(0); k < 100; k++ {
+		keys = append(keys, k*7)
+		values = append(values, strconv.FormatInt(k, 10))
+	}
+	writeRecords(t, dir+"/data/data.d", keys, values)
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+
+	// a failed reshard keeps the sharding of db with the old index
+	m, _ := readManifest(dir + "/index")
+	broken := *m
+	broken.Generations = []int{99}
+	broken.write(dir + "/index")
+	if e := db.Reshard(7, HashSharder{}); e == nil {
+		t.Fatal("expected an error for a missing generation")
+	}
+	if db.indexShardNum != 4 || db.sharder.Name() != (ModSharder{}).Name() {
+		t.Errorf("%d shards by %s, expected 4 by mod", db.indexShardNum, db.sharder.Name())
+	}
+	m.write(dir + "/index")
+
+	if e := db.Reshard(7, HashSharder{}); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := os.Stat(dir + "/index.old"); !os.IsNotExist(e) {
+		t.Errorf("old index is left")
+	}
+	if db.indexShardNum != 7 || db.sharder.Name() != "hash" {
+		t.Errorf("%d shards by %s, expected 7 by hash", db.indexShardNum, db.sharder.Name())
+	}
+
+	// the sharding is read from the manifest
+	db.Close()
+	db = OpenDB(dir)
+	db.InitFind()
+	if db.indexShardNum != 7 || db.sharder.Name() != "hash" {
+		t.Fatalf("opened %d shards by %s, expected 7 by hash", db.indexShardNum, db.sharder.Name())
+	}
+	for i, k := range keys {
+		if found := db.Find(k); found != values[i] {
+			t.Errorf("key:%d, v:%s, expected %s", k, found, values[i])
+		}
+	}
+}
+
+func Test_hash_sharder(t *testing.T) {
+	// keys of multiples of the shard count all go to shard 0 by mod, but not by hash
+	counts := make([]int, 8)
+	for k := int64(0); k < 8000; k += 8 {
+		counts[HashSharder{}.Shard(k, 8)]++
+		if shard := (ModSharder{}).Shard(k, 8); shard != 0 {
+			t.Fatalf("mod sharded key %d into %d", k, shard)
+		}
+	}
+	for shard, cnt := range counts {
+		if cnt == 0 {
+			t.Errorf("no key in shard %d", shard)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package db
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The index shards, the generations and the memtable are sorted by key each, so the keys
+// of db are walked in key order by merging them. Scan reads the values of a key range this
+// way, which is a sequential read of a data file sorted by SortData.
+
+// ScanFunc is called with every k-v pair of Scan in key order, value is only valid in the
+// call. Scan stops if it returns false.
+type ScanFunc func(key int64, value []byte) bool
+
+// Scan calls fn with the k-v pairs of the keys in [from, to) in key order, to <= 0 means
+// no end. The deleted and the expired ones are left out. The writers wait until it's
+// completed, so fn must not write db.
+func (db *DB) Scan(from int64, to int64, fn ScanFunc) error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if e := db.checkOpen(); e != nil {
+		return e
+	}
+	// the generations won't change while scanning
+	db.mergeWG.Wait()
+
+	stop := errors.New("stop")
+	e := db.forEachKey(from, to, func(key int64, vsize int64, vpos int64) error {
+		value, e := db.readValue(key, vsize, vpos)
+		if e == ErrNotFound {
+			return nil
+		} else if e != nil {
+			return fmt.Errorf("key %d: %s", key, e)
+		}
+		if !fn(key, value) {
+			return stop
+		}
+		return nil
+	})
+	if e == stop {
+		return nil
+	}
+	return e
+}
+
+// forEachKey merges the sorted index items of the index shards, the generations and the
+// memtable, and calls fn with the item found for every key in [from, to), to <= 0 means
+// no end. The deleted keys are left out.
+func (db *DB) forEachKey(from int64, to int64, fn func(key int64, vsize int64, vpos int64) error) error {
+	cursors := make(itemCursors, 0, db.fidx.shardNum)
+	add := func(items []byte) {
+		c := &itemCursor{items: items}
+		c.seek(from)
+		if c.valid() {
+			cursors = append(cursors, c)
+		}
+	}
+	for _, idx := range db.fidx.shards {
+		if e := idx.mmap(); e != nil {
+			return e
+		}
+		add(idx.dataRef)
+	}
+	for _, gen := range db.fidx.generations() {
+		for _, idx := range gen.shards {
+			add(idx.dataRef)
+		}
+	}
+	add(sortedItems(db.memtable.snapshot()))
+	heap.Init(&cursors)
+
+	last := int64(-1)
+	for len(cursors) > 0 {
+		c := cursors[0]
+		key := c.key()
+		if c.next(); c.valid() {
+			heap.Fix(&cursors, 0)
+		} else {
+			heap.Pop(&cursors)
+		}
+		if key == last {
+			continue
+		}
+		last = key
+		if to > 0 && key >= to {
+			break
+		}
+
+		vsize, vpos := db.find(key)
+		if vsize < 0 {
+			continue
+		}
+		if segment, _ := unpackValuePos(vpos); segment >= len(db.dataFiles) {
+			return fmt.Errorf("key %d: invalid value position of segment %d", key, segment)
+		}
+		if e := fn(key, vsize, vpos); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// sortedItems encodes items as the index items of an index shard, sorted by key
+func sortedItems(items []indexItem) []byte {
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].key < items[j].key
+	})
+	buf := make([]byte, len(items)*fixIndexItemSize)
+	for i, item := range items {
+		off := i * fixIndexItemSize
+		binary.BigEndian.PutUint64(buf[off:off+8], uint64(item.key))
+		binary.BigEndian.PutUint64(buf[off+8:off+16], uint64(item.vsz))
+		binary.BigEndian.PutUint64(buf[off+16:off+24], uint64(item.vpos))
+	}
+	return buf
+}
+
+// itemCursor walks the sorted index items of an index shard
+type itemCursor struct {
+	items []byte
+	off   int
+}
+
+func (c *itemCursor) valid() bool {
+	return c.off+fixIndexItemSize <= len(c.items)
+}
+
+func (c *itemCursor) key() int64 {
+	return int64(binary.BigEndian.Uint64(c.items[c.off : c.off+8]))
+}
+
+func (c *itemCursor) next() {
+	c.off += fixIndexItemSize
+}
+
+// seek moves to the first item of a key not less than key
+func (c *itemCursor) seek(key int64) {
+	n := len(c.items) / fixIndexItemSize
+	c.off = sort.Search(n, func(i int) bool {
+		return int64(binary.BigEndian.Uint64(c.items[i*fixIndexItemSize:])) >= key
+	}) * fixIndexItemSize
+}
+
+// itemCursors is a min-heap of cursors by their keys
+type itemCursors []*itemCursor
+
+func (h itemCursors) Len() int {
+	return len(h)
+}
+
+func (h itemCursors) Less(i, j int) bool {
+	return h[i].key() < h[j].key()
+}
+
+func (h itemCursors) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+}
+
+func (h *itemCursors) Push(x interface{}) {
+	*h = append(*h, x.(*itemCursor))
+}
+
+func (h *itemCursors) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
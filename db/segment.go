@@ -0,0 +1,113 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// A dataset could be made of many data files, which are called segments, such as
+// files rotated at a size limit or emitted hourly by producers. Every segment is a
+// data file with the same format, and has an ID which is its position in the
+// manifest of the index.
+//
+// The segment ID is saved in the high 16 bits of an index item's value_position,
+// so each index item still has 24 bytes, and the low 48 bits are the offset in
+// the segment. An index built before segments existed refers to segment 0.
+
+const (
+	segmentExt        = ".d"
+	segmentOffsetBits = 48
+	segmentOffsetMask = 1<<segmentOffsetBits - 1
+	maxSegmentNum     = 1 << (63 - segmentOffsetBits)
+
+	manifestFileName = "MANIFEST"
+	defaultSegment   = "data.d"
+)
+
+func packValuePos(segment int, offset int64) int64 {
+	return int64(segment)<<segmentOffsetBits | offset&segmentOffsetMask
+}
+
+func unpackValuePos(valuePos int64) (int, int64) {
+	return int(valuePos >> segmentOffsetBits), valuePos & segmentOffsetMask
+}
+
+// segmentPath returns the path of the n-th segment for a data file rotated by DataFileGen,
+// the first one is the data file itself.
+func segmentPath(dataPath string, n int) string {
+	if n == 0 {
+		return dataPath
+	}
+	return fmt.Sprintf("%s_%04d%s", strings.TrimSuffix(dataPath, segmentExt), n, segmentExt)
+}
+
+// listSegments returns the names of all segments in dataDir, ordered by name
+func listSegments(dataDir string) ([]string, error) {
+	infos, e := ioutil.ReadDir(dataDir)
+	if e != nil {
+		return nil, e
+	}
+
+	segments := []string{}
+	for _, info := range infos {
+		if !info.IsDir() && filepath.Ext(info.Name()) == segmentExt {
+			segments = append(segments, info.Name())
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// manifest records which segments an index was built from, in the order of their IDs,
+// and how the index is sharded
+type manifest struct {
+	Segments []string `json:"segments"`
+	// Sizes are the sizes of segments when they were indexed, k-v pairs appended later
+	// by Put are replayed from there
+	Sizes    []int64 `json:"sizes,omitempty"`
+	ShardNum int     `json:"shardNum,omitempty"`
+	Sharder  string  `json:"sharder,omitempty"`
+	// Generations are the ids of generations flushed from the memtable, newest last
+	Generations []int `json:"generations,omitempty"`
+	// KeyIDs are the IDs of the keys encrypting the segments, "" for a plaintext one
+	KeyIDs []string `json:"keyIDs,omitempty"`
+}
+
+// readManifest reads the manifest in indexDir. An index without manifest was built
+// from the single data.d file.
+func readManifest(indexDir string) (*manifest, error) {
+	data, e := ioutil.ReadFile(filepath.Join(indexDir, manifestFileName))
+	if os.IsNotExist(e) {
+		return &manifest{Segments: []string{defaultSegment}}, nil
+	} else if e != nil {
+		return nil, e
+	}
+
+	m := &manifest{}
+	if e := json.Unmarshal(data, m); e != nil {
+		return nil, e
+	}
+	return m, nil
+}
+
+// write saves the manifest into indexDir, replacing the old one atomically
+func (m *manifest) write(indexDir string) error {
+	data, e := json.MarshalIndent(m, "", "  ")
+	if e != nil {
+		return e
+	}
+
+	if e := createDirIfNotExist(indexDir); e != nil {
+		return e
+	}
+	tmp := filepath.Join(indexDir, manifestFileName+".tmp")
+	if e := ioutil.WriteFile(tmp, data, 0644); e != nil {
+		return e
+	}
+	return os.Rename(tmp, filepath.Join(indexDir, manifestFileName))
+}
@@ -0,0 +1,140 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeRecords writes k-v pairs into a data file, values[i] is the value of keys[i]
+func writeRecords(t *testing.T, path string, keys []int64, values []string) {
+	createDirIfNotExist(filepath.Dir(path))
+	if e := ioutil.WriteFile(path, encodeRecords(keys, values), 0644); e != nil {
+		t.Fatal(e)
+	}
+}
+
+// encodeRecords encodes k-v pairs in the data file format
+func encodeRecords(keys []int64, values []string) []byte {
+	buf := bytes.NewBuffer([]byte{})
+	_buf := make([]byte, 8)
+	for i, key := range keys {
+		binary.BigEndian.PutUint64(_buf, 8)
+		buf.Write(_buf)
+		binary.BigEndian.PutUint64(_buf, uint64(key))
+		buf.Write(_buf)
+		binary.BigEndian.PutUint64(_buf, uint64(len(values[i])))
+		buf.Write(_buf)
+		buf.WriteString(values[i])
+	}
+	return buf.Bytes()
+}
+
+func Test_pack_value_pos(t *testing.T) {
+	cases := []struct {
+		segment int
+		offset  int64
+	}{{0, 0}, {0, 24}, {1, 1 << 40}, {maxSegmentNum - 1, segmentOffsetMask}}
+
+	for _, c := range cases {
+		segment, offset := unpackValuePos(packValuePos(c.segment, c.offset))
+		if segment != c.segment || offset != c.offset {
+			t.Errorf("unpack got %d:%d, expected %d:%d", segment, offset, c.segment, c.offset)
+		}
+	}
+
+	// an index built before segments existed refers to segment 0
+	if segment, offset := unpackValuePos(1024); segment != 0 || offset != 1024 {
+		t.Errorf("unpack got %d:%d, expected 0:1024", segment, offset)
+	}
+}
+
+func Test_data_file_gen_rotate(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	gen := &DataFileGen{
+		maxKey:         1 << 20,
+		maxValueLength: 64,
+		writeBufSize:   int(4 * KB),
+		maxSize:        64 * KB,
+		maxSegmentSize: 16 * KB,
+		path:           dir + "/data.d",
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+
+	segments, e := listSegments(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(segments) != 4 || segments[0] != "data.d" || segments[1] != "data_0001.d" {
+		t.Fatalf("segments: %v", segments)
+	}
+}
+
+func Test_db_multi_segments(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/2026101900.d", []int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	writeRecords(t, dir+"/data/2026101901.d", []int64{11, 12}, []string{"dddd", "eeeee"})
+	writeRecords(t, dir+"/data/2026101902.d", []int64{21}, []string{"ffffff"})
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+
+	if len(db.dataFiles) != 3 {
+		t.Fatalf("%d segments opened, expected 3", len(db.dataFiles))
+	}
+
+	expected := map[int64]string{1: "a", 2: "bb", 3: "ccc", 11: "dddd", 12: "eeeee", 21: "ffffff"}
+	for k, v := range expected {
+		if found := db.Find(k); found != v {
+			t.Errorf("key:%d, v:%s, expected %s", k, found, v)
+		}
+	}
+	if found := db.Find(5); found != "error" {
+		t.Errorf("key:5 not exists, but found %s", found)
+	}
+
+	// segment IDs depend on the manifest, not on files added later
+	writeRecords(t, dir+"/data/2026101800.d", []int64{31}, []string{"g"})
+	db.Close()
+	db = OpenDB(dir)
+	db.indexShardNum = 4
+	db.InitFind()
+	if found := db.Find(21); found != "ffffff" {
+		t.Errorf("key:21, v:%s, expected ffffff", found)
+	}
+}
+
+func Test_read_manifest_without_file(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	m, e := readManifest(dir)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(m.Segments) != 1 || m.Segments[0] != defaultSegment {
+		t.Errorf("segments: %v, expected only %s", m.Segments, defaultSegment)
+	}
+
+	m = &manifest{Segments: []string{"a.d", "b.d"}}
+	if e := m.write(dir); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := os.Stat(filepath.Join(dir, manifestFileName+".tmp")); !os.IsNotExist(e) {
+		t.Errorf("tmp manifest is left")
+	}
+	if m, _ = readManifest(dir); len(m.Segments) != 2 || m.Segments[1] != "b.d" {
+		t.Errorf("segments: %v", m.Segments)
+	}
+}
@@ -0,0 +1,162 @@
+package db
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+)
+
+// segmentWriter writes k-v pairs into a data file of a format, rotated into segments of
+// at most maxSegmentSize bytes named by segmentPath. The values of an encrypted format are
+// sealed by the keys.
+type segmentWriter struct {
+	path           string
+	format         dataFormat
+	maxSegmentSize int64
+	keys           KeyProvider
+
+	file   *os.File
+	writer *bufio.Writer
+	blocks *blockWriter
+	cipher *valueCipher
+	offset int64
+	total  int64
+
+	// names and sizes of the written segments
+	segments []string
+	sizes    []int64
+}
+
+// writeRecord writes a k-v pair in the format of w, and returns the segment and the
+// value_position of its value in the segment. The value of an encrypted format is sealed
+// when it's written, so it's not sealed in record.
+func (w *segmentWriter) writeRecord(record []byte) (int, int64, error) {
+	size := w.offset
+	if w.blocks != nil {
+		size = w.blocks.size()
+	}
+	recordSize := int64(len(record))
+	if w.format.encrypted() {
+		recordSize += sealOverhead
+	}
+	rotate := w.maxSegmentSize > 0 && size > w.format.headerSize && size+recordSize > w.maxSegmentSize
+	// the block numbers of a segment are limited by value_position
+	if w.blocks != nil && w.blocks.full() {
+		rotate = true
+	}
+	if w.file == nil || rotate {
+		if e := w.nextSegment(); e != nil {
+			return 0, 0, e
+		}
+	}
+
+	segment := len(w.segments) - 1
+	if w.cipher != nil {
+		pos := w.offset + 24
+		if w.blocks != nil {
+			pos = w.blocks.nextPos()
+		}
+		record = w.cipher.sealRecord(record, w.format, pos)
+	}
+	if w.blocks != nil {
+		pos, e := w.blocks.add(record)
+		return segment, pos, e
+	}
+	pos := w.offset + 24
+	_, e := w.Write(record)
+	return segment, pos, e
+}
+
+// valueSize returns the value_size written for a value of valueSize, which grows when
+// the value is sealed
+func (w *segmentWriter) valueSize(valueSize int64) int64 {
+	if w.format.encrypted() && valueSize >= 0 {
+		return valueSize + sealOverhead
+	}
+	return valueSize
+}
+
+// nextSegment closes the current segment and creates the next one
+func (w *segmentWriter) nextSegment() error {
+	if e := w.closeSegment(); e != nil {
+		return e
+	}
+
+	path := segmentPath(w.path, len(w.segments))
+	if e := createDirIfNotExist(filepath.Dir(path)); e != nil {
+		return e
+	}
+	f, e := os.Create(path)
+	if e != nil {
+		return e
+	}
+	w.file = f
+	w.writer = bufio.NewWriterSize(f, int(MB))
+	// every encrypted segment has its own salt
+	if w.format.encrypted() {
+		if w.format, e = w.format.withSalt(); e != nil {
+			return e
+		}
+		if w.cipher, e = newValueCipher(w.format, w.keys); e != nil {
+			return e
+		}
+	}
+	w.offset = 0
+	w.segments = append(w.segments, filepath.Base(path))
+	w.sizes = append(w.sizes, 0)
+	if _, e := w.Write(w.format.encodeHeader()); e != nil {
+		return e
+	}
+
+	if w.format.blocked() {
+		if w.blocks, e = newBlockWriter(w, w.format.codec, w.offset); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// appendableSegment closes the current segment and creates an empty one without blocks,
+// so the data file could be appended after the segments of blocks
+func (w *segmentWriter) appendableSegment() error {
+	w.format = w.format.withBlocks(codecNone)
+	return w.nextSegment()
+}
+
+// Write writes bytes into the current segment
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	n, e := w.writer.Write(p)
+	w.offset += int64(n)
+	w.total += int64(n)
+	w.sizes[len(w.sizes)-1] = w.offset
+	return n, e
+}
+
+func (w *segmentWriter) closeSegment() error {
+	if w.file == nil {
+		return nil
+	}
+	var e error
+	if w.blocks != nil {
+		e = w.blocks.close()
+		w.blocks = nil
+	}
+	if e2 := w.writer.Flush(); e == nil {
+		e = e2
+	}
+	if e2 := w.file.Close(); e == nil {
+		e = e2
+	}
+	w.file = nil
+	return e
+}
+
+// close closes the last segment, an empty data file is created if nothing is written
+func (w *segmentWriter) close() error {
+	if w.file == nil && len(w.segments) == 0 {
+		if e := w.nextSegment(); e != nil {
+			return e
+		}
+	}
+	return w.closeSegment()
+}
@@ -0,0 +1,48 @@
+package db
+
+// A Sharder decides which indexShard an index item belongs to by its key. The default
+// ModSharder shards by key % shardNum, which is fine for random keys. HashSharder mixes
+// the key before, so keys with a pattern, such as multiples of the shard count, still
+// spread over all shards. The sharder of an index is saved in its manifest.
+
+type Sharder interface {
+	Name() string
+	Shard(key int64, shardNum int) int
+}
+
+type ModSharder struct{}
+
+func (ModSharder) Name() string {
+	return "mod"
+}
+
+func (ModSharder) Shard(key int64, shardNum int) int {
+	return int(key % int64(shardNum))
+}
+
+type HashSharder struct{}
+
+func (HashSharder) Name() string {
+	return "hash"
+}
+
+// Shard mixes the key with the finalizer of murmur3
+func (HashSharder) Shard(key int64, shardNum int) int {
+	h := uint64(key)
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return int(h % uint64(shardNum))
+}
+
+// SharderByName returns the Sharder named mod or hash, an empty name is the default one
+func SharderByName(name string) (Sharder, bool) {
+	if name == "" || name == (ModSharder{}).Name() {
+		return ModSharder{}, true
+	} else if name == (HashSharder{}).Name() {
+		return HashSharder{}, true
+	}
+	return nil, false
+}
@@ -0,0 +1,328 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// A snapshot is the data files and the index opened by InitFind or Reload. A reader holds
+// a reference of it while finding, so Reload swaps in a new one without waiting for the
+// readers, and the old one is closed when the last reader releases it. The writers and
+// Reload are serialized by writeMu.
+type snapshot struct {
+	db *DB
+
+	// one handle per segment, indexed by segment ID, and its format
+	dataFiles    []*os.File
+	formats      []dataFormat
+	blockIndexes [][]int64
+	ciphers      []*valueCipher
+	// blockCache caches the decompressed blocks of dataFiles
+	blockCache *blockCache
+	fidx       *FastIndex
+	// memtable overlays fidx with the k-v pairs appended by Put to the last segment
+	memtable *memtable
+	// m is the manifest of fidx, and published is the manifest file it's read from or
+	// written to, to tell one published by others. They're guarded by manifestMu.
+	m         *manifest
+	published os.FileInfo
+
+	// refs is the number of readers holding it, plus one of db until it's swapped out.
+	// done is closed when it's closed, with the first error of closing it.
+	refs int64
+	done chan struct{}
+	err  error
+}
+
+// openSnapshot opens the data files and the index published last, and replays the k-v pairs
+// appended after the index was built. It returns the size of the last segment to append to.
+func (db *DB) openSnapshot() (*snapshot, int64, error) {
+	if e := db.recover(); e != nil {
+		return nil, 0, e
+	}
+	release, e := db.holdLock(LockShared, "open", false)
+	if e != nil {
+		return nil, 0, e
+	}
+	defer release()
+
+	published, e := os.Stat(filepath.Join(db.indexFileDir, manifestFileName))
+	if e != nil && !os.IsNotExist(e) {
+		return nil, 0, e
+	}
+	m, e := readManifest(db.indexFileDir)
+	if e != nil {
+		return nil, 0, e
+	}
+
+	s := &snapshot{db: db, m: m, published: published, refs: 1, done: make(chan struct{})}
+	size, e := s.open()
+	if e != nil {
+		s.close()
+		return nil, 0, e
+	}
+	return s, size, nil
+}
+
+func (s *snapshot) open() (int64, error) {
+	db, m := s.db, s.m
+	s.dataFiles = make([]*os.File, 0, len(m.Segments))
+	s.formats = make([]dataFormat, len(m.Segments))
+	s.blockIndexes = make([][]int64, len(m.Segments))
+	s.ciphers = make([]*valueCipher, len(m.Segments))
+	for i, segment := range m.Segments {
+		df, e := os.Open(filepath.Join(db.dataFileDir, segment))
+		if e != nil {
+			return 0, e
+		}
+		s.dataFiles = append(s.dataFiles, df)
+		if s.formats[i], e = readDataFormat(df); e != nil {
+			return 0, fmt.Errorf("segment %s: %s", segment, e)
+		}
+		if s.formats[i].blocked() {
+			dfInfo, e := df.Stat()
+			if e != nil {
+				return 0, e
+			}
+			if s.blockIndexes[i], e = readBlockIndex(df, s.formats[i], dfInfo.Size()); e != nil {
+				return 0, fmt.Errorf("segment %s: %s", segment, e)
+			}
+		}
+		if len(m.KeyIDs) == len(m.Segments) && m.KeyIDs[i] != s.formats[i].keyID {
+			return 0, fmt.Errorf("segment %s: encrypted by key %q, but %q in manifest", segment, s.formats[i].keyID, m.KeyIDs[i])
+		}
+		// without a KeyProvider, the encrypted values can't be read by Get
+		if s.ciphers[i], e = newValueCipher(s.formats[i], db.keys); e != nil && e != errNoKeyProvider {
+			return 0, fmt.Errorf("segment %s: %s", segment, e)
+		}
+	}
+	s.blockCache = newBlockCache(db.blockCacheSize)
+
+	if e := db.applyManifest(m); e != nil {
+		return 0, e
+	}
+	fidx, e := OpenFastIndex(db.indexFileDir, db.indexShardNum)
+	if e != nil {
+		return 0, e
+	}
+	s.fidx = fidx
+	s.fidx.SetSharder(db.sharder)
+	s.fidx.SetCorruptPolicy(db.corruptPolicy, db.maxValueSize)
+	if e := db.openGenerations(s.fidx, m); e != nil {
+		return 0, e
+	}
+
+	// replay the k-v pairs appended after the index was built
+	s.memtable = newMemtable()
+	var size int64
+	for i, df := range s.dataFiles {
+		dfInfo, e := df.Stat()
+		if e != nil {
+			return 0, e
+		}
+		size = dfInfo.Size()
+		if len(m.Sizes) == len(m.Segments) && size > m.Sizes[i] && !s.formats[i].blocked() {
+			if size, e = s.memtable.replay(df, s.formats[i], i, m.Sizes[i], size, db.valueSizeLimit()); e != nil {
+				return 0, e
+			}
+		}
+	}
+	return size, nil
+}
+
+// close closes the data files and the index, and returns the first error
+func (s *snapshot) close() error {
+	var err error
+	for _, df := range s.dataFiles {
+		if e := df.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	if s.fidx != nil {
+		if e := s.fidx.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// release releases a reference, the last one closes the snapshot
+func (s *snapshot) release() {
+	if atomic.AddInt64(&s.refs, -1) == 0 {
+		s.err = s.close()
+		close(s.done)
+	}
+}
+
+// acquire returns the snapshot with a reference held, which must be released when the
+// reader is done, or ErrClosed if db is closed
+func (db *DB) acquire() (*snapshot, error) {
+	db.openMu.RLock()
+	defer db.openMu.RUnlock()
+	if e := db.checkOpen(); e != nil {
+		return nil, e
+	}
+	atomic.AddInt64(&db.snapshot.refs, 1)
+	return db.snapshot, nil
+}
+
+// checkOpen returns ErrClosed if db is closed, or an error if it isn't opened yet
+func (db *DB) checkOpen() error {
+	if db.closed {
+		return ErrClosed
+	}
+	if db.snapshot == nil {
+		return errNotOpened
+	}
+	return nil
+}
+
+// swap swaps in s for the readers, db is closed if s is nil. It's called with writeMu held,
+// and returns the old snapshot to release.
+func (db *DB) swap(s *snapshot) *snapshot {
+	db.openMu.Lock()
+	defer db.openMu.Unlock()
+	old := db.snapshot
+	db.snapshot = s
+	db.closed = s == nil
+	return old
+}
+
+// closeWriter closes the file Put appends to, it's opened again by the next Put
+func (db *DB) closeWriter() error {
+	if db.writer == nil {
+		return nil
+	}
+	e := db.writer.Close()
+	db.writer = nil
+	return e
+}
+
+// InitFind opens the data files and the index to find, like Reload
+func (db *DB) InitFind() error {
+	return db.Reload()
+}
+
+// Reload opens the data files and the index published last, after the writers and the
+// background merge are done, and swaps them in atomically. The readers finding in the ones
+// opened before keep them until they're done, then they're closed. If it fails, the ones
+// opened before are kept. It also opens db again after Close.
+func (db *DB) Reload() error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	db.mergeWG.Wait()
+	return db.reload()
+}
+
+// reload is called with writeMu held, and the background merge done
+func (db *DB) reload() error {
+	s, size, e := db.openSnapshot()
+	if e != nil {
+		return e
+	}
+	if e := db.closeWriter(); e != nil {
+		s.close()
+		return e
+	}
+	db.writeOff = size
+	if old := db.swap(s); old != nil {
+		old.release()
+	}
+	return nil
+}
+
+// Close closes the data files and the index after the writers, the background merge and
+// the finding goroutines are done, stops Watch and releases the LOCK file. Using db after
+// Close returns ErrClosed, until it's opened again by InitFind or Reload.
+func (db *DB) Close() error {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if db.stopWatch != nil {
+		close(db.stopWatch)
+		db.stopWatch = nil
+	}
+	db.mergeWG.Wait()
+
+	if e := db.checkOpen(); e != nil {
+		return e
+	}
+	err := db.closeWriter()
+	old := db.swap(nil)
+	old.release()
+	<-old.done
+	if err == nil {
+		err = old.err
+	}
+	if e := db.Unlock(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// Watch polls the manifest of the index every interval, and reloads db when a new index is
+// published, by CreateIndex, Compact or another process. fn is called with the error of
+// every reload, it could be nil. It's stopped by Close.
+func (db *DB) Watch(interval time.Duration, fn func(e error)) {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if db.stopWatch != nil {
+		close(db.stopWatch)
+	}
+	stop := make(chan struct{})
+	db.stopWatch = stop
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+			if !db.newlyPublished() {
+				continue
+			}
+			stopped, e := db.reloadWatched(stop)
+			if stopped {
+				return
+			}
+			if fn != nil {
+				fn(e)
+			}
+		}
+	}()
+}
+
+// reloadWatched reloads db unless Watch is stopped, so a closed db isn't opened again
+func (db *DB) reloadWatched(stop chan struct{}) (bool, error) {
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	select {
+	case <-stop:
+		return true, nil
+	default:
+	}
+	db.mergeWG.Wait()
+	return false, db.reload()
+}
+
+// newlyPublished tells whether a manifest is published after the one of the snapshot
+func (db *DB) newlyPublished() bool {
+	info, e := os.Stat(filepath.Join(db.indexFileDir, manifestFileName))
+	if e != nil {
+		return false
+	}
+	db.openMu.RLock()
+	defer db.openMu.RUnlock()
+	if db.snapshot == nil {
+		return false
+	}
+	db.manifestMu.Lock()
+	last := db.snapshot.published
+	db.manifestMu.Unlock()
+	return last == nil || !os.SameFile(info, last) || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size()
+}
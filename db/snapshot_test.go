@@ -0,0 +1,138 @@
+package db
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_reload(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2}, []string{"a", "bb"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+
+	// a reader finding in the snapshot while another one publishes a new index
+	old, e := db.acquire()
+	if e != nil {
+		t.Fatal(e)
+	}
+	other := OpenDB(dir)
+	other.InitFind()
+	other.Put(3, []byte("ccc"))
+	other.Close()
+	other.CreateIndex()
+
+	if e := db.Reload(); e != nil {
+		t.Fatal(e)
+	}
+	if v, e := db.Get(3); e != nil || string(v) != "ccc" {
+		t.Errorf("reloaded v:%s, e:%v, expected ccc", v, e)
+	}
+
+	// the old snapshot is kept until it's released
+	if vsize, _ := old.find(3); vsize != -1 {
+		t.Errorf("vsize:%d, expected key 3 not in the old snapshot", vsize)
+	}
+	vsize, vpos := old.find(2)
+	if v, e := old.readValue(2, vsize, vpos); e != nil || string(v) != "bb" {
+		t.Errorf("old v:%s, e:%v, expected bb", v, e)
+	}
+	old.release()
+	<-old.done
+	if vsize, _ := old.fidx.Find(2); vsize != -1 {
+		t.Errorf("vsize:%d, expected the old snapshot closed", vsize)
+	}
+
+	// the finding goroutines don't wait for reloading
+	stop := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if v, e := db.Get(1); e != nil || string(v) != "a" {
+					t.Errorf("v:%s, e:%v, expected a", v, e)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		if e := db.Reload(); e != nil {
+			t.Fatal(e)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if e := db.Close(); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Reload(); e != nil {
+		t.Fatal(e)
+	}
+	if v, e := db.Get(2); e != nil || string(v) != "bb" {
+		t.Errorf("reopened v:%s, e:%v, expected bb", v, e)
+	}
+}
+
+func Test_watch(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1}, []string{"a"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	reloaded := make(chan error, 10)
+	db.Watch(10*time.Millisecond, func(e error) {
+		reloaded <- e
+	})
+
+	other := OpenDB(dir)
+	other.InitFind()
+	other.Put(2, []byte("bb"))
+	other.Close()
+	other.CreateIndex()
+
+	// a reload while the index is being built fails on the LOCK file, and it's retried
+	for done := false; !done; {
+		select {
+		case e := <-reloaded:
+			if _, locked := e.(*LockError); e != nil && !locked {
+				t.Fatal(e)
+			}
+			done = e == nil
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the new index reloaded")
+		}
+	}
+	if v, e := db.Get(2); e != nil || string(v) != "bb" {
+		t.Errorf("v:%s, e:%v, expected bb", v, e)
+	}
+
+	// a closed db isn't reopened by a new index
+	if e := db.Close(); e != nil {
+		t.Fatal(e)
+	}
+	other.CreateIndex()
+	time.Sleep(50 * time.Millisecond)
+	if _, e := db.Get(1); e != ErrClosed {
+		t.Errorf("e:%v, expected ErrClosed", e)
+	}
+	if len(reloaded) != 0 {
+		t.Errorf("%d reloads, expected none", len(reloaded))
+	}
+}
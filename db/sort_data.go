@@ -0,0 +1,112 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SortData rewrites the live k-v pairs in key order into a data file of blocks, like an
+// SSTable. The k-v pairs of a key range are in adjacent blocks then, so Scan reads the
+// data file sequentially, and finds of adjacent keys share the cached blocks. The blocks
+// are compressed by the codec set by SetBlockCompression, or stored as they are without
+// one. The segments of blocks are immutable, so an empty segment without blocks follows
+// them for Put to append to.
+
+// SortData rewrites the live k-v pairs of db in key order into a new data file with blocks
+// and index, and reopens db on them. The expired k-v pairs are dropped, and Dropped isn't
+// counted. The writers wait until it's completed.
+func (db *DB) SortData() (CompactStats, error) {
+	stats := CompactStats{}
+	db.writeMu.Lock()
+	defer db.writeMu.Unlock()
+	if e := db.checkOpen(); e != nil {
+		return stats, e
+	}
+	release, e := db.lockBuilder("sortData")
+	if e != nil {
+		return stats, e
+	}
+	defer release()
+	if len(db.dataFiles) == 0 {
+		return stats, errors.New("no data file to sort")
+	}
+	// the generations won't change while sorting
+	db.mergeWG.Wait()
+
+	sizes, e := db.openedSizes()
+	if e != nil {
+		return stats, e
+	}
+	for _, size := range sizes {
+		stats.SizeBefore += size
+	}
+	format, e := db.rewriteFormat()
+	if e != nil {
+		return stats, e
+	}
+	if !format.blocked() {
+		format = format.withBlocks(codecStored)
+	}
+	rw, e := db.newRewrite(format)
+	if e != nil {
+		return stats, e
+	}
+	reporter := newProgressReporter(db.buildProgress, stats.SizeBefore, db.indexShardNum)
+	throttle := newThrottle(db.compactionRate)
+
+	keyByte := make([]byte, 8)
+	valuePosByte := make([]byte, 8)
+	valueSizeByte := make([]byte, 8)
+	var parsed, lastReport int64 = 0, 0
+	now := time.Now()
+	e = db.forEachKey(0, 0, func(key int64, vsize int64, vpos int64) error {
+		segment, offset := unpackValuePos(vpos)
+		stored, e := db.readStoredValue(segment, vsize, offset)
+		if e != nil {
+			return fmt.Errorf("key %d: %s", key, e)
+		}
+		parsed += db.formats[segment].recordSize(vsize)
+		if parsed-lastReport >= MB {
+			throttle.wait(parsed)
+			reporter.scanned(parsed, stats.Records)
+			lastReport = parsed
+		}
+
+		value, expiresAt, e := db.openValue(segment, key, offset, stored)
+		if e != nil {
+			return fmt.Errorf("key %d: %s", key, e)
+		}
+		if expired(expiresAt, now) {
+			stats.Expired++
+			return nil
+		}
+		if stored, e = db.storedValue(rw.w.format, value, expiresAt); e != nil {
+			return fmt.Errorf("key %d: %s", key, e)
+		}
+		newSegment, pos, e := rw.w.writeRecord(rw.w.format.encodeRecord(key, int64(len(stored)), stored))
+		if e != nil {
+			return e
+		}
+		binary.BigEndian.PutUint64(keyByte, uint64(key))
+		binary.BigEndian.PutUint64(valueSizeByte, uint64(rw.w.valueSize(int64(len(stored)))))
+		binary.BigEndian.PutUint64(valuePosByte, uint64(packValuePos(newSegment, pos)))
+		if e := rw.fidx.write(key, keyByte, valueSizeByte, valuePosByte); e != nil {
+			return e
+		}
+		stats.Records++
+		return nil
+	})
+	if e != nil {
+		rw.abort()
+		return stats, e
+	}
+	reporter.scanned(stats.SizeBefore, stats.Records)
+	if e := rw.w.appendableSegment(); e != nil {
+		rw.abort()
+		return stats, e
+	}
+	stats.SizeAfter, e = rw.replace(reporter)
+	return stats, e
+}
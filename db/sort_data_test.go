@@ -0,0 +1,136 @@
+package db
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_sort_data(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	keys := []int64{42, 7, 19, 3, 88, 7, 61, 25}
+	values := []string{"42", "old 7", "19", "3", "88", "7", "61", "25"}
+	writeRecords(t, dir+"/data/data.d", keys, values)
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.SetMaxSegmentSize(256)
+	db.CreateIndex()
+	db.InitFind()
+	db.Delete(19)
+	db.Put(50, []byte("50"))
+
+	stats, e := db.SortData()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if stats.Records != 7 {
+		t.Errorf("stats:%+v, expected 7 records", stats)
+	}
+	expected := map[int64]string{3: "3", 7: "7", 25: "25", 42: "42", 50: "50", 61: "61", 88: "88"}
+	for k, v := range expected {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+	if _, e := db.Get(19); e != ErrNotFound {
+		t.Errorf("e:%v, expected the deleted key not found", e)
+	}
+
+	// the data file is in key order, and has blocks
+	sorted := make([]int64, 0)
+	last := len(db.dataFiles) - 1
+	for i, df := range db.dataFiles {
+		if i < last && (!db.formats[i].blocked() || db.formats[i].codec != codecStored) {
+			t.Fatalf("format:%+v, expected blocks stored as they are", db.formats[i])
+		}
+		// but the last one, which is empty to append to
+		if i == last && (db.formats[i].blocked() || db.writeOff != db.formats[i].headerSize) {
+			t.Fatalf("format:%+v, size %d, expected an empty segment without blocks", db.formats[i], db.writeOff)
+		}
+		info, _ := df.Stat()
+		forEachRecord(df, db.formats[i], i, info.Size(), 0, func(record []byte, valuePos int64, read int64) error {
+			sorted = append(sorted, int64(binary.BigEndian.Uint64(record[8:16])))
+			return nil
+		}, nil)
+	}
+	if fmt.Sprint(sorted) != "[3 7 25 42 50 61 88]" {
+		t.Errorf("keys:%v, expected in key order", sorted)
+	}
+	if e := db.Put(1, []byte("1")); e != nil {
+		t.Fatal(e)
+	}
+
+	// the sorted dataset is reopened from its manifest
+	db.Close()
+	db = OpenDB(dir)
+	db.InitFind()
+	for k, v := range map[int64]string{1: "1", 61: "61"} {
+		if found, e := db.Get(k); e != nil || string(found) != v {
+			t.Errorf("reopened key:%d, v:%s, e:%v, expected %s", k, found, e, v)
+		}
+	}
+
+	// or compressed by the codec set
+	db.SetBlockCompression("flate")
+	if _, e := db.SortData(); e != nil {
+		t.Fatal(e)
+	}
+	if db.formats[0].codec != codecFlate || db.formats[len(db.formats)-1].blocked() {
+		t.Errorf("formats:%+v, expected flate blocks and the last segment without", db.formats)
+	}
+	if found, e := db.Get(1); e != nil || string(found) != "1" {
+		t.Errorf("v:%s, e:%v, expected 1", found, e)
+	}
+}
+
+func Test_scan(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{9, 2, 5, 7, 1}, []string{"9", "2", "5", "7", "1"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	scan := func(from int64, to int64, limit int) string {
+		found := ""
+		e := db.Scan(from, to, func(key int64, value []byte) bool {
+			found += fmt.Sprintf("%d:%s,", key, value)
+			limit--
+			return limit != 0
+		})
+		if e != nil {
+			t.Fatal(e)
+		}
+		return found
+	}
+	if found := scan(0, 0, -1); found != "1:1,2:2,5:5,7:7,9:9," {
+		t.Errorf("found %s", found)
+	}
+	if found := scan(2, 9, 2); found != "2:2,5:5," {
+		t.Errorf("found %s, expected 2 k-v pairs from 2", found)
+	}
+
+	// the k-v pairs put, deleted and expired, in a sorted data file with expiry
+	db.SetTTL(time.Hour)
+	if _, e := db.SortData(); e != nil {
+		t.Fatal(e)
+	}
+	if found := scan(3, 0, -1); found != "5:5,7:7,9:9," {
+		t.Errorf("sorted found %s", found)
+	}
+	db.SetDataFileVersion(DataFileV2)
+	db.SetBlockCompression("none")
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	db.Put(6, []byte("6"))
+	db.Delete(7)
+	db.PutWithExpiry(9, []byte("expired 9"), time.Now().Add(-time.Second))
+	if found := scan(3, 10, -1); found != "5:5,6:6," {
+		t.Errorf("found %s, expected the deleted and expired keys left out", found)
+	}
+}
@@ -0,0 +1,22 @@
+package db
+
+// A k-v pair is deleted by appending a tombstone, which is a k-v pair without value
+// whose value_size is tombstoneValueSize, all bits set on disk. The tombstone is indexed
+// as the latest item of its key, so it shadows the older values, and Get returns
+// ErrNotFound for the key.
+
+const tombstoneValueSize int64 = -1
+
+// valueLength returns the bytes of value following a k-v pair header with valueSize
+func valueLength(valueSize int64) int64 {
+	if valueSize == tombstoneValueSize {
+		return 0
+	}
+	return valueSize
+}
+
+// Delete appends a tombstone of key to the last segment of the data file. The key is
+// not found by Get immediately, and the tombstone is indexed by the next CreateIndex.
+func (db *DB) Delete(key int64) error {
+	return db.append(key, tombstoneValueSize, nil, 0)
+}
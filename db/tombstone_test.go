@@ -0,0 +1,134 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+)
+
+// encodeTombstone encodes a tombstone of key in the data file format
+func encodeTombstone(key int64) []byte {
+	record := make([]byte, 24)
+	binary.BigEndian.PutUint64(record[0:8], 8)
+	binary.BigEndian.PutUint64(record[8:16], uint64(key))
+	binary.BigEndian.PutUint64(record[16:24], ^uint64(0))
+	return record
+}
+
+func Test_build_with_tombstones(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	data := encodeRecords([]int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	data = append(data, encodeTombstone(2)...)
+	data = append(data, encodeRecords([]int64{3}, []string{"new ccc"})...)
+	data = append(data, encodeTombstone(3)...)
+	data = append(data, encodeTombstone(9)...)
+	data = append(data, encodeRecords([]int64{4}, []string{"dddd"})...)
+	dataPath := dir + "/data/data.d"
+	createDirIfNotExist(dir + "/data")
+	if e := ioutil.WriteFile(dataPath, data, 0644); e != nil {
+		t.Fatal(e)
+	}
+
+	expected := map[int64]string{1: "a", 2: "", 3: "", 4: "dddd", 9: ""}
+
+	// the tombstones are valid k-v pairs, from a file and from a stream
+	fidx := newTestIndex(t, dir+"/index", 4)
+	if e := fidx.Build(dataPath, int(KB)); e != nil {
+		t.Fatal(e)
+	}
+	streamFidx := newTestIndex(t, dir+"/stream_index", 4)
+	if e := streamFidx.BuildFromReader(bytes.NewReader(data), dir+"/stream/data.d", int(KB)); e != nil {
+		t.Fatal(e)
+	}
+	for _, f := range []*FastIndex{fidx, streamFidx} {
+		if len(f.CorruptRecords()) != 0 {
+			t.Errorf("corrupt records %v, expected none", f.CorruptRecords())
+		}
+		opened := openTestIndex(t, f.dir, 4)
+		for k, v := range expected {
+			if found := findValue(t, opened, data, k); found != v {
+				t.Errorf("key:%d, v:%s, expected %s", k, found, v)
+			}
+		}
+		opened.Close()
+	}
+}
+
+func Test_db_delete(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2, 3}, []string{"a", "bb", "ccc"})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+
+	if e := db.Delete(2); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Delete(-1); e == nil {
+		t.Error("expected an error for a negative key")
+	}
+	if _, e := db.Get(2); e != ErrNotFound {
+		t.Errorf("deleted key:2, e:%v, expected ErrNotFound", e)
+	}
+
+	// a deleted key could be put again
+	if e := db.Put(3, []byte("x")); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Delete(3); e != nil {
+		t.Fatal(e)
+	}
+	if e := db.Put(3, []byte("new ccc")); e != nil {
+		t.Fatal(e)
+	}
+
+	expected := map[int64]string{1: "a", 3: "new ccc"}
+	check := func(stage string) {
+		for k, v := range expected {
+			if found, e := db.Get(k); e != nil || string(found) != v {
+				t.Errorf("%s key:%d, v:%s, e:%v, expected %s", stage, k, found, e, v)
+			}
+		}
+		if _, e := db.Get(2); e != ErrNotFound {
+			t.Errorf("%s deleted key:2, e:%v, expected ErrNotFound", stage, e)
+		}
+	}
+	check("put")
+
+	// the tombstones are replayed
+	db.Close()
+	db = OpenDB(dir)
+	db.InitFind()
+	check("reopened")
+
+	// a tombstone flushed into a generation shadows the index
+	db.SetMemtableSize(fixIndexItemSize)
+	if e := db.Delete(1); e != nil {
+		t.Fatal(e)
+	}
+	delete(expected, 1)
+	if len(db.fidx.generations()) == 0 {
+		t.Fatal("expected the tombstone flushed into a generation")
+	}
+	if _, e := db.Get(1); e != ErrNotFound {
+		t.Errorf("deleted key:1, e:%v, expected ErrNotFound", e)
+	}
+	check("flushed")
+
+	// and they are indexed by the next CreateIndex
+	db.Close()
+	db = OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+	if _, e := db.Get(1); e != ErrNotFound {
+		t.Errorf("rebuilt deleted key:1, e:%v, expected ErrNotFound", e)
+	}
+	check("rebuilt")
+}
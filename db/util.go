@@ -8,13 +8,11 @@ import (
 	"unsafe"
 )
 
-func createDirIfNotExist(dir string) {
+func createDirIfNotExist(dir string) error {
 	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		err = os.MkdirAll(dir, 0755)
-		if err != nil {
-			panic(err)
-		}
+		return os.MkdirAll(dir, 0755)
 	}
+	return nil
 }
 
 // NOTE: This function is copied from stdlib because it is not available on darwin.
@@ -44,6 +42,20 @@ func ReadableTime(time int) string {
 	}
 }
 
+func ReadableSize(size int64) string {
+	if size < KB {
+		return strconv.FormatInt(size, 10) + "B"
+	} else if size < MB {
+		return strconv.FormatFloat(float64(size)/float64(KB), 'f', 1, 64) + "K"
+	} else if size < GB {
+		return strconv.FormatFloat(float64(size)/float64(MB), 'f', 1, 64) + "M"
+	} else if size < TB {
+		return strconv.FormatFloat(float64(size)/float64(GB), 'f', 1, 64) + "G"
+	} else {
+		return strconv.FormatFloat(float64(size)/float64(TB), 'f', 1, 64) + "T"
+	}
+}
+
 func ParseSize(size string) (int64, bool) {
 	if len(size) < 2 {
 		return 0, false
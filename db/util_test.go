@@ -2,6 +2,8 @@ package db
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 	"testing"
 )
 
@@ -15,3 +17,27 @@ func Test_size_parse(t *testing.T) {
 		fmt.Println(n)
 	}
 }
+
+func Test_readable_size(t *testing.T) {
+	cases := map[int64]string{
+		512:        "512B",
+		16 * KB:    "16.0K",
+		3 * MB / 2: "1.5M",
+		16 * GB:    "16.0G",
+		2 * TB:     "2.0T",
+	}
+	for size, expected := range cases {
+		if s := ReadableSize(size); s != expected {
+			t.Errorf("ReadableSize(%d) = %s, expected %s", size, s, expected)
+		}
+	}
+}
+
+// tempDir creates a directory for a single test, call the returned func to remove it
+func tempDir(t *testing.T) (string, func()) {
+	dir, e := ioutil.TempDir("", "fastindex")
+	if e != nil {
+		t.Fatal(e)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
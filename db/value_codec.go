@@ -0,0 +1,102 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// With flagValueCodec every value of a data file starts with a flags byte, and the low 4
+// bits of it are the codec of the value:
+//
+//	value: <flags(1)=codecNone, raw value> or <flags(1), raw_size(4), compressed value>
+//
+// The value_size of a k-v pair and its index item is the size of the stored value, so only
+// Get knows a value is compressed. Unlike blocks, a large value is decompressed alone, and
+// a data file with compressed values could still be appended.
+
+const (
+	valueFlagsSize   = 1
+	valueCodecMask   = 0x0f
+	valueRawSizeSize = 4
+
+	defaultValueCompressMin = KB
+)
+
+var errCorruptValue = errors.New("corrupt compressed value")
+
+// valueEncoder compresses the values of at least minSize bytes by codec, a value which
+// doesn't get smaller is stored raw
+type valueEncoder struct {
+	codec   byte
+	minSize int64
+}
+
+func (enc valueEncoder) encode(value []byte) ([]byte, error) {
+	if enc.codec != codecNone && int64(len(value)) >= enc.minSize && len(value) > 0 {
+		c, e := codecByID(enc.codec)
+		if e != nil {
+			return nil, e
+		}
+		compressed, e := c.compress(value)
+		if e != nil {
+			return nil, e
+		}
+		if valueFlagsSize+valueRawSizeSize+len(compressed) < valueFlagsSize+len(value) {
+			stored := make([]byte, valueFlagsSize+valueRawSizeSize+len(compressed))
+			stored[0] = enc.codec
+			binary.BigEndian.PutUint32(stored[valueFlagsSize:], uint32(len(value)))
+			copy(stored[valueFlagsSize+valueRawSizeSize:], compressed)
+			return stored, nil
+		}
+	}
+
+	stored := make([]byte, valueFlagsSize+len(value))
+	stored[0] = codecNone
+	copy(stored[valueFlagsSize:], value)
+	return stored, nil
+}
+
+// decodeValue returns the raw value of a stored value, which is at most maxSize bytes
+func decodeValue(stored []byte, maxSize int64) ([]byte, error) {
+	if len(stored) < valueFlagsSize {
+		return nil, errCorruptValue
+	}
+	id := stored[0] & valueCodecMask
+	if id == codecNone {
+		return stored[valueFlagsSize:], nil
+	}
+
+	if len(stored) < valueFlagsSize+valueRawSizeSize {
+		return nil, errCorruptValue
+	}
+	c, e := codecByID(id)
+	if e != nil {
+		return nil, e
+	}
+	rawSize := int64(binary.BigEndian.Uint32(stored[valueFlagsSize:]))
+	if rawSize > maxSize {
+		return nil, fmt.Errorf("compressed value of raw size %d exceeds the limit %d", rawSize, maxSize)
+	}
+	raw, e := c.decompress(stored[valueFlagsSize+valueRawSizeSize:], int(rawSize))
+	if e != nil {
+		return nil, errCorruptValue
+	}
+	return raw, nil
+}
+
+// SetValueCompression makes Put, CreateData and Compact compress the values of at least
+// minSize bytes by codec: flate, lz4, or none. The data files created with a codec have a
+// flags byte in every value and are of format v2. A value is decompressed by Get with the
+// codec it was compressed with, whatever the codec set.
+func (db *DB) SetValueCompression(codec string, minSize int64) error {
+	id, e := codecByName(codec)
+	if e != nil {
+		return e
+	}
+	if minSize < 0 {
+		minSize = defaultValueCompressMin
+	}
+	db.valueEncoder = valueEncoder{codec: id, minSize: minSize}
+	return nil
+}
@@ -0,0 +1,155 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func Test_value_encoder(t *testing.T) {
+	large := bytes.Repeat([]byte("large value "), 1000)
+	random := make([]byte, 4*KB)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	enc := valueEncoder{codec: codecLZ4, minSize: KB}
+	for name, value := range map[string][]byte{"empty": {}, "small": []byte("small value"), "random": random, "large": large} {
+		stored, e := enc.encode(value)
+		if e != nil {
+			t.Fatal(e)
+		}
+		compressed := stored[0]&valueCodecMask != codecNone
+		if compressed != (name == "large") {
+			t.Errorf("%s: stored %d bytes with codec %d", name, len(stored), stored[0])
+		}
+		raw, e := decodeValue(stored, MB)
+		if e != nil || !bytes.Equal(raw, value) {
+			t.Errorf("%s: e:%v, decoded %d bytes, expected %d", name, e, len(raw), len(value))
+		}
+	}
+
+	stored, _ := valueEncoder{codec: codecFlate}.encode(large)
+	if _, e := decodeValue(stored, KB); e == nil {
+		t.Error("expected an error for a value over the limit")
+	}
+	if _, e := decodeValue(stored[:len(stored)/2], MB); e == nil {
+		t.Error("expected an error for a truncated value")
+	}
+	if _, e := decodeValue(nil, MB); e == nil {
+		t.Error("expected an error for a value without flags")
+	}
+}
+
+func Test_data_file_gen_value_codec(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	gen := &DataFileGen{
+		maxKey:         1 << 20,
+		maxValueLength: 2 * KB,
+		writeBufSize:   int(4 * KB),
+		maxSize:        256 * KB,
+		valueEncoder:   valueEncoder{codec: codecFlate},
+		path:           dir + "/data/data.d",
+	}
+	if e := gen.generate(); e != nil {
+		t.Fatal(e)
+	}
+
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	if len(db.CorruptRecords()) != 0 {
+		t.Errorf("corrupt records:%v", db.CorruptRecords())
+	}
+	db.InitFind()
+	if !db.formats[0].valueCoded() {
+		t.Fatalf("format:%+v, expected compressed values", db.formats[0])
+	}
+
+	f, _ := os.Open(dir + "/data/data.d")
+	defer f.Close()
+	info, _ := f.Stat()
+	compressed := 0
+	e := forEachRecord(f, db.formats[0], 0, info.Size(), 0, func(record []byte, valuePos int64, read int64) error {
+		key := int64(binary.BigEndian.Uint64(record[8:16]))
+		if record[24]&valueCodecMask == codecFlate {
+			compressed++
+		}
+		value, e := db.Get(key)
+		if e != nil || strings.Trim(string(value), strconv.FormatInt(key, 10)) != "" {
+			t.Errorf("key:%d, v:%s, e:%v", key, value, e)
+		}
+		return nil
+	}, nil)
+	if e != nil {
+		t.Fatal(e)
+	}
+	if compressed == 0 {
+		t.Error("no compressed values")
+	}
+}
+
+func Test_db_value_codec(t *testing.T) {
+	dir, clean := tempDir(t)
+	defer clean()
+
+	large := strings.Repeat("large value ", 1000)
+	writeRecords(t, dir+"/data/data.d", []int64{1, 2}, []string{"a", large})
+	db := OpenDB(dir)
+	db.indexShardNum = 4
+	db.CreateIndex()
+	db.InitFind()
+
+	expected := map[int64]string{1: "a", 2: large}
+	check := func(stage string) {
+		for k, v := range expected {
+			if found, e := db.Get(k); e != nil || string(found) != v {
+				t.Errorf("%s key:%d, v:%d bytes, e:%v, expected %d bytes", stage, k, len(found), e, len(v))
+			}
+		}
+	}
+
+	// compaction compresses the large values, and Put compresses the new ones
+	if e := db.SetValueCompression("lz4", KB); e != nil {
+		t.Fatal(e)
+	}
+	stats, e := db.Compact()
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !db.formats[0].valueCoded() || stats.SizeAfter >= stats.SizeBefore {
+		t.Errorf("format:%+v, stats:%+v, expected compressed values", db.formats[0], stats)
+	}
+	check("compacted")
+	if e := db.Put(3, []byte(large+"3")); e != nil {
+		t.Fatal(e)
+	}
+	expected[3] = large + "3"
+	check("put")
+
+	db.Close()
+	db = OpenDB(dir)
+	db.SetVerifyChecksums(true)
+	db.CreateIndex()
+	db.InitFind()
+	check("rebuilt")
+	if vsize, _ := db.fidx.Find(3); vsize >= int64(len(large)) {
+		t.Errorf("value size:%d, expected compressed", vsize)
+	}
+
+	// and decompressed into a data file without the flags byte
+	db.SetDataFileVersion(DataFileV2)
+	db.SetValueCompression("none", 0)
+	if _, e := db.Compact(); e != nil {
+		t.Fatal(e)
+	}
+	check("decompressed")
+	if db.formats[0].valueCoded() {
+		t.Errorf("format:%+v, expected raw values", db.formats[0])
+	}
+}
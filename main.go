@@ -4,6 +4,7 @@ import (
 	dbBase "fastindex/db"
 	"flag"
 	"fmt"
+	"os"
 	"sync"
 	"time"
 )
@@ -13,9 +14,89 @@ func main() {
 	var dir string
 	var dataSize string
 	var cmd string
+	var segmentSize string
+	var corrupt string
+	var maxValueSize string
+	var mem string
+	var shards int
+	var sharder string
+	var key int64
+	var rate string
+	var format int
+	var verify bool
+	var compress string
+	var valueCompress string
+	var valueCompressMin string
+	var keyFile string
+	var encrypt bool
+	var ttl time.Duration
+	var input string
+	var importFormat string
+	var keyColumn string
+	var valueColumn string
+	var keyType string
+	var header bool
+	var index bool
+	var output string
+	var exportFormat string
+	var order string
+	var from int64
+	var to int64
+	var sample float64
+	var all bool
+	var keyDist string
+	var zipfS float64
+	var valueSizeDist string
+	var valueContent string
+	var compressRatio float64
+	var seed int64
+	var keyManifest bool
+	var hitRatio float64
+	var workers int
+	var watch time.Duration
 	flag.StringVar(&dir, "dir", "", "specify the base dir")
 	flag.StringVar(&dataSize, "size", "16G", "specify the dataSize, such as: 4M, 16G, 128G, 1T")
-	flag.StringVar(&cmd, "cmd", "", "createData: create data file; createIndex: create indexFile; findTest: testing find k-v")
+	flag.StringVar(&segmentSize, "segmentSize", "", "rotate the data file into segments of segmentSize when createData or compact, such as: 1G")
+	flag.StringVar(&corrupt, "corrupt", "abort", "how to handle corrupt k-v pairs when createIndex, ingest or compact: abort, skip or quarantine")
+	flag.StringVar(&maxValueSize, "maxValueSize", "2M", "the limit of value size, a k-v pair with larger value size is corrupt")
+	flag.StringVar(&mem, "mem", "", "limit the memory of buffers when createIndex, ingest or reshard, such as: 256M")
+	flag.IntVar(&shards, "shards", 1000, "the shard count of the index when createIndex, ingest or reshard")
+	flag.StringVar(&sharder, "sharder", "mod", "how keys are sharded when createIndex, ingest or reshard: mod or hash")
+	flag.Int64Var(&key, "key", -1, "the key to delete")
+	flag.IntVar(&format, "format", 1, "the format version of data file when createData: 1, or 2 with a file header and checksums")
+	flag.StringVar(&compress, "compress", "", "compress the k-v pairs in blocks when createData or compact: none, flate or lz4, compact converts the data file into -format with it")
+	flag.StringVar(&valueCompress, "valueCompress", "", "compress every value alone when createData or compact: none, flate or lz4, compact converts the data file into -format with it")
+	flag.StringVar(&valueCompressMin, "valueCompressMin", "1K", "the min size of values compressed by -valueCompress")
+	flag.StringVar(&keyFile, "keyFile", "", "the file of lines <id> <hex key> to decrypt values, and to encrypt by the last key with -encrypt")
+	flag.BoolVar(&encrypt, "encrypt", false, "encrypt the values by AES-GCM when createData or compact, compact converts the data file into -format with it")
+	flag.DurationVar(&ttl, "ttl", 0, "k-v pairs expire randomly within ttl when createData, such as: 24h, compact converts the data file into -format with expiry with it")
+	flag.StringVar(&input, "input", "", "the file to import, stdin if empty or -")
+	flag.StringVar(&importFormat, "importFormat", "csv", "the format of rows when import: csv, tsv or jsonl")
+	flag.StringVar(&keyColumn, "keyColumn", "0", "the key column when import, a column name with -header or a 0-based number, or a field of jsonl")
+	flag.StringVar(&valueColumn, "valueColumn", "1", "the value column when import, like -keyColumn, an empty value field of jsonl is the whole line")
+	flag.StringVar(&keyType, "keyType", "int64", "the type of keys when import: int64, or bytes hashed into int64")
+	flag.BoolVar(&header, "header", false, "the first row of csv or tsv is the column names when import")
+	flag.BoolVar(&index, "index", true, "create indexFile of -shards shards along with import")
+	flag.StringVar(&output, "output", "", "the file to export into, stdout if empty or -")
+	flag.StringVar(&exportFormat, "exportFormat", "jsonl", "the format of k-v pairs when export: jsonl, csv or hex")
+	flag.StringVar(&order, "order", "data", "the order of k-v pairs when export: data, or key by the index")
+	flag.Int64Var(&from, "from", 0, "export the keys from -from, inclusive")
+	flag.Int64Var(&to, "to", 0, "export the keys until -to, exclusive, 0 means no end")
+	flag.Float64Var(&sample, "sample", 0, "export about the fraction of keys, such as: 0.01, 0 means all")
+	flag.BoolVar(&all, "all", false, "export every k-v pair in data order with its position, the overwritten, deleted and expired ones included")
+	flag.StringVar(&keyDist, "keyDist", "uniform", "the distribution of keys when createData: uniform, zipf, sequential or permutation")
+	flag.Float64Var(&zipfS, "zipfS", 1.1, "the exponent of -keyDist zipf, it must be > 1")
+	flag.StringVar(&valueSizeDist, "valueSizeDist", "uniform", "the distribution of value sizes when createData: uniform, fixed or lognormal")
+	flag.StringVar(&valueContent, "valueContent", "key", "the content of values when createData: key repeated, random or compressible")
+	flag.Float64Var(&compressRatio, "compressRatio", 2, "-valueContent compressible compresses to about 1/compressRatio")
+	flag.Int64Var(&seed, "seed", 0, "the seed of keys and values when createData, 0 means a random seed")
+	flag.BoolVar(&keyManifest, "keyManifest", false, "write the keys and the checksums of values when createData, for findTest to verify")
+	flag.Float64Var(&hitRatio, "hitRatio", 1, "the ratio of keys found when findTest with the keys of -keyManifest, -seed samples the keys")
+	flag.DurationVar(&watch, "watch", 0, "reload the index when a new one is published, polling it every watch when findTest, such as: 1s")
+	flag.IntVar(&workers, "workers", 1, "generate the data file in parallel when createData, into a segment per worker or segments of -segmentSize")
+	flag.BoolVar(&verify, "verify", false, "verify the checksums of k-v pairs when createIndex or ingest")
+	flag.StringVar(&rate, "rate", "", "limit the bytes read per second when compact or sortData, such as: 64M")
+	flag.StringVar(&cmd, "cmd", "", "createData: create data file; createIndex: create indexFile; ingest: create data file and indexFile from stdin; reshard: redistribute indexFile into -shards shards; delete: delete -key; compact: rewrite the live k-v pairs and reclaim space; sortData: rewrite the live k-v pairs in key order into blocks; import: create data file from csv, tsv or jsonl of -input; export: write k-v pairs as jsonl, csv or hex into -output; findTest: testing find k-v")
 	flag.Parse()
 
 	if dir == "" {
@@ -23,19 +104,138 @@ func main() {
 		return
 	}
 
+	var keys dbBase.KeyProvider
+	if keyFile != "" {
+		loaded, e := dbBase.LoadKeyFile(keyFile)
+		if e != nil {
+			fmt.Println("invalid keyFile:", e)
+			return
+		}
+		keys = loaded
+	} else if encrypt {
+		fmt.Println("-encrypt needs -keyFile")
+		return
+	}
+
 	if cmd == "createData" {
 		size, ok := dbBase.ParseSize(dataSize)
 		if !ok {
 			fmt.Println("invalid size")
 			return
 		}
-		createData(dir, size, dataSize)
+		var maxSegmentSize int64 = 0
+		if segmentSize != "" {
+			if maxSegmentSize, ok = dbBase.ParseSize(segmentSize); !ok {
+				fmt.Println("invalid segmentSize")
+				return
+			}
+		}
+		cfg, ok := newDataConfig(format, compress, valueCompress, valueCompressMin)
+		if !ok {
+			return
+		}
+		cfg.keys, cfg.encrypt, cfg.ttl = keys, encrypt, ttl
+		cfg.dist = dbBase.Distribution{Keys: keyDist, ZipfS: zipfS, ValueSize: valueSizeDist, Content: valueContent,
+			CompressRatio: compressRatio, Seed: seed}
+		cfg.keyManifest = keyManifest
+		cfg.workers = workers
+		createData(dir, size, dataSize, maxSegmentSize, cfg)
+		return
+	} else if cmd == "createIndex" || cmd == "ingest" || cmd == "reshard" {
+		cfg := buildConfig{shardNum: shards, verify: verify}
+		var ok bool
+		if cfg.sharder, ok = dbBase.SharderByName(sharder); !ok || shards <= 0 {
+			fmt.Println("invalid shards or sharder")
+			return
+		}
+		cfg.policy, ok = dbBase.ParseCorruptPolicy(corrupt)
+		if !ok {
+			fmt.Println("invalid corrupt policy")
+			return
+		}
+		if cfg.maxValueSize, ok = dbBase.ParseSize(maxValueSize); !ok {
+			fmt.Println("invalid maxValueSize")
+			return
+		}
+		if mem != "" {
+			if cfg.memBudget, ok = dbBase.ParseSize(mem); !ok {
+				fmt.Println("invalid mem")
+				return
+			}
+		}
+		if cmd == "createIndex" {
+			createIndex(dir, cfg)
+		} else if cmd == "ingest" {
+			ingest(dir, cfg)
+		} else {
+			reshard(dir, cfg)
+		}
+		return
+	} else if cmd == "delete" {
+		if key < 0 {
+			fmt.Println("invalid key")
+			return
+		}
+		deleteKey(dir, key, keys)
+		return
+	} else if cmd == "compact" || cmd == "sortData" {
+		var compactionRate int64 = 0
+		if rate != "" {
+			var ok bool
+			if compactionRate, ok = dbBase.ParseSize(rate); !ok {
+				fmt.Println("invalid rate")
+				return
+			}
+		}
+		var maxSegmentSize int64 = 0
+		if segmentSize != "" {
+			var ok bool
+			if maxSegmentSize, ok = dbBase.ParseSize(segmentSize); !ok {
+				fmt.Println("invalid segmentSize")
+				return
+			}
+		}
+		cfg, ok := newDataConfig(format, compress, valueCompress, valueCompressMin)
+		if !ok {
+			return
+		}
+		cfg.keys, cfg.encrypt, cfg.ttl = keys, encrypt, ttl
+		policy, ok := dbBase.ParseCorruptPolicy(corrupt)
+		if !ok {
+			fmt.Println("invalid corrupt policy")
+			return
+		}
+		compact(dir, cmd, compactionRate, maxSegmentSize, policy, cfg)
+		return
+	} else if cmd == "import" {
+		var maxSegmentSize int64 = 0
+		if segmentSize != "" {
+			var ok bool
+			if maxSegmentSize, ok = dbBase.ParseSize(segmentSize); !ok {
+				fmt.Println("invalid segmentSize")
+				return
+			}
+		}
+		shardBy, ok := dbBase.SharderByName(sharder)
+		if !ok || shards <= 0 {
+			fmt.Println("invalid shards or sharder")
+			return
+		}
+		cfg, ok := newDataConfig(format, compress, valueCompress, valueCompressMin)
+		if !ok {
+			return
+		}
+		cfg.keys, cfg.encrypt = keys, encrypt
+		opts := dbBase.ImportOptions{Format: importFormat, Header: header, KeyColumn: keyColumn,
+			ValueColumn: valueColumn, KeyType: keyType, Index: index}
+		importData(dir, input, opts, maxSegmentSize, shards, shardBy, cfg)
 		return
-	} else if cmd == "createIndex" {
-		createIndex(dir)
+	} else if cmd == "export" {
+		opts := dbBase.ExportOptions{Format: exportFormat, Order: order, From: from, To: to, Sample: sample, All: all}
+		exportData(dir, output, opts, keys)
 		return
 	} else if cmd == "findTest" {
-		findTest(dir)
+		findTest(dir, keys, hitRatio, seed, watch)
 		return
 	} else {
 		fmt.Println("unsupported cmd ")
@@ -43,12 +243,73 @@ func main() {
 
 }
 
-func createData(dir string, size int64, dataSize string) {
+// dataConfig is the format of data files created from the command line
+type dataConfig struct {
+	format           int
+	compress         string
+	valueCompress    string
+	valueCompressMin int64
+	keys             dbBase.KeyProvider
+	encrypt          bool
+	ttl              time.Duration
+	dist             dbBase.Distribution
+	keyManifest      bool
+	workers          int
+}
+
+func newDataConfig(format int, compress string, valueCompress string, valueCompressMin string) (dataConfig, bool) {
+	cfg := dataConfig{format: format, compress: compress, valueCompress: valueCompress}
+	var ok bool
+	if cfg.valueCompressMin, ok = dbBase.ParseSize(valueCompressMin); !ok {
+		fmt.Println("invalid valueCompressMin")
+	}
+	return cfg, ok
+}
+
+// converts tells whether the data file is converted into the format when compact
+func (cfg dataConfig) converts() bool {
+	return cfg.compress != "" || cfg.valueCompress != "" || cfg.encrypt || cfg.ttl > 0
+}
+
+func (cfg dataConfig) apply(db *dbBase.DB) error {
+	db.SetKeyProvider(cfg.keys, cfg.encrypt)
+	db.SetTTL(cfg.ttl)
+	if e := db.SetDataFileVersion(cfg.format); e != nil {
+		return e
+	}
+	if cfg.compress != "" {
+		if e := db.SetBlockCompression(cfg.compress); e != nil {
+			return e
+		}
+	}
+	if cfg.valueCompress != "" {
+		if e := db.SetValueCompression(cfg.valueCompress, cfg.valueCompressMin); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func createData(dir string, size int64, dataSize string, maxSegmentSize int64, cfg dataConfig) {
 	fmt.Println("call createData... ")
 	start := time.Now()
 
 	db := dbBase.OpenDB(dir)
-	db.CreateData(size)
+	db.SetMaxSegmentSize(maxSegmentSize)
+	if e := cfg.apply(db); e != nil {
+		fmt.Println(e)
+		return
+	}
+	if e := db.SetDistribution(cfg.dist); e != nil {
+		fmt.Println(e)
+		return
+	}
+	db.SetKeyManifest(cfg.keyManifest)
+	db.SetGenWorkers(cfg.workers)
+	if e := db.CreateData(size); e != nil {
+		fmt.Println("createData error:", e)
+		return
+	}
 
 	end := time.Now()
 	costTime := dbBase.ReadableTime(int(end.Sub(start)))
@@ -56,27 +317,369 @@ func createData(dir string, size int64, dataSize string) {
 	fmt.Println()
 }
 
-func createIndex(dir string) {
+// buildConfig is the options of building index from the command line
+type buildConfig struct {
+	policy       dbBase.CorruptPolicy
+	maxValueSize int64
+	memBudget    int64
+	shardNum     int
+	sharder      dbBase.Sharder
+	verify       bool
+}
+
+func (cfg buildConfig) apply(db *dbBase.DB) {
+	db.OnBuildProgress(newProgressPrinter())
+	db.SetCorruptPolicy(cfg.policy, cfg.maxValueSize)
+	db.SetMemoryBudget(cfg.memBudget)
+	db.SetSharding(cfg.shardNum, cfg.sharder)
+	db.SetVerifyChecksums(cfg.verify)
+}
+
+func createIndex(dir string, cfg buildConfig) {
 	fmt.Println("call createIndex... ")
 	start := time.Now()
 
 	db := dbBase.OpenDB(dir)
-	db.CreateIndex()
+	cfg.apply(db)
+	if e := db.CreateIndex(); e != nil {
+		fmt.Println()
+		fmt.Println("createIndex error:", e)
+		return
+	}
+	fmt.Println()
+	printCorruptRecords(db.CorruptRecords())
 
 	end := time.Now()
 	costTime := dbBase.ReadableTime(int(end.Sub(start)))
 	fmt.Println("createIndex successfully. cost time:", costTime)
 }
 
-func findTest(dir string) {
+func ingest(dir string, cfg buildConfig) {
+	fmt.Println("call ingest... ")
+	start := time.Now()
+
+	db := dbBase.OpenDB(dir)
+	cfg.apply(db)
+	if e := db.Ingest(os.Stdin); e != nil {
+		fmt.Println()
+		fmt.Println("ingest error:", e)
+		return
+	}
+	fmt.Println()
+	printCorruptRecords(db.CorruptRecords())
+
+	end := time.Now()
+	costTime := dbBase.ReadableTime(int(end.Sub(start)))
+	fmt.Println("ingest successfully. cost time:", costTime)
+}
+
+func reshard(dir string, cfg buildConfig) {
+	fmt.Println("call reshard... ")
+	start := time.Now()
+
+	db := dbBase.OpenDB(dir)
+	cfg.apply(db)
+	if e := db.Reshard(cfg.shardNum, cfg.sharder); e != nil {
+		fmt.Println()
+		fmt.Println("reshard error:", e)
+		return
+	}
+	fmt.Println()
+
+	end := time.Now()
+	costTime := dbBase.ReadableTime(int(end.Sub(start)))
+	fmt.Println("reshard successfully. cost time:", costTime)
+}
+
+func deleteKey(dir string, key int64, keys dbBase.KeyProvider) {
+	db := dbBase.OpenDB(dir)
+	db.SetKeyProvider(keys, false)
+	if e := db.InitFind(); e != nil {
+		fmt.Println("open error:", e)
+		return
+	}
+	defer db.Close()
+	if _, e := db.Get(key); e == dbBase.ErrNotFound {
+		fmt.Println("key not found:", key)
+		return
+	}
+	if e := db.Delete(key); e != nil {
+		fmt.Println("delete error:", e)
+		return
+	}
+	fmt.Println("delete successfully. key:", key)
+}
+
+// compact compacts the data file, or sorts it in key order if cmd is sortData
+func compact(dir string, cmd string, rate int64, maxSegmentSize int64, policy dbBase.CorruptPolicy, cfg dataConfig) {
+	fmt.Printf("call %s... ", cmd)
+	fmt.Println()
+	start := time.Now()
+
+	db := dbBase.OpenDB(dir)
+	db.OnBuildProgress(newProgressPrinter())
+	db.SetCompactionRate(rate)
+	db.SetCorruptPolicy(policy, 0)
+	db.SetMaxSegmentSize(maxSegmentSize)
+	// without -compress, -valueCompress, -encrypt or -ttl the data file keeps its format
+	db.SetKeyProvider(cfg.keys, false)
+	if cfg.converts() {
+		if e := cfg.apply(db); e != nil {
+			fmt.Println(e)
+			return
+		}
+	}
+	if e := db.InitFind(); e != nil {
+		fmt.Printf("%s error: %s", cmd, e)
+		fmt.Println()
+		return
+	}
+	defer db.Close()
+	var stats dbBase.CompactStats
+	var e error
+	if cmd == "sortData" {
+		stats, e = db.SortData()
+	} else {
+		stats, e = db.Compact()
+	}
+	fmt.Println()
+	if e != nil {
+		fmt.Printf("%s error: %s", cmd, e)
+		fmt.Println()
+		return
+	}
+	fmt.Printf("rewrote %d records, dropped %d, expired %d, %s -> %s, reclaimed %s",
+		stats.Records, stats.Dropped, stats.Expired, dbBase.ReadableSize(stats.SizeBefore), dbBase.ReadableSize(stats.SizeAfter),
+		dbBase.ReadableSize(stats.Reclaimed()))
+	fmt.Println()
+	if stats.Corrupt > 0 {
+		fmt.Printf("dropped %d corrupt records, %s", stats.Corrupt, dbBase.ReadableSize(stats.CorruptBytes))
+		fmt.Println()
+	}
+
+	end := time.Now()
+	costTime := dbBase.ReadableTime(int(end.Sub(start)))
+	fmt.Printf("%s successfully. cost time:%v", cmd, costTime)
+	fmt.Println()
+}
+
+func importData(dir string, input string, opts dbBase.ImportOptions, maxSegmentSize int64, shards int,
+	sharder dbBase.Sharder, cfg dataConfig) {
+	fmt.Println("call import... ")
+	start := time.Now()
+
+	r := os.Stdin
+	if input != "" && input != "-" {
+		f, e := os.Open(input)
+		if e != nil {
+			fmt.Println("invalid input:", e)
+			return
+		}
+		defer f.Close()
+		r = f
+	}
+
+	db := dbBase.OpenDB(dir)
+	db.OnBuildProgress(newProgressPrinter())
+	db.SetMaxSegmentSize(maxSegmentSize)
+	db.SetSharding(shards, sharder)
+	if e := cfg.apply(db); e != nil {
+		fmt.Println(e)
+		return
+	}
+	stats, e := db.Import(r, opts)
+	fmt.Println()
+	if e != nil {
+		fmt.Println("import error:", e)
+		return
+	}
+	fmt.Printf("imported %d records from %s", stats.Records, dbBase.ReadableSize(stats.Bytes))
+	fmt.Println()
+
+	end := time.Now()
+	costTime := dbBase.ReadableTime(int(end.Sub(start)))
+	fmt.Println("import successfully. cost time:", costTime)
+}
+
+// exportData prints to stderr, as the k-v pairs could be exported to stdout
+func exportData(dir string, output string, opts dbBase.ExportOptions, keys dbBase.KeyProvider) {
+	fmt.Fprintln(os.Stderr, "call export... ")
+	start := time.Now()
+
+	w := os.Stdout
+	if output != "" && output != "-" {
+		f, e := os.Create(output)
+		if e != nil {
+			fmt.Fprintln(os.Stderr, "invalid output:", e)
+			return
+		}
+		defer f.Close()
+		w = f
+	}
+
+	db := dbBase.OpenDB(dir)
+	db.SetKeyProvider(keys, false)
+	if e := db.InitFind(); e != nil {
+		fmt.Fprintln(os.Stderr, "export error:", e)
+		return
+	}
+	defer db.Close()
+	stats, e := db.Export(w, opts)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "export error:", e)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "exported %d records, %s", stats.Records, dbBase.ReadableSize(stats.Bytes))
+	fmt.Fprintln(os.Stderr)
+
+	end := time.Now()
+	costTime := dbBase.ReadableTime(int(end.Sub(start)))
+	fmt.Fprintln(os.Stderr, "export successfully. cost time:", costTime)
+}
+
+// printCorruptRecords prints the report of corrupt k-v pairs found when building index
+func printCorruptRecords(records []dbBase.CorruptRecord) {
+	if len(records) == 0 {
+		return
+	}
+
+	var skipped int64 = 0
+	for _, r := range records {
+		skipped += r.Length
+	}
+	fmt.Printf("found %d corrupt records, skipped %s:", len(records), dbBase.ReadableSize(skipped))
+	fmt.Println()
+	for i, r := range records {
+		if i == 20 {
+			fmt.Printf("  ... and %d more", len(records)-i)
+			fmt.Println()
+			break
+		}
+		fmt.Println(" ", r)
+	}
+}
+
+// newProgressPrinter renders build progress in a single refreshing line
+func newProgressPrinter() dbBase.ProgressFunc {
+	var lastPhase dbBase.BuildPhase
+	var lastPrint time.Time
+	return func(p dbBase.BuildProgress) {
+		// refresh at most 5 times per second, but never miss a phase change or its end
+		now := time.Now()
+		finished := p.ShardsDone == p.ShardNum
+		if p.Phase == dbBase.PhaseScan {
+			finished = p.BytesParsed == p.TotalBytes
+		}
+		if p.Phase == lastPhase && !finished && now.Sub(lastPrint) < 200*time.Millisecond {
+			return
+		}
+		if lastPhase != "" && p.Phase != lastPhase {
+			fmt.Println()
+		}
+		lastPhase = p.Phase
+		lastPrint = now
+
+		eta := "-"
+		if d := p.ETA(); d >= 0 {
+			eta = dbBase.ReadableTime(int(d))
+		}
+
+		var line string
+		if p.Phase == dbBase.PhaseScan && p.TotalBytes <= 0 {
+			line = fmt.Sprintf("[%s] %s, records:%d, %s/s",
+				p.Phase, dbBase.ReadableSize(p.BytesParsed), p.Records, dbBase.ReadableSize(int64(p.Throughput)))
+		} else if p.Phase == dbBase.PhaseScan {
+			percent := 0.0
+			if p.TotalBytes > 0 {
+				percent = float64(p.BytesParsed) * 100 / float64(p.TotalBytes)
+			}
+			line = fmt.Sprintf("[%s] %s/%s %.1f%%, records:%d, %s/s, ETA:%s",
+				p.Phase, dbBase.ReadableSize(p.BytesParsed), dbBase.ReadableSize(p.TotalBytes), percent,
+				p.Records, dbBase.ReadableSize(int64(p.Throughput)), eta)
+		} else {
+			line = fmt.Sprintf("[%s] shards %d/%d, ETA:%s", p.Phase, p.ShardsDone, p.ShardNum, eta)
+		}
+		fmt.Printf("\r%-80s", line)
+	}
+}
+
+// findTest finds the keys sampled from the key manifest at hitRatio and verifies their
+// values, or random keys without a key manifest
+func findTest(dir string, keys dbBase.KeyProvider, hitRatio float64, seed int64, watch time.Duration) {
 	fmt.Println("call findTest... ")
 	start := time.Now()
 
 	db := dbBase.OpenDB(dir)
-	db.InitFind()
+	db.SetKeyProvider(keys, false)
+	if e := db.InitFind(); e != nil {
+		fmt.Println("findTest error:", e)
+		return
+	}
+	defer db.Close()
+	if watch > 0 {
+		db.Watch(watch, func(e error) {
+			if e != nil {
+				fmt.Println("reload error:", e)
+			} else {
+				fmt.Println("index reloaded")
+			}
+		})
+	}
 
 	concurrent := 10
 	loopCnt := 1000 * 10
+	testKeys, expiring, e := db.TestKeys(concurrent*loopCnt, hitRatio, seed)
+	if os.IsNotExist(e) {
+		fmt.Println("no key manifest, finding random keys without verifying, createData with -keyManifest to verify")
+		findRandomKeys(db, start, concurrent, loopCnt)
+		return
+	} else if e != nil {
+		fmt.Println("findTest error:", e)
+		return
+	}
+
+	results := make([]dbBase.FindTestStats, concurrent)
+	wg := sync.WaitGroup{}
+	wg.Add(concurrent)
+	for i := 0; i < concurrent; i++ {
+		go func(curr int) {
+			results[curr] = db.FindTest(testKeys[curr*loopCnt:(curr+1)*loopCnt], expiring)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+
+	end := time.Now()
+	costTime := dbBase.ReadableTime(int(end.Sub(start)))
+
+	stats := results[0]
+	for _, r := range results[1:] {
+		stats.Hits += r.Hits
+		stats.Misses += r.Misses
+		stats.Expired += r.Expired
+		stats.Wrong += r.Wrong
+		stats.HitTime += r.HitTime
+		stats.MissTime += r.MissTime
+	}
+	avgHitTime, avgMissTime := "-", "-"
+	if stats.Hits > 0 {
+		avgHitTime = dbBase.ReadableTime(int(stats.HitTime) / int(stats.Hits))
+	}
+	if stats.Misses > 0 {
+		avgMissTime = dbBase.ReadableTime(int(stats.MissTime) / int(stats.Misses))
+	}
+	fmt.Printf("hits:%d, avg time:%v, misses:%d, avg time:%v, expired:%d", stats.Hits, avgHitTime, stats.Misses, avgMissTime, stats.Expired)
+	fmt.Println()
+	if stats.Wrong > 0 {
+		fmt.Printf("findTest failed. %d keys of %d found wrong, cost time:%v", stats.Wrong, concurrent*loopCnt, costTime)
+		fmt.Println()
+		return
+	}
+	fmt.Printf("findTest successfully. total op:%d, cost time:%v", concurrent*loopCnt, costTime)
+	fmt.Println()
+}
+
+func findRandomKeys(db *dbBase.DB, start time.Time, concurrent int, loopCnt int) {
 	avgTimes := make([]int, concurrent)
 
 	wg := sync.WaitGroup{}